@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// banList tracks misbehaving clients,
+// banning them after too many strikes within a window
+type banList interface {
+	Strike(ctx context.Context, client string) (banned bool, err error)
+	Banned(ctx context.Context, client string) (bool, error)
+}
+
+type abuseOpts struct {
+	threshold int
+	window    time.Duration
+	ban       time.Duration
+	redis     string
+}
+
+func (o *abuseOpts) Flags(fs *flag.FlagSet) {
+	fs.IntVar(&o.threshold, "abuse.threshold", 10, "bad requests within abuse.window before a client is banned, 0 to disable")
+	fs.DurationVar(&o.window, "abuse.window", time.Minute, "window to count bad requests in")
+	fs.DurationVar(&o.ban, "abuse.ban", 10*time.Minute, "duration of a ban")
+	fs.StringVar(&o.redis, "abuse.redis", "", "host:port of redis to share bans, in memory if empty")
+}
+
+func (o abuseOpts) validate() error {
+	if o.threshold > 0 && o.window <= 0 {
+		return fmt.Errorf("abuse.window must be positive with abuse.threshold set")
+	}
+	return nil
+}
+
+func (o abuseOpts) banList(ctx context.Context) (banList, error) {
+	if o.threshold <= 0 {
+		return noBans{}, nil
+	}
+	if o.redis != "" {
+		rc, err := newRedis(ctx, o.redis)
+		if err != nil {
+			return nil, fmt.Errorf("abuse redis: %w", err)
+		}
+		return &redisBans{rc, o}, nil
+	}
+	m := &memBans{
+		abuseOpts: o,
+		clients:   make(map[string]*memBan),
+	}
+	go m.prune(ctx)
+	return m, nil
+}
+
+type noBans struct{}
+
+func (noBans) Strike(context.Context, string) (bool, error) { return false, nil }
+func (noBans) Banned(context.Context, string) (bool, error) { return false, nil }
+
+type memBan struct {
+	strikes int
+	start   time.Time
+	until   time.Time
+}
+
+type memBans struct {
+	abuseOpts
+	mu      sync.Mutex
+	clients map[string]*memBan
+}
+
+func (m *memBans) Strike(ctx context.Context, client string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := time.Now()
+	b, ok := m.clients[client]
+	if !ok {
+		b = &memBan{}
+		m.clients[client] = b
+	}
+	if t.Sub(b.start) > m.window {
+		b.strikes, b.start = 0, t
+	}
+	b.strikes++
+	if b.strikes >= m.threshold {
+		b.until = t.Add(m.ban)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *memBans) Banned(ctx context.Context, client string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.clients[client]
+	return ok && time.Now().Before(b.until), nil
+}
+
+func (m *memBans) prune(ctx context.Context) {
+	t := time.NewTicker(m.window)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			m.mu.Lock()
+			for c, b := range m.clients {
+				if now.Sub(b.start) > m.window && now.After(b.until) {
+					delete(m.clients, c)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+type redisBans struct {
+	rc *redisClient
+	abuseOpts
+}
+
+// strikeScript counts a strike, starting the window on the first,
+// in one step so the count can't be left without an expiry
+const strikeScript = `redis.call("SET", KEYS[1], 0, "NX", "PX", ARGV[1])
+return redis.call("INCR", KEYS[1])`
+
+func (r *redisBans) Strike(ctx context.Context, client string) (bool, error) {
+	k := "statslogger:strikes:" + client
+	n, err := r.rc.Int(ctx, "EVAL", strikeScript, "1", k, fmt.Sprint(r.window.Milliseconds()))
+	if err != nil {
+		return false, err
+	}
+	if n < int64(r.threshold) {
+		return false, nil
+	}
+	err = r.rc.OK(ctx, "SET", "statslogger:banned:"+client, "1", "PX", fmt.Sprint(r.ban.Milliseconds()))
+	return err == nil, err
+}
+
+func (r *redisBans) Banned(ctx context.Context, client string) (bool, error) {
+	n, err := r.rc.Int(ctx, "EXISTS", "statslogger:banned:"+client)
+	return n == 1, err
+}
+
+type abuseMetrics struct {
+	strikes prometheus.Counter
+	bans    prometheus.Counter
+	blocked prometheus.Counter
+}
+
+func newAbuseMetrics(f promauto.Factory) abuseMetrics {
+	return abuseMetrics{
+		strikes: f.NewCounter(prometheus.CounterOpts{
+			Name: "abuse_strikes",
+		}),
+		bans: f.NewCounter(prometheus.CounterOpts{
+			Name: "abuse_bans",
+		}),
+		blocked: f.NewCounter(prometheus.CounterOpts{
+			Name: "abuse_blocked_requests",
+		}),
+	}
+}
+
+func (r *redisBans) Ping(ctx context.Context) error {
+	_, err := r.rc.Do(ctx, "PING")
+	return err
+}
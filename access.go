@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/rs/zerolog"
+)
+
+type requestIDKey struct{}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// accessLog assigns a request id (reusing X-Request-ID if set),
+// attaches a logger with it, the handler name, and the client address to the context,
+// and logs a summary of each request at accessLvl, with the client as -privacy.ip allows
+func (s *Server) accessLog(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("x-request-id")
+		if id == "" || len(id) > 64 {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("x-request-id", id)
+
+		log := s.log.With().Str("request_id", id).Str("handler", name).Logger()
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = context.WithValue(ctx, handlerKey{}, name)
+		ctx = withClient(ctx, s.trusted.clientAddr(r))
+		ctx = log.WithContext(ctx)
+		r = r.WithContext(ctx)
+
+		body := &countReader{ReadCloser: r.Body}
+		r.Body = body
+		m := httpsnoop.CaptureMetrics(h, w, r)
+		s.sizes.WithLabelValues(name).Observe(float64(body.n))
+
+		log.WithLevel(s.accessLvl).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Int("status", m.Code).
+			Int64("bytes", m.Written).
+			Int64("req_bytes", body.n).
+			Dur("dur", m.Duration).
+			Str("client", s.httpRemote(r, false).Remote).
+			Msg("access")
+	}
+}
+
+// countReader counts the bytes read from a request body
+type countReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+type levelFlag struct {
+	lvl *zerolog.Level
+}
+
+func (l levelFlag) String() string {
+	if l.lvl == nil {
+		return ""
+	} else if *l.lvl == zerolog.Disabled {
+		return "disabled"
+	}
+	return l.lvl.String()
+}
+
+func (l levelFlag) Set(v string) error {
+	if v == "disabled" {
+		*l.lvl = zerolog.Disabled
+		return nil
+	}
+	lvl, err := zerolog.ParseLevel(v)
+	if err != nil {
+		return err
+	}
+	*l.lvl = lvl
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// admin guards h with the admin bearer token,
+// admin endpoints are disabled if no token is configured
+func (s *Server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			http.Error(w, "admin endpoints disabled", http.StatusNotFound)
+			return
+		}
+		tok := strings.TrimPrefix(r.Header.Get("authorization"), "Bearer ")
+		if _, pass, ok := r.BasicAuth(); ok {
+			// browsers can only prompt for basic auth, the token is the password
+			tok = pass
+		}
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(s.adminToken)) != 1 {
+			w.Header().Set("www-authenticate", `Bearer realm="statslogger"`)
+			w.Header().Add("www-authenticate", `Basic realm="statslogger"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+type alertOpts struct {
+	webhooks stringList
+	classes  stringList
+	warmup   time.Duration
+	repeat   time.Duration
+	max      int
+	seen     int
+}
+
+func (o *alertOpts) Flags(fs *flag.FlagSet) {
+	fs.Var(secret(&o.webhooks), "alert.webhooks", "comma separated [slack=|discord=]url to notify of new and spiking csp violations, plain urls get json")
+	o.classes = stringList{classActionable}
+	fs.Var(&o.classes, "alert.classes", "comma separated violation classes to alert on")
+	fs.DurationVar(&o.warmup, "alert.warmup", 10*time.Minute, "time after start to learn existing violations without alerting on them as new")
+	fs.DurationVar(&o.repeat, "alert.repeat", time.Hour, "minimum time between alerts for the same fingerprint")
+	fs.IntVar(&o.max, "alert.max", 20, "maximum alerts per hour, across all fingerprints")
+	fs.IntVar(&o.seen, "alert.seen", 100000, "number of fingerprints to remember as seen, forgotten all at once when full")
+}
+
+func (o alertOpts) validate() error {
+	for _, w := range o.webhooks {
+		if _, _, err := parseWebhook(w); err != nil {
+			return fmt.Errorf("alert.webhooks: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseWebhook splits a webhook flag value into its payload format and url
+func parseWebhook(v string) (kind, u string, err error) {
+	kind, u = "json", v
+	if i := strings.Index(v, "="); i > 0 && !strings.Contains(v[:i], ":") {
+		kind, u = v[:i], v[i+1:]
+	}
+	switch kind {
+	case "json", "slack", "discord":
+	default:
+		return "", "", fmt.Errorf("%q: unknown format %s", v, kind)
+	}
+	if pu, err := url.Parse(u); err != nil || (pu.Scheme != "http" && pu.Scheme != "https") {
+		return "", "", fmt.Errorf("%q: not an http(s) url", v)
+	}
+	return kind, u, nil
+}
+
+// alert is a notification about a fingerprint
+type alert struct {
+	Kind         string  `json:"kind"` // new or spike
+	Fingerprint  string  `json:"fingerprint"`
+	Class        string  `json:"class"`
+	Directive    string  `json:"directive"`
+	BlockedHost  string  `json:"blocked_host"`
+	DocumentHost string  `json:"document_host"`
+	Violations   int     `json:"violations,omitempty"`
+	Z            float64 `json:"z,omitempty"`
+	Text         string  `json:"text"`
+}
+
+// alerter notifies webhooks of new and spiking violations,
+// at most once per fingerprint per repeat interval and max per hour
+type alerter struct {
+	alertOpts
+	log    zerolog.Logger
+	sent   *prometheus.CounterVec
+	client *http.Client
+	start  time.Time
+	queue  chan alert
+
+	mu     sync.Mutex
+	seen   map[string]struct{}
+	last   map[string]time.Time
+	window time.Time
+	inHour int
+}
+
+func newAlerter(ctx context.Context, o alertOpts, log zerolog.Logger, f promauto.Factory) *alerter {
+	a := &alerter{
+		alertOpts: o,
+		log:       log.With().Str("module", "alert").Logger(),
+		sent: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "alerts",
+		}, []string{"kind", "outcome"}),
+		client: &http.Client{Timeout: 10 * time.Second},
+		start:  time.Now(),
+		queue:  make(chan alert, 16),
+		seen:   make(map[string]struct{}),
+		last:   make(map[string]time.Time),
+	}
+	if len(o.webhooks) > 0 {
+		go a.run(ctx)
+	}
+	return a
+}
+
+// Seen records a violation, alerting if its fingerprint is new
+func (a *alerter) Seen(fingerprint, class string, r CSPReport) {
+	if len(a.webhooks) == 0 || !a.classes.contains(class) {
+		return
+	}
+	a.mu.Lock()
+	_, ok := a.seen[fingerprint]
+	if !ok {
+		if len(a.seen) >= a.alertOpts.seen {
+			a.seen = make(map[string]struct{})
+		}
+		a.seen[fingerprint] = struct{}{}
+	}
+	a.mu.Unlock()
+	if ok || time.Since(a.start) < a.warmup {
+		return
+	}
+	a.notify(newAlert("new", fingerprint, class, r))
+}
+
+// Spike alerts on a spike from the anomaly detector
+func (a *alerter) Spike(sp spike) {
+	if len(a.webhooks) == 0 || !a.classes.contains(sp.class) {
+		return
+	}
+	al := newAlert("spike", sp.fingerprint, sp.class, sp.example)
+	al.Violations, al.Z = sp.n, sp.z
+	al.Text = fmt.Sprintf("%s: %d violations, usual %.1f", al.Text, sp.n, sp.mean)
+	a.notify(al)
+}
+
+func newAlert(kind, fingerprint, class string, r CSPReport) alert {
+	al := alert{
+		Kind:         kind,
+		Fingerprint:  fingerprint,
+		Class:        class,
+		Directive:    r.directive(),
+		BlockedHost:  hostOf(r.CspReport.BlockedURI),
+		DocumentHost: hostOf(r.CspReport.DocumentURI),
+	}
+	al.Text = fmt.Sprintf("%s csp violation %s: %s blocked %s on %s", kind, fingerprint, al.Directive, al.BlockedHost, al.DocumentHost)
+	return al
+}
+
+// notify queues an alert unless it's limited
+func (a *alerter) notify(al alert) {
+	now := time.Now()
+	a.mu.Lock()
+	if t, ok := a.last[al.Fingerprint]; ok && now.Sub(t) < a.repeat {
+		a.mu.Unlock()
+		a.sent.WithLabelValues(al.Kind, "repeat").Inc()
+		return
+	}
+	if now.Sub(a.window) >= time.Hour {
+		a.window, a.inHour = now, 0
+		for fp, t := range a.last {
+			if now.Sub(t) >= a.repeat {
+				delete(a.last, fp)
+			}
+		}
+	}
+	if a.inHour >= a.max {
+		a.mu.Unlock()
+		a.sent.WithLabelValues(al.Kind, "limited").Inc()
+		return
+	}
+	a.inHour++
+	a.last[al.Fingerprint] = now
+	a.mu.Unlock()
+
+	select {
+	case a.queue <- al:
+	default:
+		a.sent.WithLabelValues(al.Kind, "limited").Inc()
+	}
+}
+
+func (a *alerter) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case al := <-a.queue:
+			for _, w := range a.webhooks {
+				kind, u, _ := parseWebhook(w)
+				err := a.post(ctx, kind, u, al)
+				if err != nil {
+					a.log.Error().Err(err).Str("webhook", hostOf(u)).Str("fingerprint", al.Fingerprint).Msg("send alert")
+					a.sent.WithLabelValues(al.Kind, "error").Inc()
+					continue
+				}
+				a.sent.WithLabelValues(al.Kind, "success").Inc()
+			}
+		}
+	}
+}
+
+func (a *alerter) post(ctx context.Context, kind, u string, al alert) error {
+	return postWebhook(ctx, a.client, kind, u, al, al.Text)
+}
+
+// postWebhook sends body as json, or just text for slack and discord
+func postWebhook(ctx context.Context, client *http.Client, kind, u string, body interface{}, text string) error {
+	switch kind {
+	case "slack":
+		body = map[string]string{"text": text}
+	case "discord":
+		if len(text) > 2000 {
+			text = text[:1997] + "..."
+		}
+		body = map[string]string{"content": text}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("content-type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("send: %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// domainList matches hosts that are or are subdomains of its entries,
+// an empty list matches everything
+type domainList []string
+
+func (l domainList) Allowed(u string) bool {
+	return len(l) == 0 || l.match(u) != ""
+}
+
+// match is the entry u's host is or is a subdomain of, empty if none
+func (l domainList) match(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimSuffix(strings.ToLower(pu.Hostname()), ".")
+	for _, d := range l {
+		d = strings.ToLower(d)
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return d
+		}
+	}
+	return ""
+}
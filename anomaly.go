@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+type anomalyOpts struct {
+	interval time.Duration
+	alpha    float64
+	z        float64
+	min      int
+}
+
+func (o *anomalyOpts) Flags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.interval, "anomaly.interval", time.Minute, "interval to count csp violations per fingerprint in for spike detection, 0 to disable")
+	fs.Float64Var(&o.alpha, "anomaly.alpha", 0.1, "weight of the latest interval in the moving average")
+	fs.Float64Var(&o.z, "anomaly.z", 4, "standard deviations above the moving average an interval count has to be to be a spike")
+	fs.IntVar(&o.min, "anomaly.min", 10, "minimum violations in an interval to be a spike")
+}
+
+func (o anomalyOpts) validate() error {
+	if o.interval > 0 && (o.alpha <= 0 || o.alpha > 1) {
+		return fmt.Errorf("anomaly.alpha: %v not in (0, 1]", o.alpha)
+	}
+	return nil
+}
+
+// anomalies detects spikes in violation rates per fingerprint
+// using an exponentially weighted moving average and variance
+type anomalies struct {
+	anomalyOpts
+	log      zerolog.Logger
+	spikes   *prometheus.CounterVec
+	spiking  prometheus.Gauge
+	onSpikes []func(spike)
+
+	mu    sync.Mutex
+	rates map[string]*fpRate
+}
+
+type fpRate struct {
+	example CSPReport
+	class   string
+	n       int
+	mean    float64
+	vari    float64
+}
+
+// spike is a fingerprint with an unusual number of violations in an interval
+type spike struct {
+	fingerprint string
+	example     CSPReport
+	class       string
+	n           int
+	mean        float64
+	z           float64
+}
+
+// newAnomalies starts a detector calling onSpikes for every spike
+func newAnomalies(ctx context.Context, o anomalyOpts, log zerolog.Logger, f promauto.Factory, onSpikes ...func(spike)) *anomalies {
+	a := &anomalies{
+		anomalyOpts: o,
+		log:         log,
+		spikes: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "csp_spikes",
+		}, []string{"class"}),
+		spiking: f.NewGauge(prometheus.GaugeOpts{
+			Name: "csp_spiking_fingerprints",
+		}),
+		onSpikes: onSpikes,
+		rates:    make(map[string]*fpRate),
+	}
+	if o.interval > 0 {
+		go a.run(ctx)
+	}
+	return a
+}
+
+// Record counts a violation
+func (a *anomalies) Record(fingerprint, class string, r CSPReport) {
+	if a.interval <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rt, ok := a.rates[fingerprint]
+	if !ok {
+		rt = &fpRate{example: r, class: class}
+		a.rates[fingerprint] = rt
+	}
+	rt.n++
+}
+
+func (a *anomalies) run(ctx context.Context) {
+	t := time.NewTicker(a.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			spikes := a.update()
+			a.spiking.Set(float64(len(spikes)))
+			for _, sp := range spikes {
+				a.spikes.WithLabelValues(sp.class).Inc()
+				a.log.Warn().
+					Str("fingerprint", sp.fingerprint).
+					Str("class", sp.class).
+					Str("directive", sp.example.directive()).
+					Str("blocked_host", hostOf(sp.example.CspReport.BlockedURI)).
+					Str("document_host", hostOf(sp.example.CspReport.DocumentURI)).
+					Int("violations", sp.n).
+					Float64("mean", sp.mean).
+					Float64("z", sp.z).
+					Msg("csp violation spike")
+				for _, fn := range a.onSpikes {
+					fn(sp)
+				}
+			}
+		}
+	}
+}
+
+// update closes the current interval, returning the spikes in it
+func (a *anomalies) update() []spike {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var spikes []spike
+	for fp, rt := range a.rates {
+		n := float64(rt.n)
+		// floor the deviation at what counting noise alone would give
+		sd := math.Max(math.Sqrt(rt.vari), math.Max(math.Sqrt(rt.mean), 1))
+		z := (n - rt.mean) / sd
+		if rt.n >= a.min && z >= a.z {
+			spikes = append(spikes, spike{fp, rt.example, rt.class, rt.n, rt.mean, z})
+		}
+
+		d := n - rt.mean
+		rt.mean += a.alpha * d
+		rt.vari = (1 - a.alpha) * (rt.vari + a.alpha*d*d)
+		rt.n = 0
+		if rt.mean < 0.01 {
+			// quiet long enough to be forgotten
+			delete(a.rates, fp)
+		}
+	}
+	return spikes
+}
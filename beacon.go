@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+type beaconOpts struct {
+	maxDur   time.Duration
+	outliers string
+}
+
+func (o *beaconOpts) Flags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.maxDur, "beacon.max-duration", 0, "longest plausible beacon duration, longer ones are outliers, 0 for no limit")
+	fs.StringVar(&o.outliers, "beacon.outliers", "clamp", "what to do with negative or too long durations: clamp, drop")
+}
+
+func (o beaconOpts) validate() error {
+	switch o.outliers {
+	case "clamp", "drop":
+	default:
+		return fmt.Errorf("beacon.outliers: unknown action %s", o.outliers)
+	}
+	if o.maxDur < 0 {
+		return fmt.Errorf("beacon.max-duration: negative")
+	}
+	return nil
+}
+
+// duration checks a beacon duration in ms,
+// returning the (possibly clamped) duration,
+// why it was an outlier if it was, and whether to drop it
+func (o beaconOpts) duration(ms int64) (int64, string, bool) {
+	var reason string
+	var clamped int64
+	switch max := o.maxDur.Milliseconds(); {
+	case ms < 0:
+		reason, clamped = "negative", 0
+	case max > 0 && ms > max:
+		reason, clamped = "too-long", max
+	default:
+		return ms, "", false
+	}
+	if o.outliers == "drop" {
+		return ms, reason, true
+	}
+	return clamped, reason, false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.seankhliao.com/apis/saver/v1"
+)
+
+type bucketOpts struct {
+	zone  string
+	zones stringList
+}
+
+func (o *bucketOpts) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.zone, "time.zone", "", "time zone to additionally bucket records in, eg Europe/London, none if empty")
+	fs.Var(&o.zones, "time.zones", "comma separated site=zone time zones for individual sites, overriding time.zone")
+}
+
+// bucketZones is the time zone for each site, "" for the default
+type bucketZones map[string]*time.Location
+
+func (o bucketOpts) locations() (bucketZones, error) {
+	zs := make(bucketZones)
+	if o.zone != "" {
+		loc, err := time.LoadLocation(o.zone)
+		if err != nil {
+			return nil, fmt.Errorf("time.zone: %w", err)
+		}
+		zs[""] = loc
+	}
+	for _, e := range o.zones {
+		i := strings.Index(e, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("time.zones: %q: expected site=zone", e)
+		}
+		loc, err := time.LoadLocation(e[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("time.zones: %q: %w", e, err)
+		}
+		zs[strings.ToLower(e[:i])] = loc
+	}
+	return zs, nil
+}
+
+func (o bucketOpts) validate() error {
+	_, err := o.locations()
+	return err
+}
+
+// bucketProc attaches the utc day and hour of a record,
+// and the same in the site's time zone if configured,
+// so everything downstream agrees on which day a record belongs to
+func bucketProc(zs bucketZones) Processor {
+	return ProcessorFunc(func(ctx context.Context, e *event) (*event, bool, error) {
+		t := time.Now()
+		var site string
+		switch m := e.msg.(type) {
+		case *saver.CSPRequest:
+			site = hostOf(m.DocumentUri)
+			t = remoteTime(m.HttpRemote, t)
+		case *saver.BeaconRequest:
+			site = hostOf(m.SrcPage)
+			t = remoteTime(m.HttpRemote, t)
+		}
+		t = t.UTC()
+		e.md.Append("bucket-day", t.Format("2006-01-02"))
+		e.md.Append("bucket-hour", t.Format("2006-01-02T15Z"))
+		loc, ok := zs[strings.ToLower(site)]
+		if !ok {
+			loc, ok = zs[""]
+		}
+		if ok {
+			lt := t.In(loc)
+			e.md.Append("bucket-zone", loc.String())
+			e.md.Append("bucket-local-day", lt.Format("2006-01-02"))
+			e.md.Append("bucket-local-hour", lt.Format("2006-01-02T15"))
+		}
+		return e, false, nil
+	})
+}
+
+// remoteTime is the time a record was received, or def
+func remoteTime(r *saver.HTTPRemote, def time.Time) time.Time {
+	if r == nil {
+		return def
+	}
+	t, err := time.Parse(time.RFC3339, r.Timestamp)
+	if err != nil {
+		return def
+	}
+	return t
+}
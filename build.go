@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// set with -ldflags '-X main.version=... -X main.commit=... -X main.date=...'
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+type buildInfo struct {
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+func getBuildInfo() buildInfo {
+	bi := buildInfo{
+		Module:    name,
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		GoVersion: runtime.Version(),
+	}
+	dbi, ok := debug.ReadBuildInfo()
+	if ok && dbi.Main.Path != "" {
+		bi.Module = dbi.Main.Path
+	}
+	if bi.Version == "" {
+		bi.Version = "(devel)"
+		if ok {
+			bi.Version = dbi.Main.Version
+		}
+	}
+	if bi.Commit == "" {
+		bi.Commit = "unknown"
+	}
+	if bi.Date == "" {
+		bi.Date = "unknown"
+	}
+	return bi
+}
+
+// serveVersion reports the build info as json
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(getBuildInfo())
+}
+
+// registerRuntimeMetrics exports build info,
+// and go / process metrics under namespace if set
+// (the default registry already has unprefixed ones)
+func registerRuntimeMetrics(f promauto.Factory, namespace string) {
+	bi := getBuildInfo()
+	f.NewGauge(prometheus.GaugeOpts{
+		Name: "build_info",
+		ConstLabels: prometheus.Labels{
+			"version":   bi.Version,
+			"commit":    bi.Commit,
+			"date":      bi.Date,
+			"goversion": bi.GoVersion,
+		},
+	}).Set(1)
+
+	if namespace == "" {
+		return
+	}
+	reg := prometheus.WrapRegistererWithPrefix(namespace+"_", prometheus.DefaultRegisterer)
+	reg.MustRegister(prometheus.NewGoCollector())
+	prometheus.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{
+		Namespace: namespace,
+	}))
+}
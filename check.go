@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.seankhliao.com/usvc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// checkConfig validates the configuration as serve would see it,
+// reporting every problem found along with where the flag was set
+func checkConfig(args []string) int {
+	full, origins, err := expandConfig(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s := &Server{}
+	fs := newFlagSet(args[0]+" check-config", s)
+	checkSaver := fs.Duration("check.saver", 0, "also check the saver is reachable within this time")
+	err = fs.Parse(full[1:])
+	if err != nil {
+		return 2
+	}
+
+	var errs, warns []string
+	verrs := s.validate()
+	if _, err := loadReloadable(s); err != nil {
+		verrs = append(verrs, err)
+	}
+	for _, err := range verrs {
+		errs = append(errs, withOrigin(fs, origins, err.Error()))
+	}
+	for _, w := range s.conflicts() {
+		warns = append(warns, withOrigin(fs, origins, w))
+	}
+	for _, kv := range os.Environ() {
+		k := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(k, envPrefix) && origins[envFlag(fs, k)] == "" {
+			warns = append(warns, fmt.Sprintf("$%s doesn't match any flag", k))
+		}
+	}
+	if *checkSaver > 0 && len(errs) == 0 {
+		if err := s.checkSaver(*checkSaver); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for _, w := range warns {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	for _, e := range errs {
+		fmt.Fprintln(os.Stderr, "error:", e)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Println("ok")
+	return 0
+}
+
+// envFlag is the flag an environment variable sets, if any
+func envFlag(fs *flag.FlagSet, env string) string {
+	var name string
+	fs.VisitAll(func(f *flag.Flag) {
+		if envName(f.Name) == env {
+			name = f.Name
+		}
+	})
+	return name
+}
+
+// withOrigin notes where the flags mentioned in msg were set
+func withOrigin(fs *flag.FlagSet, origins map[string]string, msg string) string {
+	var notes []string
+	fs.VisitAll(func(f *flag.Flag) {
+		o, ok := origins[f.Name]
+		if !ok {
+			return
+		}
+		if regexp.MustCompile(`(^|[^\w.-])` + regexp.QuoteMeta(f.Name) + `($|[^\w.-])`).MatchString(msg) {
+			notes = append(notes, f.Name+" set at "+o)
+		}
+	})
+	if len(notes) == 0 {
+		return msg
+	}
+	return msg + " (" + strings.Join(notes, ", ") + ")"
+}
+
+// validate checks the flags, Setup runs it before building anything
+func (s *Server) validate() []error {
+	var errs []error
+	for _, err := range []error{
+		s.privacyOpts.validate(),
+		s.routeOpts.validate(),
+		s.response.validate(),
+		s.traceOpts.validate(),
+		s.anomalyOpts.validate(),
+		s.alertOpts.validate(),
+		s.digestOpts.validate(),
+		s.pipelineOpts.validate(),
+		s.beaconOpts.validate(),
+		s.scriptOpts.validate(),
+		s.sourceMapOpts.validate(),
+		s.jsGroupOpts.validate(),
+		s.proxyOpts.validate(),
+		s.schemaOpts.validate(),
+		s.tenantOpts.validate(),
+		s.topOpts.validate(),
+		s.bucketOpts.validate(),
+		s.abuseOpts.validate(),
+		s.kAnonOpts.validate(),
+		s.otlpOpts.validate(),
+		s.dedupOpts.validate(),
+	} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := s.metricOpts.factory(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newReferrerSources(s.refSources); err != nil {
+		errs = append(errs, err)
+	}
+	if s.nRecent < 0 {
+		errs = append(errs, fmt.Errorf("debug.reports: %d is negative", s.nRecent))
+	}
+	return errs
+}
+
+// conflicts are settings that are valid but likely not what was intended
+func (s *Server) conflicts() []string {
+	var warns []string
+	if len(s.routeOpts.handlers) == 0 {
+		warns = append(warns, "http.handlers is empty, no reports will be accepted")
+	}
+	for _, e := range s.listen.extra {
+		for _, h := range e.handlers {
+			if !s.routeOpts.enabled(h) {
+				warns = append(warns, fmt.Sprintf("addr.extra %s serves %s which isn't in http.handlers", e.addr, h))
+			}
+		}
+	}
+	if (s.ingestOpts.addr != "" || s.ingestOpts.web) && !s.routeOpts.enabled("csp") && !s.routeOpts.enabled("beacon") {
+		warns = append(warns, "grpc ingestion replays through http.handlers, which has neither csp nor beacon")
+	}
+	if s.proxyOpts.upstream != "" && !s.routeOpts.enabled("reports") {
+		warns = append(warns, "proxy.upstream points browsers at the reports handler, which isn't in http.handlers")
+	}
+	if s.tenantOpts.from.contains("key") && len(s.tenantOpts.keys) == 0 {
+		warns = append(warns, "tenant.from includes key but tenant.keys is empty, no api key will match")
+	}
+	if len(s.tenantOpts.from) == 0 && (len(s.tenantOpts.keys) > 0 || len(s.tenantOpts.sites) > 0 || len(s.tenantOpts.rates) > 0) {
+		warns = append(warns, "tenant.from is empty, tenant.keys, tenant.sites, and tenant.rate are unused")
+	}
+	if s.privacyOpts.minimal {
+		if s.geoOpts.db != "" || s.geoOpts.asn != "" {
+			warns = append(warns, "privacy.minimal skips geoip lookups, geoip.db and geoip.asn are unused")
+		}
+		if s.sessTimeout > 0 {
+			warns = append(warns, "privacy.minimal skips sessions, session.timeout is unused")
+		}
+	}
+	if s.privacyOpts.secret == "" && (s.privacyOpts.ip == "hash" || s.kAnonOpts.k > 0 || s.sessTimeout > 0) {
+		warns = append(warns, "privacy.secret is empty, hashed values differ between instances and restarts")
+	}
+	if s.traceOpts.disabled && (s.traceOpts.sampler != "" || s.traceOpts.agent != "") {
+		warns = append(warns, "trace.disabled ignores trace.sampler and trace.agent")
+	}
+	if s.dryRun && s.saverAddr != "saver:443" {
+		warns = append(warns, "dry-run doesn't connect to saver")
+	}
+	return warns
+}
+
+// checkSaver connects to the saver
+func (s *Server) checkSaver(timeout time.Duration) error {
+	o := usvc.TLSOpts{
+		CrtFile: s.fs.Lookup("tls.crt").Value.String(),
+		KeyFile: s.fs.Lookup("tls.key").Value.String(),
+		CAFile:  s.fs.Lookup("ca.crt").Value.String(),
+	}
+	conf, err := o.Config()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cc, err := grpc.DialContext(ctx, s.saverAddr, grpc.WithTransportCredentials(credentials.NewTLS(conf)), grpc.WithBlock())
+	if err != nil {
+		return fmt.Errorf("connect to saver %s: %w", s.saverAddr, err)
+	}
+	return cc.Close()
+}
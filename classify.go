@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"net/url"
+)
+
+// violation classes, everything but actionable is likely benign
+const (
+	classExtension   = "extension"   // browser extensions and in app browsers
+	classInjection   = "injection"   // scripts injected by isps or middleboxes
+	classTranslation = "translation" // translators and translation proxies
+	classActionable  = "actionable"
+)
+
+var extensionSchemes = newLabelSet([]string{
+	"chrome-extension", "moz-extension", "safari-extension", "safari-web-extension",
+	"ms-browser-extension", "webviewprogressproxy", "mxaddon-pkg", "mxjscall", "gsa", "ms-appx-web",
+})
+
+var translationDomains = []string{
+	"translate.googleapis.com", "translate.google.com", "translate.goog",
+	"microsofttranslator.com", "translatoruser.net",
+}
+
+// classify is what likely caused a violation
+func (r CSPReport) classify() string {
+	c := r.CspReport
+	blocked, _ := url.Parse(c.BlockedURI)
+	source, _ := url.Parse(c.SourceFile)
+	doc, _ := url.Parse(c.DocumentURI)
+	for _, u := range []*url.URL{blocked, source} {
+		if u != nil && extensionSchemes[u.Scheme] {
+			return classExtension
+		}
+	}
+	for _, u := range []*url.URL{blocked, source, doc} {
+		if u == nil {
+			continue
+		}
+		for _, d := range translationDomains {
+			if matchDomain(d, u.Hostname()) {
+				return classTranslation
+			}
+		}
+	}
+	// injected content is commonly served from a bare ip
+	// over plain http, no site references these itself
+	if blocked != nil && blocked.Scheme == "http" && net.ParseIP(blocked.Hostname()) != nil {
+		return classInjection
+	}
+	return classActionable
+}
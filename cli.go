@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.seankhliao.com/usvc"
+)
+
+// commands are the subcommands, serve is the default
+var commands = map[string]func(args []string) int{
+	"serve":        serve,
+	"check-config": checkConfig,
+	"send":         send,
+	"replay":       replay,
+	"bench":        bench,
+	"serverless":   serverless,
+}
+
+// subcommand splits the subcommand out of args,
+// keeping the program name first
+func subcommand(args []string) (string, []string) {
+	if len(args) > 1 {
+		if _, ok := commands[args[1]]; ok {
+			return args[1], append([]string{args[0]}, args[2:]...)
+		}
+	}
+	return "serve", args
+}
+
+func usage(w io.Writer, prog string) {
+	fmt.Fprintf(w, `usage: %s [command] [flags]
+
+commands:
+  serve         run the collector (default)
+  check-config  validate flags, environment, and config file
+  send          send a test report to a running collector
+  replay        resend reports from a file to a running collector
+  bench         load test a running collector
+  serverless    run only the report handlers, for lambda, cloud run, or cloud functions
+
+run %s command -h for the flags of each command
+`, prog, prog)
+}
+
+func serve(args []string) int {
+	full, err := configArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return usvc.Exec(context.Background(), &Server{args: args}, full)
+}
+
+// clientOpts are the flags shared by commands talking to a collector
+type clientOpts struct {
+	url     string
+	kind    string
+	page    string
+	timeout time.Duration
+	routes  routeOpts
+}
+
+func (o *clientOpts) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.url, "url", "http://localhost:8080", "base url of the collector")
+	fs.StringVar(&o.kind, "type", "csp", "report type to send: csp, beacon")
+	fs.StringVar(&o.page, "page", "https://example.com/", "page the report is for")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Second, "request timeout")
+	// the collector's paths, as it was started with
+	o.routes.Flags(fs)
+}
+
+// sample is a made up report of kind for page
+func (o clientOpts) sample() (string, string, string) {
+	if o.kind == "beacon" {
+		v := url.Values{
+			"trigger": {"unload"},
+			"src":     {o.page},
+			"dst":     {""},
+			"dur":     {"1234ms"},
+		}
+		return o.routes.path(o.routes.beacon), "application/x-www-form-urlencoded", v.Encode()
+	}
+	var r CSPReport
+	r.CspReport.DocumentURI = o.page
+	r.CspReport.BlockedURI = "https://statslogger.invalid/test.js"
+	r.CspReport.ViolatedDirective = "script-src-elem"
+	r.CspReport.EffectiveDirective = "script-src-elem"
+	r.CspReport.OriginalPolicy = "script-src-elem 'self'; report-uri /csp"
+	r.CspReport.Disposition = "report"
+	b, _ := json.Marshal(r)
+	return o.routes.path(o.routes.csp), "application/csp-report", string(b)
+}
+
+// post sends a report and returns the response status and request id
+func (o clientOpts) post(client *http.Client, path, ct, body string) (int, string, error) {
+	res, err := client.Post(strings.TrimSuffix(o.url, "/")+path, ct, strings.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	return res.StatusCode, res.Header.Get("x-request-id"), nil
+}
+
+func send(args []string) int {
+	var o clientOpts
+	fs := flag.NewFlagSet(args[0]+" send", flag.ExitOnError)
+	o.Flags(fs)
+	fs.Parse(args[1:])
+
+	path, ct, body := o.sample()
+	code, id, err := o.post(&http.Client{Timeout: o.timeout}, path, ct, body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s %d request_id=%s\n", path, code, id)
+	if code >= 300 {
+		return 1
+	}
+	return 0
+}
+
+// replay sends each line of the files (or stdin) as a report,
+// lines starting with { are csp reports, others are beacon forms
+func replay(args []string) int {
+	var o clientOpts
+	fs := flag.NewFlagSet(args[0]+" replay", flag.ExitOnError)
+	o.Flags(fs)
+	fs.Parse(args[1:])
+
+	client := &http.Client{Timeout: o.timeout}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	var sent, failed int
+	for _, fn := range files {
+		n, nf, err := o.replayFile(client, fn)
+		sent, failed = sent+n, failed+nf
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	fmt.Printf("sent=%d failed=%d\n", sent, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayFile sends the reports in fn, - for stdin,
+// returning how many were sent and how many of those failed
+func (o clientOpts) replayFile(client *http.Client, fn string) (sent, failed int, err error) {
+	var r io.Reader = os.Stdin
+	if fn != "-" {
+		f, err := os.Open(fn)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		path, ct := o.routes.path(o.routes.beacon), "application/x-www-form-urlencoded"
+		if strings.HasPrefix(line, "{") {
+			path, ct = o.routes.path(o.routes.csp), "application/csp-report"
+		}
+		code, id, err := o.post(client, path, ct, line)
+		sent++
+		if err != nil || code >= 300 {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s %d request_id=%s err=%v\n", path, code, id, err)
+		}
+	}
+	return sent, failed, sc.Err()
+}
+
+// bench sends n sample reports over c connections
+// and reports throughput and latency
+func bench(args []string) int {
+	var o clientOpts
+	var n, c int
+	fs := flag.NewFlagSet(args[0]+" bench", flag.ExitOnError)
+	o.Flags(fs)
+	fs.IntVar(&n, "n", 1000, "number of reports to send")
+	fs.IntVar(&c, "c", 10, "concurrent requests")
+	fs.Parse(args[1:])
+	if n < 1 || c < 1 {
+		fmt.Fprintln(os.Stderr, "n and c must be positive")
+		return 2
+	}
+
+	client := &http.Client{
+		Timeout:   o.timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: c},
+	}
+	path, ct, body := o.sample()
+	jobs := make(chan struct{}, n)
+	for i := 0; i < n; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+
+	var mu sync.Mutex
+	var lat []time.Duration
+	var failed int
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < c; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				t := time.Now()
+				code, _, err := o.post(client, path, ct, body)
+				d := time.Since(t)
+				mu.Lock()
+				lat = append(lat, d)
+				if err != nil || code >= 300 {
+					failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	total := time.Since(start)
+
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	pct := func(p float64) time.Duration {
+		return lat[int(p*float64(len(lat)-1))]
+	}
+	fmt.Printf("sent=%d failed=%d time=%v rps=%.1f p50=%v p90=%v p99=%v max=%v\n",
+		n, failed, total, float64(n)/total.Seconds(), pct(.5), pct(.9), pct(.99), lat[len(lat)-1])
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
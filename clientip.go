@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the peers whose x-forwarded-for is believed,
+// unix for connections on addr.unix
+type trustedProxies struct {
+	nets []*net.IPNet
+	unix bool
+	raw  string
+}
+
+func (t *trustedProxies) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.raw
+}
+
+func (t *trustedProxies) Set(v string) error {
+	n := trustedProxies{raw: v}
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		} else if s == "unix" {
+			n.unix = true
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("invalid ip or cidr %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid ip or cidr %q", s)
+		}
+		n.nets = append(n.nets, ipnet)
+	}
+	*t = n
+	return nil
+}
+
+func (t trustedProxies) trusts(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return t.unix && (addr == "" || addr == "@")
+	}
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr is the address of the client:
+// the peer unless it's a trusted proxy,
+// then the rightmost x-forwarded-for hop that isn't
+func (t trustedProxies) clientAddr(r *http.Request) string {
+	addr := hostOnly(r.RemoteAddr)
+	if !t.trusts(addr) {
+		return addr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("x-forwarded-for"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hostOnly(strings.TrimSpace(hops[i]))
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			// garbage from further out can't be trusted
+			return addr
+		}
+		addr = hop
+		if !t.trusts(addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+// hostOnly strips the port from an address if it has one
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return strings.Trim(addr, "[]")
+	}
+	return host
+}
+
+type clientKey struct{}
+
+// withClient records the resolved client address for clientIP
+func withClient(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientKey{}, addr)
+}
+
+// clientIP is the address of the client used to identify it,
+// as resolved by accessLog, or the peer if it wasn't
+func clientIP(r *http.Request) string {
+	if addr, ok := r.Context().Value(clientKey{}).(string); ok {
+		return addr
+	}
+	return hostOnly(r.RemoteAddr)
+}
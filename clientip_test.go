@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		remote  string
+		xff     []string
+		want    string
+	}{
+		{"no proxies", "", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"spoofed without trusted proxies", "", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"spoofed from untrusted peer", "10.0.0.0/8", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.0/8", "10.0.0.2:80", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed leftmost hop", "10.0.0.0/8", "10.0.0.2:80", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of trusted proxies", "10.0.0.0/8,192.0.2.1", "10.0.0.2:80", []string{"198.51.100.1, 203.0.113.7, 192.0.2.1, 10.0.0.3"}, "203.0.113.7"},
+		{"repeated headers", "10.0.0.0/8", "10.0.0.2:80", []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7"},
+		{"garbage hop", "10.0.0.0/8", "10.0.0.2:80", []string{"198.51.100.1, <script>"}, "10.0.0.2"},
+		{"all hops trusted", "10.0.0.0/8", "10.0.0.2:80", []string{"10.0.0.9"}, "10.0.0.9"},
+		{"empty header", "10.0.0.0/8", "10.0.0.2:80", nil, "10.0.0.2"},
+		{"ipv6", "2001:db8::/32", "[2001:db8::1]:443", []string{"2001:db8::2, [2001:db8:ffff::1]:5000, 2001:db9::1"}, "2001:db9::1"},
+		{"unix socket trusted", "unix", "@", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"unix socket untrusted", "10.0.0.0/8", "@", []string{"203.0.113.7"}, "@"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tp trustedProxies
+			err := tp.Set(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, _ := http.NewRequest(http.MethodPost, "/csp", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("x-forwarded-for", v)
+			}
+			if got := tp.clientAddr(r); got != tt.want {
+				t.Errorf("clientAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxiesInvalid(t *testing.T) {
+	for _, v := range []string{"10.0.0.0/33", "proxy.example.com", "10.0.0"} {
+		var tp trustedProxies
+		if err := tp.Set(v); err == nil {
+			t.Errorf("Set(%q) = nil, want error", v)
+		}
+	}
+}
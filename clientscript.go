@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type clientScriptOpts struct {
+	maxAge time.Duration
+	csp    bool
+	vitals bool
+	errors bool
+}
+
+func (o *clientScriptOpts) Flags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.maxAge, "script.max-age", time.Hour, "how long browsers and caches may keep the client script")
+	fs.BoolVar(&o.csp, "script.csp", true, "client script sends securitypolicyviolation events as csp reports, turn off for pages already setting report-uri")
+	fs.BoolVar(&o.vitals, "script.vitals", true, "client script measures web vitals (lcp, fcp, cls, inp, ttfb) and adds them to the beacon")
+	fs.BoolVar(&o.errors, "script.errors", true, "client script counts uncaught errors and unhandled rejections and adds them with the first message and stack to the beacon")
+}
+
+func (o clientScriptOpts) validate() error {
+	if o.maxAge < 0 {
+		return fmt.Errorf("script.max-age: negative")
+	}
+	return nil
+}
+
+// siteKey is what can be passed as ?site= to the client script
+var siteKey = regexp.MustCompile(`^[A-Za-z0-9._-]{0,64}$`)
+
+// clientScript is the collector snippet for <script src=... async>,
+// endpoints are resolved against the script's own url so it works cross origin,
+// both are sent with sendBeacon as simple requests to avoid preflights
+var clientScript = template.Must(template.New("").Funcs(template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}).Parse(`/* statslogger */
+(function () {
+  var me = document.currentScript, base = me ? me.src : location.href;
+  var beacon = new URL({{json .Beacon}}, base).href, csp = new URL({{json .CSP}}, base).href;
+  var site = {{json .Site}}, start = Date.now(), vitals = {}, sent = false;
+  function post(url, body) {
+    if (navigator.sendBeacon) return navigator.sendBeacon(url, body);
+    fetch(url, { method: "POST", body: body, keepalive: true, mode: "no-cors" });
+  }
+{{- if .Vitals}}
+  function observe(type, fn, opts) {
+    try {
+      new PerformanceObserver(function (l) { l.getEntries().forEach(fn); })
+        .observe(Object.assign({ type: type, buffered: true }, opts));
+    } catch (e) {}
+  }
+  observe("largest-contentful-paint", function (e) { vitals.lcp = Math.round(e.startTime); });
+  observe("paint", function (e) { if (e.name === "first-contentful-paint") vitals.fcp = Math.round(e.startTime); });
+  observe("layout-shift", function (e) { if (!e.hadRecentInput) vitals.cls = ((vitals.cls || 0) + e.value); });
+  observe("event", function (e) { if (e.interactionId && e.duration > (vitals.inp || 0)) vitals.inp = Math.round(e.duration); }, { durationThreshold: 40 });
+  observe("navigation", function (e) { vitals.ttfb = Math.round(e.responseStart); });
+{{- end}}
+{{- if .Errors}}
+  var errors = 0, firstError = "", firstStack = "";
+  function onError(msg, err) {
+    if (errors++ > 0) return;
+    firstError = String(msg).slice(0, 500);
+    if (err && typeof err.stack === "string") firstStack = err.stack.slice(0, 4000);
+  }
+  addEventListener("error", function (e) { if (e.message) onError(e.message + " at " + e.filename + ":" + e.lineno + ":" + e.colno, e.error); });
+  addEventListener("unhandledrejection", function (e) { var r = e.reason; onError("unhandled rejection: " + ((r && r.message) || r), r); });
+{{- end}}
+  function send() {
+    if (sent) return;
+    sent = true;
+    var f = new URLSearchParams({ src: location.href, dur: Date.now() - start, ref: document.referrer });
+    if (site) f.set("site", site);
+    for (var k in vitals) f.set(k, k === "cls" ? vitals[k].toFixed(4) : vitals[k]);
+{{- if .Errors}}
+    if (errors) { f.set("errors", errors); f.set("error", firstError); if (firstStack) f.set("stack", firstStack); }
+{{- end}}
+    post(beacon, f);
+  }
+  addEventListener("visibilitychange", function () { if (document.visibilityState === "hidden") send(); });
+  addEventListener("pagehide", send);
+{{- if .CSPReports}}
+  document.addEventListener("securitypolicyviolation", function (e) {
+    post(csp, JSON.stringify({ "csp-report": {
+      "document-uri": e.documentURI, "referrer": e.referrer, "blocked-uri": e.blockedURI,
+      "violated-directive": e.violatedDirective, "effective-directive": e.effectiveDirective,
+      "original-policy": e.originalPolicy, "disposition": e.disposition, "source-file": e.sourceFile,
+      "line-number": e.lineNumber, "status-code": e.statusCode, "script-sample": e.sample
+    } }));
+  });
+{{- end}}
+})();
+`))
+
+// script serves the client script configured with this instance's endpoints,
+// and the site key from ?site= to send along with beacons
+func (s *Server) script(w http.ResponseWriter, r *http.Request) {
+	site := r.URL.Query().Get("site")
+	if !siteKey.MatchString(site) {
+		http.Error(w, "invalid site key", http.StatusBadRequest)
+		return
+	}
+	var buf bytes.Buffer
+	err := clientScript.Execute(&buf, map[string]interface{}{
+		"Beacon":     s.routeOpts.path(s.routeOpts.beacon),
+		"CSP":        s.routeOpts.path(s.routeOpts.csp),
+		"Site":       site,
+		"Vitals":     s.scriptOpts.vitals,
+		"Errors":     s.scriptOpts.errors,
+		"CSPReports": s.scriptOpts.csp && s.routeOpts.enabled("csp"),
+	})
+	if err != nil {
+		http.Error(w, "render script", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	w.Header().Set("content-type", "text/javascript; charset=utf-8")
+	w.Header().Set("cache-control", "public, max-age="+strconv.Itoa(int(s.scriptOpts.maxAge.Seconds())))
+	w.Header().Set("etag", etag)
+	if r.Header.Get("if-none-match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// vitalNames are the web vitals the client script may add to a beacon,
+// cls is unitless, the others are in ms
+var vitalNames = []string{"lcp", "fcp", "inp", "ttfb", "cls"}
+
+// beaconVitals are the web vitals sent with a beacon, skipping malformed ones
+func beaconVitals(r *http.Request) map[string]float64 {
+	vs := make(map[string]float64)
+	for _, name := range vitalNames {
+		v, err := strconv.ParseFloat(r.FormValue(name), 64)
+		if err != nil || !(v >= 0) || math.IsInf(v, 1) {
+			continue
+		}
+		vs[name] = v
+	}
+	return vs
+}
+
+// vitalsMetadata is the forwarded form of vitals, eg lcp=1200,cls=0.01
+func vitalsMetadata(vs map[string]float64) string {
+	var parts []string
+	for _, name := range vitalNames {
+		if v, ok := vs[name]; ok {
+			parts = append(parts, name+"="+strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// beaconErrors are the uncaught errors counted by the client script
+// and the first one's message, to be scrubbed before it's forwarded
+func (s *Server) beaconErrors(r *http.Request) (int, string) {
+	n, err := strconv.Atoi(r.FormValue("errors"))
+	if err != nil || n <= 0 {
+		return 0, ""
+	}
+	msg := r.FormValue("error")
+	if len(msg) > 1024 {
+		msg = msg[:1024]
+	}
+	return n, msg
+}
+
+// beaconStack is the stack trace of the first error, if the browser gave one,
+// to be scrubbed before it's forwarded
+func beaconStack(r *http.Request) string {
+	stack := r.FormValue("stack")
+	if len(stack) > 4096 {
+		stack = stack[:4096]
+	}
+	return stack
+}
@@ -0,0 +1,49 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.seankhliao.com/apis/saver/v1"
+)
+
+// ErrDuration is returned with a usable Beacon when only its duration is invalid
+var ErrDuration = errors.New("invalid beacon duration")
+
+// Beacon is a page navigation: from src to dst after dur ms on src
+type Beacon struct {
+	Src        string
+	Dst        string
+	DurationMs int64
+}
+
+// ParseBeacon reads the src, dst, and dur (optionally suffixed with ms) form values,
+// the caller should limit the size of the body
+func ParseBeacon(r *http.Request) (Beacon, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return Beacon{}, fmt.Errorf("parse beacon form: %w", err)
+	}
+	b := Beacon{
+		Src: r.FormValue("src"),
+		Dst: r.FormValue("dst"),
+	}
+	b.DurationMs, err = strconv.ParseInt(strings.TrimSuffix(r.FormValue("dur"), "ms"), 10, 64)
+	if err != nil {
+		return b, fmt.Errorf("%w: %v", ErrDuration, err)
+	}
+	return b, nil
+}
+
+// Request is the beacon as sent to the saver, from remote
+func (b Beacon) Request(remote *saver.HTTPRemote) *saver.BeaconRequest {
+	return &saver.BeaconRequest{
+		HttpRemote: remote,
+		DurationMs: b.DurationMs,
+		SrcPage:    b.Src,
+		DstPage:    b.Dst,
+	}
+}
@@ -0,0 +1,251 @@
+// Package collector receives csp violation reports and navigation beacons
+// and forwards them to a saver,
+// for services that want to mount the handlers on their own mux
+// instead of running statslogger.
+package collector
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"go.seankhliao.com/apis/saver/v1"
+)
+
+// Collector has http handlers for csp reports and beacons
+type Collector struct {
+	client  saver.SaverClient
+	log     zerolog.Logger
+	maxBody int64
+	strict  bool
+	remote  func(*http.Request) *saver.HTTPRemote
+	cspF    func(*http.Request, Report, *saver.CSPRequest) bool
+	beaconF func(*http.Request, Beacon, *saver.BeaconRequest) bool
+	rejectF func(http.ResponseWriter, *http.Request, string, error)
+	cspH    func(http.ResponseWriter, *http.Request, Report, *saver.CSPRequest)
+	beaconH func(http.ResponseWriter, *http.Request, Beacon, *saver.BeaconRequest)
+	csp     string
+	beacon  string
+	reg     prometheus.Registerer
+
+	requests *prometheus.CounterVec
+}
+
+// Option configures a Collector
+type Option func(*Collector)
+
+// WithLogger logs errors to l, nothing is logged by default.
+// A logger in the request context is preferred.
+func WithLogger(l zerolog.Logger) Option {
+	return func(c *Collector) { c.log = l }
+}
+
+// WithMaxBody limits request bodies to n bytes, 1MiB by default
+func WithMaxBody(n int64) Option {
+	return func(c *Collector) { c.maxBody = n }
+}
+
+// WithStrict rejects csp reports that fail Report.Validate
+func WithStrict(strict bool) Option {
+	return func(c *Collector) { c.strict = strict }
+}
+
+// WithRemote describes the client of a request, DefaultRemote by default
+func WithRemote(f func(*http.Request) *saver.HTTPRemote) Option {
+	return func(c *Collector) { c.remote = f }
+}
+
+// WithCSPFilter calls f with each csp report and the request built from it before forwarding,
+// f can modify the request, returning false drops the report, answering as if it was accepted
+func WithCSPFilter(f func(r *http.Request, rep Report, req *saver.CSPRequest) bool) Option {
+	return func(c *Collector) { c.cspF = f }
+}
+
+// WithBeaconFilter is WithCSPFilter for beacons
+func WithBeaconFilter(f func(r *http.Request, b Beacon, req *saver.BeaconRequest) bool) Option {
+	return func(c *Collector) { c.beaconF = f }
+}
+
+// WithReject answers requests that don't parse (outcome parse-error)
+// or fail Report.Validate (invalid, err is an *InvalidError),
+// instead of a plain 400
+func WithReject(f func(w http.ResponseWriter, r *http.Request, outcome string, err error)) Option {
+	return func(c *Collector) { c.rejectF = f }
+}
+
+// WithCSPHandler hands parsed (and with WithStrict, valid) reports
+// and the request built from them to h, which filters, forwards, and answers them
+// in place of the csp filter and the client
+func WithCSPHandler(h func(w http.ResponseWriter, r *http.Request, rep Report, req *saver.CSPRequest)) Option {
+	return func(c *Collector) { c.cspH = h }
+}
+
+// WithBeaconHandler is WithCSPHandler for beacons
+func WithBeaconHandler(h func(w http.ResponseWriter, r *http.Request, b Beacon, req *saver.BeaconRequest)) Option {
+	return func(c *Collector) { c.beaconH = h }
+}
+
+// WithPaths sets where Handler, Mount, and Middleware serve the handlers,
+// /csp and /beacon by default
+func WithPaths(csp, beacon string) Option {
+	return func(c *Collector) { c.csp, c.beacon = csp, beacon }
+}
+
+// WithRegisterer registers the collector_requests{handler,outcome} counter with reg,
+// no metrics are collected by default
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(c *Collector) { c.reg = reg }
+}
+
+// New creates a Collector forwarding to client
+func New(client saver.SaverClient, opts ...Option) *Collector {
+	c := &Collector{
+		client:  client,
+		log:     zerolog.Nop(),
+		maxBody: 1 << 20,
+		remote:  DefaultRemote,
+		csp:     "/csp",
+		beacon:  "/beacon",
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.reg != nil {
+		c.requests = promauto.With(c.reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "collector_requests",
+			Help: "csp reports and beacons received by outcome",
+		}, []string{"handler", "outcome"})
+	}
+	return c
+}
+
+// Mount creates a Collector and registers its handlers on mux
+func Mount(mux *http.ServeMux, client saver.SaverClient, opts ...Option) *Collector {
+	c := New(client, opts...)
+	mux.HandleFunc(c.csp, c.CSP)
+	mux.HandleFunc(c.beacon, c.Beacon)
+	return c
+}
+
+// Handler serves both handlers on their paths
+func (c *Collector) Handler() http.Handler {
+	return c.Middleware(http.NotFoundHandler())
+}
+
+// Middleware serves the handlers on their paths, passing other requests to next
+func (c *Collector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case c.csp:
+			c.CSP(w, r)
+		case c.beacon:
+			c.Beacon(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (c *Collector) count(handler, outcome string) {
+	if c.requests != nil {
+		c.requests.WithLabelValues(handler, outcome).Inc()
+	}
+}
+
+// logger is the request's logger if it has one
+func (c *Collector) logger(r *http.Request) *zerolog.Logger {
+	if l := zerolog.Ctx(r.Context()); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return &c.log
+}
+
+func (c *Collector) reject(w http.ResponseWriter, r *http.Request, handler, outcome string, err error) {
+	c.count(handler, outcome)
+	if c.rejectF != nil {
+		c.rejectF(w, r, outcome, err)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+}
+
+// DefaultRemote is the address, user agent, and referrer of the request
+func DefaultRemote(r *http.Request) *saver.HTTPRemote {
+	return &saver.HTTPRemote{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Remote:    r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+		Referrer:  r.Referer(),
+	}
+}
+
+// CSP handles a csp report-uri request
+func (c *Collector) CSP(w http.ResponseWriter, r *http.Request) {
+	rep, err := ParseReport(http.MaxBytesReader(w, r.Body, c.maxBody))
+	if err != nil {
+		c.logger(r).Error().Err(err).Msg("unmarshal csp report")
+		c.reject(w, r, "csp", "parse-error", err)
+		return
+	}
+	if c.strict {
+		if reason, err := rep.Validate(); err != nil {
+			c.logger(r).Debug().Err(err).Msg("invalid csp report")
+			c.reject(w, r, "csp", "invalid", &InvalidError{Reason: reason, Err: err})
+			return
+		}
+	}
+	req := rep.Request(c.remote(r))
+	if c.cspH != nil {
+		c.cspH(w, r, rep, req)
+		return
+	}
+	if c.cspF != nil && !c.cspF(r, rep, req) {
+		c.count("csp", "dropped")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	_, err = c.client.CSP(r.Context(), req)
+	if err != nil {
+		c.logger(r).Error().Err(err).Msg("write to saver")
+		c.count("csp", "forward-error")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	c.count("csp", "success")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Beacon handles a navigation beacon
+func (c *Collector) Beacon(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, c.maxBody)
+	b, err := ParseBeacon(r)
+	if errors.Is(err, ErrDuration) {
+		c.logger(r).Warn().Err(err).Msg("parse duration")
+	} else if err != nil {
+		c.logger(r).Error().Err(err).Msg("parse beacon form")
+		c.reject(w, r, "beacon", "parse-error", err)
+		return
+	}
+	req := b.Request(c.remote(r))
+	if c.beaconH != nil {
+		c.beaconH(w, r, b, req)
+		return
+	}
+	if c.beaconF != nil && !c.beaconF(r, b, req) {
+		c.count("beacon", "dropped")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	_, err = c.client.Beacon(r.Context(), req)
+	if err != nil {
+		c.logger(r).Error().Err(err).Msg("write to saver")
+		c.count("beacon", "forward-error")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	c.count("beacon", "success")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,135 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.seankhliao.com/apis/saver/v1"
+	"google.golang.org/grpc"
+)
+
+// fakeSaver keeps the records it's sent, failing with err if set
+type fakeSaver struct {
+	saver.SaverClient
+	err     error
+	csp     []*saver.CSPRequest
+	beacons []*saver.BeaconRequest
+}
+
+func (f *fakeSaver) CSP(ctx context.Context, in *saver.CSPRequest, opts ...grpc.CallOption) (*saver.CSPResponse, error) {
+	f.csp = append(f.csp, in)
+	return &saver.CSPResponse{}, f.err
+}
+
+func (f *fakeSaver) Beacon(ctx context.Context, in *saver.BeaconRequest, opts ...grpc.CallOption) (*saver.BeaconResponse, error) {
+	f.beacons = append(f.beacons, in)
+	return &saver.BeaconResponse{}, f.err
+}
+
+func TestCSP(t *testing.T) {
+	const valid = `{"csp-report":{"document-uri":"https://example.com/","violated-directive":"script-src-elem","blocked-uri":"inline"}}`
+	tests := []struct {
+		name     string
+		body     string
+		strict   bool
+		drop     bool
+		err      error
+		want     int
+		forwards int
+	}{
+		{"valid", valid, true, false, nil, http.StatusNoContent, 1},
+		{"not json", `{"csp-report":`, false, false, nil, http.StatusBadRequest, 0},
+		{"no directive strict", `{"csp-report":{"document-uri":"https://example.com/","blocked-uri":"inline"}}`, true, false, nil, http.StatusBadRequest, 0},
+		{"no directive", `{"csp-report":{"document-uri":"https://example.com/","blocked-uri":"inline"}}`, false, false, nil, http.StatusNoContent, 1},
+		{"filtered", valid, false, true, nil, http.StatusNoContent, 0},
+		{"saver error", valid, false, false, errors.New("unavailable"), http.StatusInternalServerError, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSaver{err: tt.err}
+			c := New(f, WithStrict(tt.strict), WithCSPFilter(func(*http.Request, Report, *saver.CSPRequest) bool {
+				return !tt.drop
+			}))
+			w := httptest.NewRecorder()
+			c.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/csp", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if len(f.csp) != tt.forwards {
+				t.Errorf("forwarded %d, want %d", len(f.csp), tt.forwards)
+			}
+		})
+	}
+}
+
+func TestBeacon(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		want     int
+		forwards int
+		dur      int64
+	}{
+		{"valid", "src=https://example.com/&dst=https://example.com/b&dur=120ms", http.StatusNoContent, 1, 120},
+		{"no unit", "src=https://example.com/&dur=5", http.StatusNoContent, 1, 5},
+		{"bad duration", "src=https://example.com/&dur=soon", http.StatusNoContent, 1, 0},
+		{"bad form", "src=%zz", http.StatusBadRequest, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSaver{}
+			r := httptest.NewRequest("POST", "/beacon", strings.NewReader(tt.body))
+			r.Header.Set("content-type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			New(f).Handler().ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if len(f.beacons) != tt.forwards {
+				t.Fatalf("forwarded %d, want %d", len(f.beacons), tt.forwards)
+			}
+			if tt.forwards > 0 && f.beacons[0].DurationMs != tt.dur {
+				t.Errorf("duration = %d, want %d", f.beacons[0].DurationMs, tt.dur)
+			}
+		})
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	var reason string
+	var handled int
+	c := New(nil,
+		WithStrict(true),
+		WithReject(func(w http.ResponseWriter, r *http.Request, outcome string, err error) {
+			var ierr *InvalidError
+			if errors.As(err, &ierr) {
+				reason = ierr.Reason
+			}
+			w.WriteHeader(http.StatusTeapot)
+		}),
+		WithCSPHandler(func(w http.ResponseWriter, r *http.Request, rep Report, req *saver.CSPRequest) {
+			handled++
+			w.WriteHeader(http.StatusAccepted)
+		}),
+	)
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`{"csp-report":{"document-uri":"https://example.com/","effective-directive":"img-src","blocked-uri":"data"}}`, http.StatusAccepted},
+		{`{"csp-report":{"blocked-uri":"data"}}`, http.StatusTeapot},
+	} {
+		w := httptest.NewRecorder()
+		c.CSP(w, httptest.NewRequest("POST", "/csp", strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.body, w.Code, tt.want)
+		}
+	}
+	if handled != 1 || reason != "missing-document-uri" {
+		t.Errorf("handled %d, rejected as %q", handled, reason)
+	}
+}
@@ -0,0 +1,192 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// InLambda reports whether the process was started by the AWS Lambda runtime
+func InLambda() bool {
+	return os.Getenv("AWS_LAMBDA_RUNTIME_API") != ""
+}
+
+// ServeLambda serves h as an AWS Lambda function behind API Gateway
+// (REST or HTTP APIs) or a function url, using the runtime api directly,
+// until ctx is done or the runtime api fails
+func ServeLambda(ctx context.Context, h http.Handler) error {
+	api := "http://" + os.Getenv("AWS_LAMBDA_RUNTIME_API") + "/2018-06-01/runtime/invocation/"
+	client := &http.Client{}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, api+"next", nil)
+		if err != nil {
+			return err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("next invocation: %w", err)
+		}
+		event, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("read invocation: %w", err)
+		}
+		id := res.Header.Get("lambda-runtime-aws-request-id")
+
+		invCtx, cancel := ctx, func() {}
+		if ms, err := strconv.ParseInt(res.Header.Get("lambda-runtime-deadline-ms"), 10, 64); err == nil {
+			invCtx, cancel = context.WithDeadline(ctx, time.Unix(0, ms*int64(time.Millisecond)))
+		}
+		out, err := invokeLambda(invCtx, h, event)
+		cancel()
+
+		path, ct := api+id+"/response", "application/json"
+		if err != nil {
+			path, ct = api+id+"/error", "application/vnd.aws.lambda.error+json"
+			out, _ = json.Marshal(map[string]string{
+				"errorMessage": err.Error(),
+				"errorType":    "InvalidEvent",
+			})
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(out))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("content-type", ct)
+		res, err = client.Do(req)
+		if err != nil {
+			return fmt.Errorf("post invocation result: %w", err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+}
+
+// lambdaEvent covers the api gateway v1 (rest) and v2 (http api, function url) payloads
+type lambdaEvent struct {
+	Version string `json:"version"`
+
+	// v1
+	HTTPMethod        string              `json:"httpMethod"`
+	Path              string              `json:"path"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	MultiValueQuery   map[string][]string `json:"multiValueQueryStringParameters"`
+
+	// v2
+	RawPath        string   `json:"rawPath"`
+	RawQueryString string   `json:"rawQueryString"`
+	Cookies        []string `json:"cookies"`
+
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	RequestContext  struct {
+		Identity struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+		HTTP struct {
+			Method   string `json:"method"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+	} `json:"requestContext"`
+}
+
+type lambdaResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders,omitempty"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// invokeLambda converts an api gateway event to a request for h,
+// and the response back
+func invokeLambda(ctx context.Context, h http.Handler, event []byte) ([]byte, error) {
+	var ev lambdaEvent
+	err := json.Unmarshal(event, &ev)
+	if err != nil {
+		return nil, fmt.Errorf("decode event: %w", err)
+	}
+	body := []byte(ev.Body)
+	if ev.IsBase64Encoded {
+		body, err = base64.StdEncoding.DecodeString(ev.Body)
+		if err != nil {
+			return nil, fmt.Errorf("decode body: %w", err)
+		}
+	}
+
+	v2 := ev.Version == "2.0"
+	method, path, query, remote := ev.HTTPMethod, ev.Path, url.Values(ev.MultiValueQuery).Encode(), ev.RequestContext.Identity.SourceIP
+	if v2 {
+		method, path, query, remote = ev.RequestContext.HTTP.Method, ev.RawPath, ev.RawQueryString, ev.RequestContext.HTTP.SourceIP
+	}
+	u := &url.URL{Path: path, RawQuery: query}
+	r, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	for k, v := range ev.Headers {
+		r.Header.Set(k, v)
+	}
+	for k, vs := range ev.MultiValueHeaders {
+		r.Header[http.CanonicalHeaderKey(k)] = vs
+	}
+	if len(ev.Cookies) > 0 {
+		r.Header.Set("cookie", strings.Join(ev.Cookies, "; "))
+	}
+	r.Host = r.Header.Get("host")
+	r.RemoteAddr = remote
+
+	rec := &recorder{header: make(http.Header)}
+	h.ServeHTTP(rec, r)
+
+	res := lambdaResponse{StatusCode: rec.code}
+	if res.StatusCode == 0 {
+		res.StatusCode = http.StatusOK
+	}
+	if v2 {
+		res.Headers = make(map[string]string)
+		for k, vs := range rec.header {
+			res.Headers[k] = strings.Join(vs, ",")
+		}
+	} else {
+		res.MultiValueHeaders = rec.header
+	}
+	if b := rec.body.Bytes(); utf8.Valid(b) {
+		res.Body = string(b)
+	} else {
+		res.Body, res.IsBase64Encoded = base64.StdEncoding.EncodeToString(b), true
+	}
+	return json.Marshal(res)
+}
+
+// recorder keeps a response to return to the runtime api
+type recorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header { return r.header }
+
+func (r *recorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
@@ -0,0 +1,69 @@
+package collector
+
+import (
+	"context"
+	"sync"
+
+	"go.seankhliao.com/apis/saver/v1"
+	"google.golang.org/grpc"
+)
+
+// Lazy is a saver client that's only created on first use,
+// so serverless instances that never receive a report don't pay for the connection.
+// A failed dial is retried on the next call.
+func Lazy(dial func(context.Context) (saver.SaverClient, error)) saver.SaverClient {
+	return &lazyClient{dial: dial}
+}
+
+type lazyClient struct {
+	dial func(context.Context) (saver.SaverClient, error)
+
+	mu     sync.Mutex
+	client saver.SaverClient
+}
+
+func (l *lazyClient) get(ctx context.Context) (saver.SaverClient, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.client != nil {
+		return l.client, nil
+	}
+	c, err := l.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.client = c
+	return c, nil
+}
+
+func (l *lazyClient) HTTP(ctx context.Context, in *saver.HTTPRequest, opts ...grpc.CallOption) (*saver.HTTPResponse, error) {
+	c, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.HTTP(ctx, in, opts...)
+}
+
+func (l *lazyClient) Beacon(ctx context.Context, in *saver.BeaconRequest, opts ...grpc.CallOption) (*saver.BeaconResponse, error) {
+	c, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.Beacon(ctx, in, opts...)
+}
+
+func (l *lazyClient) CSP(ctx context.Context, in *saver.CSPRequest, opts ...grpc.CallOption) (*saver.CSPResponse, error) {
+	c, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.CSP(ctx, in, opts...)
+}
+
+func (l *lazyClient) RepoDefault(ctx context.Context, in *saver.RepoDefaultRequest, opts ...grpc.CallOption) (*saver.RepoDefaultResponse, error) {
+	c, err := l.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.RepoDefault(ctx, in, opts...)
+}
@@ -0,0 +1,140 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"go.seankhliao.com/apis/saver/v1"
+)
+
+// Report is a csp violation report as sent to a report-uri
+type Report struct {
+	CspReport struct {
+		OriginalPolicy     string `json:"original-policy"`
+		ViolatedDirective  string `json:"violated-directive"`
+		Referrer           string `json:"referrer"`
+		ScriptSample       string `json:"script-sample"`
+		StatusCode         int64  `json:"status-code"`
+		LineNumber         int64  `json:"line-number"`
+		Disposition        string `json:"disposition"`
+		BlockedURI         string `json:"blocked-uri"`
+		EffectiveDirective string `json:"effective-directive"`
+		DocumentURI        string `json:"document-uri"`
+		SourceFile         string `json:"source-file"`
+	} `json:"csp-report"`
+}
+
+// ParseReport decodes a report body
+func ParseReport(r io.Reader) (Report, error) {
+	var rep Report
+	err := json.NewDecoder(r).Decode(&rep)
+	if err != nil {
+		return rep, fmt.Errorf("decode csp report: %w", err)
+	}
+	return rep, nil
+}
+
+// Disposition is enforce or report, unknown for browsers that don't send it,
+// and other for anything else
+func (r Report) Disposition() string {
+	switch d := strings.ToLower(strings.TrimSpace(r.CspReport.Disposition)); d {
+	case "":
+		return "unknown"
+	case "enforce", "report":
+		return d
+	}
+	return "other"
+}
+
+// Directive is the effective directive of a report,
+// falling back to the first token of the violated directive for older browsers
+func (r Report) Directive() string {
+	d := r.CspReport.EffectiveDirective
+	if d == "" {
+		if f := strings.Fields(r.CspReport.ViolatedDirective); len(f) > 0 {
+			d = f[0]
+		}
+	}
+	return strings.ToLower(d)
+}
+
+// BlockedSource is the host of the blocked uri,
+// or its scheme or keyword if it doesn't have one
+func (r Report) BlockedSource() string {
+	blocked := strings.ToLower(r.CspReport.BlockedURI)
+	if u, err := url.Parse(blocked); err == nil && u.Scheme != "" {
+		blocked = u.Host
+		if blocked == "" {
+			blocked = u.Scheme
+		}
+	}
+	return blocked
+}
+
+// keywords are the non url values browsers send as blocked-uri
+var keywords = map[string]bool{
+	"": true, "inline": true, "eval": true, "self": true, "data": true, "blob": true,
+	"about": true, "filesystem": true, "wasm-eval": true,
+	"trusted-types-policy": true, "trusted-types-sink": true,
+}
+
+// InvalidError is a report rejected by Validate
+type InvalidError struct {
+	Reason string // short, for metrics
+	Err    error
+}
+
+func (e *InvalidError) Error() string { return e.Err.Error() }
+func (e *InvalidError) Unwrap() error { return e.Err }
+
+// Validate checks a report has the required fields and well formed urls,
+// returning a short reason for metrics along with the error
+func (r Report) Validate() (string, error) {
+	c := r.CspReport
+	switch {
+	case c.DocumentURI == "":
+		return "missing-document-uri", fmt.Errorf("missing document-uri")
+	case r.Directive() == "":
+		return "missing-directive", fmt.Errorf("missing violated-directive and effective-directive")
+	case r.Disposition() == "other":
+		return "bad-disposition", fmt.Errorf("unknown disposition %q", c.Disposition)
+	case c.StatusCode < 0 || c.LineNumber < 0:
+		return "bad-number", fmt.Errorf("negative status-code or line-number")
+	}
+	if u, err := url.Parse(c.DocumentURI); err != nil || !u.IsAbs() {
+		return "bad-document-uri", fmt.Errorf("document-uri %q: not an absolute url", c.DocumentURI)
+	}
+	if !keywords[c.BlockedURI] {
+		if u, err := url.Parse(c.BlockedURI); err != nil || u.Scheme == "" {
+			return "bad-blocked-uri", fmt.Errorf("blocked-uri %q: not a url or keyword", c.BlockedURI)
+		}
+	}
+	for _, f := range [][2]string{{"source-file", c.SourceFile}, {"referrer", c.Referrer}} {
+		name, v := f[0], f[1]
+		if v == "" {
+			continue
+		}
+		if u, err := url.Parse(v); err != nil || u.Scheme == "" {
+			return "bad-" + name, fmt.Errorf("%s %q: not a url", name, v)
+		}
+	}
+	return "", nil
+}
+
+// Request is the report as sent to the saver, from remote
+func (r Report) Request(remote *saver.HTTPRemote) *saver.CSPRequest {
+	return &saver.CSPRequest{
+		HttpRemote:         remote,
+		Disposition:        r.CspReport.Disposition,
+		BlockedUri:         r.CspReport.BlockedURI,
+		SourceFile:         r.CspReport.SourceFile,
+		DocumentUri:        r.CspReport.DocumentURI,
+		ViolatedDirective:  r.CspReport.ViolatedDirective,
+		EffectiveDirective: r.CspReport.EffectiveDirective,
+		StatusCode:         r.CspReport.StatusCode,
+		LineNumber:         r.CspReport.LineNumber,
+	}
+}
@@ -0,0 +1,89 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ReportingEntry is one report of a Reporting API (application/reports+json) batch,
+// as sent to the endpoints named in Reporting-Endpoints or Report-To
+type ReportingEntry struct {
+	Type      string          `json:"type"`
+	Age       int64           `json:"age"`
+	URL       string          `json:"url"`
+	UserAgent string          `json:"user_agent"`
+	Body      json.RawMessage `json:"body"`
+}
+
+// ParseReporting decodes a Reporting API batch
+func ParseReporting(r io.Reader) ([]ReportingEntry, error) {
+	var es []ReportingEntry
+	err := json.NewDecoder(r).Decode(&es)
+	if err != nil {
+		return nil, fmt.Errorf("decode reporting api batch: %w", err)
+	}
+	return es, nil
+}
+
+// CSP converts a csp-violation entry to the report-uri format,
+// false for other types
+func (e ReportingEntry) CSP() (Report, bool) {
+	var rep Report
+	if e.Type != "csp-violation" {
+		return rep, false
+	}
+	var b struct {
+		DocumentURL        string `json:"documentURL"`
+		Referrer           string `json:"referrer"`
+		BlockedURL         string `json:"blockedURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		OriginalPolicy     string `json:"originalPolicy"`
+		SourceFile         string `json:"sourceFile"`
+		Sample             string `json:"sample"`
+		Disposition        string `json:"disposition"`
+		StatusCode         int64  `json:"statusCode"`
+		LineNumber         int64  `json:"lineNumber"`
+	}
+	if json.Unmarshal(e.Body, &b) != nil {
+		return rep, false
+	}
+	c := &rep.CspReport
+	c.DocumentURI = b.DocumentURL
+	if c.DocumentURI == "" {
+		c.DocumentURI = e.URL
+	}
+	c.Referrer = b.Referrer
+	c.BlockedURI = b.BlockedURL
+	c.EffectiveDirective = b.EffectiveDirective
+	// not sent separately by the reporting api
+	c.ViolatedDirective = b.EffectiveDirective
+	c.OriginalPolicy = b.OriginalPolicy
+	c.SourceFile = b.SourceFile
+	c.ScriptSample = b.Sample
+	c.Disposition = b.Disposition
+	c.StatusCode = b.StatusCode
+	c.LineNumber = b.LineNumber
+	return rep, true
+}
+
+// NetworkError is the body of a network-error (NEL) entry
+type NetworkError struct {
+	Type             string  `json:"type"`
+	Phase            string  `json:"phase"`
+	ServerIP         string  `json:"server_ip"`
+	Protocol         string  `json:"protocol"`
+	Method           string  `json:"method"`
+	StatusCode       int     `json:"status_code"`
+	ElapsedTime      int64   `json:"elapsed_time"`
+	SamplingFraction float64 `json:"sampling_fraction"`
+}
+
+// NEL decodes a network-error entry, false for other types
+func (e ReportingEntry) NEL() (NetworkError, bool) {
+	var ne NetworkError
+	if e.Type != "network-error" || json.Unmarshal(e.Body, &ne) != nil {
+		return ne, false
+	}
+	return ne, true
+}
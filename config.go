@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strings"
+)
+
+type configValue struct {
+	Value   string `json:"value"`
+	Default string `json:"default"`
+	Set     bool   `json:"set"`
+}
+
+// secretValue marks a flag whose value shouldn't be shown as is,
+// mask hides it, all of it if nil
+type secretValue struct {
+	flag.Value
+	mask func(string) string
+}
+
+func (v *secretValue) String() string {
+	if v == nil || v.Value == nil {
+		return ""
+	}
+	return v.Value.String()
+}
+
+func (v *secretValue) masked(s string) string {
+	if s == "" {
+		return ""
+	}
+	if v.mask == nil {
+		return "********"
+	}
+	return v.mask(s)
+}
+
+// secret hides a flag's value entirely, for tokens, passwords, and webhook urls
+func secret(v flag.Value) *secretValue {
+	return &secretValue{Value: v}
+}
+
+// secretString is secret for a string flag
+func secretString(p *string) *secretValue {
+	return secret((*stringValue)(p))
+}
+
+// withCredentials hides the user:password@ of a url or address in a string flag
+func withCredentials(p *string) *secretValue {
+	return &secretValue{Value: (*stringValue)(p), mask: maskUserinfo}
+}
+
+// maskUserinfo hides everything before the @ of a url or host:port
+func maskUserinfo(v string) string {
+	start := strings.Index(v, "://")
+	if start < 0 {
+		start = 0
+	} else {
+		start += 3
+	}
+	end := len(v)
+	if i := strings.Index(v[start:], "/"); i >= 0 {
+		end = start + i
+	}
+	at := strings.LastIndex(v[start:end], "@")
+	if at < 0 {
+		return v
+	}
+	return v[:start] + "********" + v[start+at:]
+}
+
+type stringValue string
+
+func (v *stringValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return string(*v)
+}
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+// resolvedConfig is every flag with its effective value
+func resolvedConfig(fs *flag.FlagSet) map[string]configValue {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	conf := make(map[string]configValue)
+	fs.VisitAll(func(f *flag.Flag) {
+		cv := configValue{
+			Value:   f.Value.String(),
+			Default: f.DefValue,
+			Set:     set[f.Name],
+		}
+		if sv, ok := f.Value.(*secretValue); ok {
+			cv.Value, cv.Default = sv.masked(cv.Value), sv.masked(cv.Default)
+		}
+		conf[f.Name] = cv
+	})
+	return conf
+}
+
+func (s *Server) config(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(resolvedConfig(s.fs))
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.seankhliao.com/usvc"
+)
+
+// envPrefix is prepended to flag names to get their environment variables,
+// -privacy.ip is STATSLOGGER_PRIVACY_IP
+const envPrefix = "STATSLOGGER_"
+
+// configArgs expands -config and the environment into flags
+// placed before the command line ones,
+// later flags win so the precedence is: flags, environment, config file
+func configArgs(args []string) ([]string, error) {
+	out, _, err := expandConfig(args)
+	return out, err
+}
+
+// expandConfig is configArgs, also returning where each flag was last set
+func expandConfig(args []string) ([]string, map[string]string, error) {
+	fs := newFlagSet(args[0], new(Server))
+	envArgs := envConfig(fs, os.LookupEnv)
+
+	out := []string{args[0]}
+	origins := make(map[string]string)
+	fn := configPath(append(envArgs, args[1:]...))
+	if fn != "" {
+		entries, err := readConfig(fn, fs)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range entries {
+			out = append(out, "-"+e.key+"="+e.value)
+			origins[e.key] = fmt.Sprintf("%s:%d", fn, e.line)
+		}
+	}
+	for _, a := range envArgs {
+		n := strings.SplitN(strings.TrimPrefix(a, "-"), "=", 2)[0]
+		origins[n] = "$" + envName(n)
+	}
+	out = append(out, envArgs...)
+	sub := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.VisitAll(func(f *flag.Flag) {
+		sub.Var(f.Value, f.Name, "")
+	})
+	sub.SetOutput(ioutil.Discard)
+	sub.Parse(args[1:])
+	sub.Visit(func(f *flag.Flag) {
+		origins[f.Name] = "command line"
+	})
+	return append(out, args[1:]...), origins, nil
+}
+
+// newFlagSet has every flag the service accepts,
+// including the ones usvc defines, with s holding the service's values
+func newFlagSet(prog string, s *Server) *flag.FlagSet {
+	fs := flag.NewFlagSet(prog, flag.ContinueOnError)
+	fs.String("addr", "", "")
+	fs.String("addr.metric", "", "")
+	new(usvc.LoggerOpts).Flags(fs)
+	new(usvc.MetricOpts).Flags(fs)
+	new(usvc.TracerOpts).Flags(fs)
+	new(usvc.SaverOpts).Flag(fs)
+	new(usvc.TLSOpts).Flags(fs)
+	s.Flags(fs)
+	return fs
+}
+
+// suggest is the flag closest to an unknown name, if any are close
+func suggest(fs *flag.FlagSet, name string) string {
+	best, bestD := "", len(name)/3+1
+	fs.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(name, f.Name); d < bestD {
+			best, bestD = f.Name, d
+		}
+	})
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// envName is the environment variable for a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flagName))
+}
+
+// envConfig is the flags set through environment variables
+func envConfig(fs *flag.FlagSet, lookup func(string) (string, bool)) []string {
+	var args []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := lookup(envName(f.Name)); ok {
+			args = append(args, "-"+f.Name+"="+v)
+		}
+	})
+	return args
+}
+
+// configPath finds the value of -config in args
+func configPath(args []string) string {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			return ""
+		}
+		a = strings.TrimPrefix(strings.TrimPrefix(a, "-"), "-")
+		if a == "config" && i+1 < len(args) {
+			return args[i+1]
+		} else if strings.HasPrefix(a, "config=") {
+			return strings.TrimPrefix(a, "config=")
+		}
+	}
+	return ""
+}
+
+// configEntry is a flag value set in a config file
+type configEntry struct {
+	key   string
+	value string
+	line  int
+}
+
+// configErrors are all the problems found in a config
+type configErrors []error
+
+func (e configErrors) Error() string {
+	var ss []string
+	for _, err := range e {
+		ss = append(ss, err.Error())
+	}
+	return strings.Join(ss, "\n")
+}
+
+// readConfig reads a toml file as flags,
+// tables prefix their keys: [privacy] ip = "hash" is -privacy.ip=hash,
+// arrays are joined with commas.
+// Entries are checked against fs, reporting unknown keys and invalid values
+func readConfig(fn string, fs *flag.FlagSet) ([]configEntry, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	entries, err := parseConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", fn, err)
+	}
+	var errs configErrors
+	for _, e := range entries {
+		f := fs.Lookup(e.key)
+		if f == nil {
+			err = fmt.Errorf("%s:%d: unknown key %s", fn, e.line, e.key)
+			if sug := suggest(fs, e.key); sug != "" {
+				err = fmt.Errorf("%w, did you mean %s?", err, sug)
+			}
+			errs = append(errs, err)
+		} else if err := f.Value.Set(e.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s: %w", fn, e.line, e.key, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return entries, nil
+}
+
+// parseConfig parses the subset of toml that maps onto flags:
+// tables, and keys with string, number, bool, or single line array values
+func parseConfig(b []byte) ([]configEntry, error) {
+	var entries []configEntry
+	var table string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table %q", n, line)
+			}
+			table = strings.TrimSpace(line[1:end])
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: empty key", n)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		val, err := configValueOf(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, key, err)
+		}
+		entries = append(entries, configEntry{key, val, n})
+	}
+	return entries, sc.Err()
+}
+
+// configValueOf converts a toml value to its flag form
+func configValueOf(v string) (string, error) {
+	if strings.HasPrefix(v, "[") {
+		var vals []string
+		rest := strings.TrimSpace(v[1:])
+		for !strings.HasPrefix(rest, "]") {
+			if rest == "" {
+				return "", fmt.Errorf("unterminated array")
+			}
+			var val string
+			var err error
+			val, rest, err = configScalar(rest)
+			if err != nil {
+				return "", err
+			}
+			vals = append(vals, val)
+			rest = strings.TrimSpace(rest)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") && rest != "" {
+				return "", fmt.Errorf("expected , in array")
+			}
+		}
+		if rest = strings.TrimSpace(rest[1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after array", rest)
+		}
+		return strings.Join(vals, ","), nil
+	}
+	val, rest, err := configScalar(v)
+	if err != nil {
+		return "", err
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after value", rest)
+	}
+	return val, nil
+}
+
+// configScalar reads one string, number, or bool from the start of v
+func configScalar(v string) (val, rest string, err error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		end := 1
+		for ; end < len(v); end++ {
+			if v[end] == '\\' {
+				end++
+			} else if v[end] == '"' {
+				break
+			}
+		}
+		if end >= len(v) {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		val, err = strconv.Unquote(v[:end+1])
+		return val, v[end+1:], err
+	case strings.HasPrefix(v, "'"):
+		end := strings.Index(v[1:], "'")
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return v[1 : end+1], v[end+2:], nil
+	}
+	end := strings.IndexAny(v, ",]# \t")
+	if end < 0 {
+		end = len(v)
+	}
+	if end == 0 {
+		return "", "", fmt.Errorf("missing value")
+	}
+	return v[:end], v[end:], nil
+}
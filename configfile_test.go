@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []configEntry
+	}{
+		{
+			"comments", "# top\n\n  # indented\nsaver = \"s:443\" # trailing\ndry-run = true#tight\n",
+			[]configEntry{{"saver", "s:443", 4}, {"dry-run", "true", 5}},
+		}, {
+			"quoting", `a = "x # not a comment"
+b = 'c:\no\escapes'
+c = "tab\tquote\"unicode\u00e9"
+d = ""
+e = 5
+`,
+			[]configEntry{{"a", "x # not a comment", 1}, {"b", `c:\no\escapes`, 2}, {"c", "tab\tquote\"unicode\u00e9", 3}, {"d", "", 4}, {"e", "5", 5}},
+		}, {
+			"arrays", `a = ["x", 'y', 3]
+b = []
+c = [ "a,b" , "]" ] # done
+`,
+			[]configEntry{{"a", "x,y,3", 1}, {"b", "", 2}, {"c", "a,b,]", 3}},
+		}, {
+			"tables", "top = 1\n[privacy]\nip = \"hash\"\n[ privacy.ipv4 ]\nbits = 16\n",
+			[]configEntry{{"top", "1", 1}, {"privacy.ip", "hash", 3}, {"privacy.ipv4.bits", "16", 5}},
+		}, {
+			"repeated", "filter = \"drop a=b\"\nfilter = \"drop c=d\"\n",
+			[]configEntry{{"filter", "drop a=b", 1}, {"filter", "drop c=d", 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfig([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfig = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for _, in := range []string{
+		"a",
+		"= 1",
+		"a =",
+		"a = \"x",
+		"a = 'x",
+		"a = \"x\" y",
+		"a = [1, 2",
+		"a = [1 2]",
+		"a = [1] y",
+		"[table",
+		"[[array.of.tables]]",
+		`a = "\q"`,
+	} {
+		if _, err := parseConfig([]byte(in)); err == nil {
+			t.Errorf("parseConfig(%q) = nil, want error", in)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "statslogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fn := filepath.Join(dir, "config.toml")
+	err = ioutil.WriteFile(fn, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	fn := writeConfig(t, "[privacy]\nipp = \"hash\"\nipv4.bits = \"many\"\nnot-a-flag-at-all = 1\n")
+	_, err := readConfig(fn, newFlagSet("statslogger", new(Server)))
+	if err == nil {
+		t.Fatal("readConfig = nil, want error")
+	}
+	errs, ok := err.(configErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("readConfig = %v, want 3 errors", err)
+	}
+	for i, want := range []string{
+		fn + ":2: unknown key privacy.ipp, did you mean privacy.ip?",
+		fn + ":3: privacy.ipv4.bits: ",
+		fn + ":4: unknown key privacy.not-a-flag-at-all",
+	} {
+		if got := errs[i].Error(); !strings.HasPrefix(got, want) {
+			t.Errorf("error %d = %q, want prefix %q", i, got, want)
+		}
+	}
+	if strings.Contains(errs[2].Error(), "did you mean") {
+		t.Errorf("error 2 = %q, want no suggestion", errs[2])
+	}
+}
+
+func TestExpandConfig(t *testing.T) {
+	fn := writeConfig(t, "saver = \"file:443\"\nhttp.prefix = \"/file\"\n[privacy]\nip = \"hash\"\n")
+	os.Setenv("STATSLOGGER_HTTP_PREFIX", "/env")
+	defer os.Unsetenv("STATSLOGGER_HTTP_PREFIX")
+
+	args, origins, err := expandConfig([]string{"statslogger", "-config", fn, "-privacy.ip=drop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	fs := newFlagSet("statslogger", s)
+	err = fs.Parse(args[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flags, environment, config file
+	if s.saverAddr != "file:443" || s.routeOpts.prefix != "/env" || s.privacyOpts.ip != "drop" {
+		t.Errorf("saver = %s, http.prefix = %s, privacy.ip = %s", s.saverAddr, s.routeOpts.prefix, s.privacyOpts.ip)
+	}
+	want := map[string]string{
+		"saver":       fn + ":1",
+		"http.prefix": "$STATSLOGGER_HTTP_PREFIX",
+		"privacy.ip":  "command line",
+		"config":      "command line",
+	}
+	if !reflect.DeepEqual(origins, want) {
+		t.Errorf("origins = %v, want %v", origins, want)
+	}
+}
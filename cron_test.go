@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// a wednesday
+	start := time.Date(2021, 3, 3, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"* * * * *", []string{"2021-03-03 10:31", "2021-03-03 10:32"}},
+		{"@hourly", []string{"2021-03-03 11:00", "2021-03-03 12:00"}},
+		{"@daily", []string{"2021-03-04 00:00", "2021-03-05 00:00"}},
+		{"@weekly", []string{"2021-03-07 00:00", "2021-03-14 00:00"}},
+		{"@monthly", []string{"2021-04-01 00:00", "2021-05-01 00:00"}},
+		{"0 9 * * 1-5", []string{"2021-03-04 09:00", "2021-03-05 09:00", "2021-03-08 09:00"}},
+		{"*/20 10-11 * * *", []string{"2021-03-03 10:40", "2021-03-03 11:00", "2021-03-03 11:20", "2021-03-03 11:40", "2021-03-04 10:00"}},
+		{"5/30 * * * *", []string{"2021-03-03 10:35", "2021-03-03 11:05"}},
+		{"0 0-12/6 * * *", []string{"2021-03-03 12:00", "2021-03-04 00:00", "2021-03-04 06:00"}},
+		{"15,45 8 * * *", []string{"2021-03-04 08:15", "2021-03-04 08:45"}},
+		// sunday as 7
+		{"0 0 * * 7", []string{"2021-03-07 00:00"}},
+		// both restricted: either matches
+		{"0 0 13 * 5", []string{"2021-03-05 00:00", "2021-03-12 00:00", "2021-03-13 00:00", "2021-03-19 00:00"}},
+		// only one restricted: that one decides
+		{"0 0 13 * *", []string{"2021-03-13 00:00", "2021-04-13 00:00"}},
+		{"0 0 * * 5", []string{"2021-03-05 00:00", "2021-03-12 00:00"}},
+		{"0 0 31 * *", []string{"2021-03-31 00:00", "2021-05-31 00:00"}},
+		{"0 0 29 2 *", []string{"2024-02-29 00:00"}},
+		{"0 0 30 2 *", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			c, err := parseCron(tt.spec, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := start
+			for _, w := range tt.want {
+				next = c.Next(next)
+				if got := next.Format("2006-01-02 15:04"); got != w {
+					t.Fatalf("Next = %s, want %s", got, w)
+				}
+			}
+			if tt.want == nil {
+				if next = c.Next(next); !next.IsZero() {
+					t.Errorf("Next = %v, want none", next)
+				}
+			}
+		})
+	}
+}
+
+func TestCronLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+9", 9*60*60)
+	c, err := parseCron("0 9 * * *", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := c.Next(time.Date(2021, 3, 3, 0, 30, 0, 0, time.UTC))
+	if want := time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Next = %v, want %v", got, want)
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@yearly",
+	} {
+		if _, err := parseCron(spec, time.UTC); err == nil {
+			t.Errorf("parseCron(%q) = nil, want error", spec)
+		}
+	}
+}
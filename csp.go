@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+
+	"go.seankhliao.com/statslogger/collector"
+)
+
+// cspDirectives are the directives exported as metric labels by default
+var cspDirectives = []string{
+	"base-uri", "child-src", "connect-src", "default-src", "font-src",
+	"form-action", "frame-ancestors", "frame-src", "img-src", "manifest-src",
+	"media-src", "navigate-to", "object-src", "prefetch-src", "script-src",
+	"script-src-attr", "script-src-elem", "style-src", "style-src-attr",
+	"style-src-elem", "trusted-types", "require-trusted-types-for", "worker-src",
+}
+
+// disposition is whether the violated policy was enforced or report-only,
+// unknown for browsers that don't send it
+func (r CSPReport) disposition() string {
+	return collector.Report(r).Disposition()
+}
+
+// directive is the effective directive of a report
+func (r CSPReport) directive() string {
+	return collector.Report(r).Directive()
+}
+
+// fingerprint is a stable hash grouping violations
+// by directive, blocked host (or scheme / keyword), and document path,
+// with paths collapsed by the normalize patterns
+func (r CSPReport) fingerprint(n normalizeOpts) string {
+	blocked := r.blockedSource()
+	doc := r.CspReport.DocumentURI
+	if u, err := url.Parse(doc); err == nil {
+		doc = u.Path
+		if doc == "" {
+			doc = "/"
+		} else if len(doc) > 1 {
+			doc = strings.TrimRight(doc, "/")
+		}
+	}
+	if p, ok := n.collapse(doc); ok {
+		doc = p
+	}
+	h := sha256.Sum256([]byte(r.directive() + "\n" + blocked + "\n" + doc))
+	return hex.EncodeToString(h[:8])
+}
+
+// blockedSource is the host of the blocked uri,
+// or its scheme or keyword if it doesn't have one
+func (r CSPReport) blockedSource() string {
+	return collector.Report(r).BlockedSource()
+}
+
+// validate checks a report has the required fields and well formed urls,
+// returning a short reason for metrics along with the error
+func (r CSPReport) validate() (string, error) {
+	return collector.Report(r).Validate()
+}
+
+// labelSet bounds label cardinality to known values
+type labelSet map[string]bool
+
+func newLabelSet(vs []string) labelSet {
+	ls := make(labelSet, len(vs))
+	for _, v := range vs {
+		ls[v] = true
+	}
+	return ls
+}
+
+func (ls labelSet) label(v string) string {
+	if ls[v] {
+		return v
+	}
+	return "other"
+}
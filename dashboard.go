@@ -0,0 +1,169 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.seankhliao.com/apis/saver/v1"
+)
+
+var dashboardTmpl = template.Must(template.New("dashboard").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width,initial-scale=1">
+<meta http-equiv="refresh" content="30">
+<title>statslogger</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em auto; max-width: 72em; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { text-align: left; padding: .2em .6em; border-bottom: 1px solid #ddd; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+.spark { font-size: 1.5em; letter-spacing: -.1em; }
+</style>
+</head>
+<body>
+<h1>statslogger</h1>
+<p>
+violations <span class="spark">{{ .ViolationTrend }}</span>
+beacons <span class="spark">{{ .BeaconTrend }}</span>
+over {{ .Window }}
+</p>
+
+<h2>Violations</h2>
+<p>last {{ .Buffered }} forwarded reports, by fingerprint</p>
+<table>
+<tr><th>fingerprint</th><th>class</th><th>directive</th><th>blocked</th><th>document</th><th>count</th><th>last seen</th></tr>
+{{ range .Groups }}
+<tr><td><code>{{ .Fingerprint }}</code></td><td>{{ .Class }}</td><td>{{ .Directive }}</td><td>{{ .Blocked }}</td><td>{{ .Document }}</td><td class="n">{{ .Count }}</td><td>{{ .Last.Format "15:04:05" }}</td></tr>
+{{ end }}
+</table>
+
+<h2>Top pages</h2>
+<table>
+<tr><th>page</th><th>beacons</th></tr>
+{{ range .Pages }}
+<tr><td>{{ .Key }}</td><td class="n">{{ .Count }}</td></tr>
+{{ end }}
+</table>
+
+<h2>Beacon durations</h2>
+<p>last {{ .Durations.N }} beacons</p>
+<table>
+<tr><th>p50</th><th>p90</th><th>p99</th></tr>
+<tr><td class="n">{{ .Durations.P50 }}</td><td class="n">{{ .Durations.P90 }}</td><td class="n">{{ .Durations.P99 }}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+type dashboardGroup struct {
+	Fingerprint string
+	Class       string
+	Directive   string
+	Blocked     string
+	Document    string
+	Count       int
+	Last        time.Time
+}
+
+type dashboardDurations struct {
+	N             int
+	P50, P90, P99 time.Duration
+}
+
+// dashboard serves an overview built from the buffered reports and top counts
+func (s *Server) dashboard(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	recs := s.recent.Records()
+	groups := make(map[string]*dashboardGroup)
+	var durs []int64
+	for _, rec := range recs {
+		switch m := rec.Report.(type) {
+		case *saver.CSPRequest:
+			fp := rec.Metadata["csp-fingerprint"]
+			g, ok := groups[fp]
+			if !ok {
+				directive := m.EffectiveDirective
+				if directive == "" {
+					directive = m.ViolatedDirective
+				}
+				g = &dashboardGroup{
+					Fingerprint: fp,
+					Class:       rec.Metadata["csp-class"],
+					Directive:   directive,
+					Blocked:     hostOf(m.BlockedUri),
+					Document:    m.DocumentUri,
+					Last:        rec.Time,
+				}
+				groups[fp] = g
+			}
+			g.Count++
+		case *saver.BeaconRequest:
+			if m.DurationMs > 0 {
+				durs = append(durs, m.DurationMs)
+			}
+		}
+	}
+	var gs []*dashboardGroup
+	for _, g := range groups {
+		gs = append(gs, g)
+	}
+	sort.Slice(gs, func(i, j int) bool { return gs[i].Count > gs[j].Count })
+
+	var d dashboardDurations
+	if len(durs) > 0 {
+		sort.Slice(durs, func(i, j int) bool { return durs[i] < durs[j] })
+		d = dashboardDurations{
+			N:   len(durs),
+			P50: time.Duration(percentile(durs, 50)) * time.Millisecond,
+			P90: time.Duration(percentile(durs, 90)) * time.Millisecond,
+			P99: time.Duration(percentile(durs, 99)) * time.Millisecond,
+		}
+	}
+
+	var window string
+	var pages []topEntry
+	if len(s.top.windows) > 0 {
+		w := s.top.windows[0].window
+		window = w.String()
+		pages, _ = s.top.Top("page", w, 20, now)
+	}
+
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	err := dashboardTmpl.Execute(w, map[string]interface{}{
+		"Buffered":       len(recs),
+		"Groups":         gs,
+		"Pages":          pages,
+		"Durations":      d,
+		"Window":         window,
+		"ViolationTrend": sparkline(s.top.Series("violation", now)),
+		"BeaconTrend":    sparkline(s.top.Series("page", now)),
+	})
+	if err != nil {
+		s.log.Error().Err(err).Msg("render dashboard")
+	}
+}
+
+// sparkline draws values as block characters
+func sparkline(vs []uint64) string {
+	const blocks = "▁▂▃▄▅▆▇█"
+	var max uint64
+	for _, v := range vs {
+		if v > max {
+			max = v
+		}
+	}
+	bs := []rune(blocks)
+	out := make([]rune, len(vs))
+	for i, v := range vs {
+		idx := 0
+		if max > 0 {
+			idx = int(v * uint64(len(bs)-1) / max)
+		}
+		out[i] = bs[idx]
+	}
+	return string(out)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"runtime"
+)
+
+type debugOpts struct {
+	blockRate     int
+	mutexFraction int
+}
+
+func (o *debugOpts) Flags(fs *flag.FlagSet) {
+	fs.IntVar(&o.blockRate, "debug.block-rate", 0, "runtime.SetBlockProfileRate for /debug/pprof/block on the metrics port, 0 to disable")
+	fs.IntVar(&o.mutexFraction, "debug.mutex-fraction", 0, "runtime.SetMutexProfileFraction for /debug/pprof/mutex on the metrics port, 0 to disable")
+}
+
+// setup enables the optional profiles,
+// usvc already serves net/http/pprof (including trace) on the metrics port
+func (o debugOpts) setup() {
+	runtime.SetBlockProfileRate(o.blockRate)
+	runtime.SetMutexProfileFraction(o.mutexFraction)
+}
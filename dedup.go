@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"go.seankhliao.com/apis/saver/v1"
+	"google.golang.org/grpc/metadata"
+)
+
+type dedupOpts struct {
+	window time.Duration
+}
+
+func (o *dedupOpts) Flags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.window, "csp.dedup", 0, "forward identical csp violations (directive, blocked-uri, document-uri, client) once per window, followed by a summary with the duplicate count, at least 1s, 0 to disable")
+}
+
+func (o dedupOpts) validate() error {
+	if o.window > 0 && o.window < time.Second {
+		return fmt.Errorf("csp.dedup: %v shorter than 1s", o.window)
+	}
+	return nil
+}
+
+// dedup suppresses repeats of a csp violation within a window
+type dedup struct {
+	dedupOpts
+	log        zerolog.Logger
+	suppressed prometheus.Counter
+	send       func(ctx context.Context, req *saver.CSPRequest) error
+
+	mu      sync.Mutex
+	groups  map[string]*dupGroup
+	expired []*dupGroup // replaced before the sweep could summarize them
+}
+
+type dupGroup struct {
+	first time.Time
+	req   *saver.CSPRequest
+	md    metadata.MD
+	dups  int
+}
+
+func newDedup(ctx context.Context, o dedupOpts, log zerolog.Logger, f promauto.Factory, send func(context.Context, *saver.CSPRequest) error) *dedup {
+	d := &dedup{
+		dedupOpts: o,
+		log:       log,
+		suppressed: f.NewCounter(prometheus.CounterOpts{
+			Name: "csp_duplicates",
+		}),
+		send:   send,
+		groups: make(map[string]*dupGroup),
+	}
+	if o.window > 0 {
+		go d.sweep(ctx)
+	}
+	return d
+}
+
+// dedupKey identifies a violation from a client
+func (r CSPReport) dedupKey(client string) string {
+	return strings.Join([]string{
+		r.directive(),
+		r.CspReport.BlockedURI,
+		r.CspReport.DocumentURI,
+		client,
+	}, "|")
+}
+
+// Duplicate counts a report and returns true if it repeats one forwarded in the window
+func (d *dedup) Duplicate(key string, t time.Time) bool {
+	if d.window <= 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	g, ok := d.groups[key]
+	if ok && t.Sub(g.first) < d.window {
+		g.dups++
+		d.suppressed.Inc()
+		return true
+	}
+	return false
+}
+
+// Forwarded starts a window with the forwarded report to base the summary on,
+// reports dropped by later stages or failing to forward never start one.
+// Concurrent first reports may both be forwarded, the first to finish is kept.
+func (d *dedup) Forwarded(ctx context.Context, key string, req *saver.CSPRequest, t time.Time) {
+	if d.window <= 0 {
+		return
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if g, ok := d.groups[key]; ok {
+		if t.Sub(g.first) < d.window {
+			return
+		}
+		if g.dups > 0 {
+			d.expired = append(d.expired, g)
+		}
+	}
+	d.groups[key] = &dupGroup{first: t, req: req, md: md.Copy()}
+}
+
+func (d *dedup) sweep(ctx context.Context) {
+	t := time.NewTicker(d.window / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			d.mu.Lock()
+			expired := d.expired
+			d.expired = nil
+			for key, g := range d.groups {
+				if now.Sub(g.first) < d.window {
+					continue
+				}
+				delete(d.groups, key)
+				if g.dups > 0 {
+					expired = append(expired, g)
+				}
+			}
+			d.mu.Unlock()
+
+			for _, g := range expired {
+				// same record as the first, marked with the count
+				sctx := metadata.NewOutgoingContext(d.log.WithContext(ctx), metadata.Join(g.md, metadata.Pairs(
+					"csp-duplicates", strconv.Itoa(g.dups),
+					"csp-duplicates-since", g.first.UTC().Format(time.RFC3339),
+				)))
+				err := d.send(sctx, g.req)
+				if err != nil {
+					d.log.Error().Err(err).Int("duplicates", g.dups).Msg("forward duplicate summary")
+				}
+			}
+		}
+	}
+}
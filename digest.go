@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// digestFingerprints is the most new fingerprints listed in a digest
+	digestFingerprints = 50
+	// digestPages is the capacity for counting violating pages
+	digestPages = 1000
+	// digestSamples is the beacon durations kept per page per period
+	digestSamples = 200
+	// digestKnown is the fingerprints remembered as not new, forgotten all at once when full
+	digestKnown = 100000
+)
+
+type digestOpts struct {
+	smtp       string
+	user       string
+	password   string
+	from       string
+	to         stringList
+	at         string
+	regression float64
+	min        int
+	webhook    string
+	cron       string
+}
+
+func (o *digestOpts) Flags(fs *flag.FlagSet) {
+	fs.Var(withCredentials(&o.smtp), "digest.smtp", "host:port of the smtp server to send the daily digest through, disabled if empty")
+	fs.StringVar(&o.user, "digest.smtp.user", "", "smtp username, no auth if empty")
+	fs.Var(secretString(&o.password), "digest.smtp.password", "smtp password")
+	fs.StringVar(&o.from, "digest.from", "statslogger@localhost", "sender address of the digest")
+	fs.Var(&o.to, "digest.to", "comma separated recipient addresses of the digest")
+	fs.StringVar(&o.at, "digest.at", "08:00", "time of day to send the digest, in -time.zone")
+	fs.Float64Var(&o.regression, "digest.regression", 1.25, "ratio of a page's p90 beacon duration to the previous digest's to report as a regression")
+	fs.IntVar(&o.min, "digest.min", 20, "minimum beacons for a page in both digests to compare durations")
+	fs.Var(secretString(&o.webhook), "digest.webhook", "[slack=|discord=]url to post the digest to, plain urls get json, disabled if empty")
+	fs.StringVar(&o.cron, "digest.webhook.schedule", "@daily", "cron schedule of the webhook digest in -time.zone, minute hour day month weekday, or @hourly, @daily, @weekly")
+}
+
+func (o digestOpts) validate() error {
+	if _, _, err := parseClock(o.at); err != nil {
+		return fmt.Errorf("digest.at: %w", err)
+	}
+	if o.regression <= 1 {
+		return fmt.Errorf("digest.regression: must be more than 1: %v", o.regression)
+	}
+	if o.webhook != "" {
+		if _, _, err := parseWebhook(o.webhook); err != nil {
+			return fmt.Errorf("digest.webhook: %w", err)
+		}
+		if _, err := parseCron(o.cron, time.UTC); err != nil {
+			return fmt.Errorf("digest.webhook.schedule: %w", err)
+		}
+	}
+	if o.smtp == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(o.smtp); err != nil {
+		return fmt.Errorf("digest.smtp: %w", err)
+	}
+	if len(o.to) == 0 {
+		return fmt.Errorf("digest.to: no recipients for digest.smtp")
+	}
+	return nil
+}
+
+// parseClock parses HH:MM
+func parseClock(v string) (h, m int, err error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, 0, fmt.Errorf("expected HH:MM: %q", v)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// schedule is when to send a digest
+type schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// dailyAt is a time of day in a time zone
+type dailyAt struct {
+	h, m int
+	loc  *time.Location
+}
+
+func (d dailyAt) Next(after time.Time) time.Time {
+	a := after.In(d.loc)
+	t := time.Date(a.Year(), a.Month(), a.Day(), d.h, d.m, 0, 0, d.loc)
+	if !t.After(after) {
+		t = time.Date(a.Year(), a.Month(), a.Day()+1, d.h, d.m, 0, 0, d.loc)
+	}
+	return t
+}
+
+type digestFingerprint struct {
+	Fingerprint  string `json:"fingerprint"`
+	Class        string `json:"class"`
+	Directive    string `json:"directive"`
+	BlockedHost  string `json:"blocked_host"`
+	DocumentHost string `json:"document_host"`
+	Violations   int    `json:"violations"`
+}
+
+type digestRegression struct {
+	Page    string `json:"page"`
+	Beacons int    `json:"beacons"`
+	P90     int64  `json:"p90_ms"`
+	PrevP90 int64  `json:"prev_p90_ms"`
+}
+
+// digestSummary is what happened in a period
+type digestSummary struct {
+	Start           time.Time           `json:"start"`
+	End             time.Time           `json:"end"`
+	NewFingerprints []digestFingerprint `json:"new_fingerprints"`
+	MoreNew         int                 `json:"more_new,omitempty"`
+	TopPages        []topEntry          `json:"top_pages"`
+	Regressions     []digestRegression  `json:"regressions"`
+}
+
+// Text renders the summary as markdown, readable as plain text
+func (ds digestSummary) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "statslogger digest %s to %s\n", ds.Start.Format("2006-01-02 15:04"), ds.End.Format("2006-01-02 15:04 MST"))
+
+	fmt.Fprintf(&b, "\nNew violations: %d\n", len(ds.NewFingerprints)+ds.MoreNew)
+	for _, f := range ds.NewFingerprints {
+		fmt.Fprintf(&b, "- `%s` %s: %s blocked %s on %s, %d times\n", f.Fingerprint, f.Class, f.Directive, f.BlockedHost, f.DocumentHost, f.Violations)
+	}
+	if ds.MoreNew > 0 {
+		fmt.Fprintf(&b, "- and %d more\n", ds.MoreNew)
+	}
+
+	fmt.Fprintf(&b, "\nTop violating pages:\n")
+	for _, e := range ds.TopPages {
+		fmt.Fprintf(&b, "- %s: %d\n", e.Key, e.Count)
+	}
+	if len(ds.TopPages) == 0 {
+		fmt.Fprintf(&b, "- none\n")
+	}
+
+	fmt.Fprintf(&b, "\nSlower pages (p90 beacon duration):\n")
+	for _, r := range ds.Regressions {
+		fmt.Fprintf(&b, "- %s: %v from %v over %d beacons\n", r.Page, time.Duration(r.P90)*time.Millisecond, time.Duration(r.PrevP90)*time.Millisecond, r.Beacons)
+	}
+	if len(ds.Regressions) == 0 {
+		fmt.Fprintf(&b, "- none\n")
+	}
+	return b.String()
+}
+
+type pageDurations struct {
+	seen    int
+	samples []int64
+}
+
+// digest collects violations and beacons over a period,
+// summarizing them for send on each schedule
+type digest struct {
+	name       string
+	log        zerolog.Logger
+	sent       *prometheus.CounterVec
+	schedule   schedule
+	send       func(context.Context, digestSummary) error
+	regression float64
+	min        int
+
+	mu        sync.Mutex
+	start     time.Time
+	known     map[string]struct{}
+	fresh     map[string]*digestFingerprint
+	pages     spaceSaving
+	durations map[string]*pageDurations
+	prevP90   map[string]int64
+}
+
+func newDigest(ctx context.Context, name string, sch schedule, send func(context.Context, digestSummary) error, regression float64, min int, log zerolog.Logger, sent *prometheus.CounterVec) *digest {
+	d := &digest{
+		name:       name,
+		log:        log.With().Str("module", "digest").Str("digest", name).Logger(),
+		sent:       sent,
+		schedule:   sch,
+		send:       send,
+		regression: regression,
+		min:        min,
+		start:      time.Now(),
+		known:      make(map[string]struct{}),
+	}
+	d.reset()
+	go d.run(ctx)
+	return d
+}
+
+func (d *digest) reset() {
+	d.fresh = make(map[string]*digestFingerprint)
+	d.pages = make(spaceSaving)
+	d.durations = make(map[string]*pageDurations)
+}
+
+// CSP records a violation
+func (d *digest) CSP(fingerprint, class string, r CSPReport) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pages.add(pageKey(r.CspReport.DocumentURI), digestPages)
+	if f, ok := d.fresh[fingerprint]; ok {
+		f.Violations++
+		return
+	}
+	if _, ok := d.known[fingerprint]; ok {
+		return
+	}
+	if len(d.known) >= digestKnown {
+		d.known = make(map[string]struct{})
+	}
+	d.known[fingerprint] = struct{}{}
+	d.fresh[fingerprint] = &digestFingerprint{
+		Fingerprint:  fingerprint,
+		Class:        class,
+		Directive:    r.directive(),
+		BlockedHost:  hostOf(r.CspReport.BlockedURI),
+		DocumentHost: hostOf(r.CspReport.DocumentURI),
+		Violations:   1,
+	}
+}
+
+// Beacon records a beacon duration for a page
+func (d *digest) Beacon(page string, durMs int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pd, ok := d.durations[page]
+	if !ok {
+		pd = &pageDurations{}
+		d.durations[page] = pd
+	}
+	pd.seen++
+	if len(pd.samples) < digestSamples {
+		pd.samples = append(pd.samples, durMs)
+	} else if i := rand.Intn(pd.seen); i < digestSamples {
+		pd.samples[i] = durMs
+	}
+}
+
+// Summary ends the current period
+func (d *digest) Summary(now time.Time) digestSummary {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ds := digestSummary{
+		Start:           d.start,
+		End:             now,
+		NewFingerprints: []digestFingerprint{},
+		TopPages:        []topEntry{},
+		Regressions:     []digestRegression{},
+	}
+
+	for _, f := range d.fresh {
+		ds.NewFingerprints = append(ds.NewFingerprints, *f)
+	}
+	sort.Slice(ds.NewFingerprints, func(i, j int) bool {
+		return ds.NewFingerprints[i].Violations > ds.NewFingerprints[j].Violations
+	})
+	if len(ds.NewFingerprints) > digestFingerprints {
+		ds.MoreNew = len(ds.NewFingerprints) - digestFingerprints
+		ds.NewFingerprints = ds.NewFingerprints[:digestFingerprints]
+	}
+
+	for k, c := range d.pages {
+		ds.TopPages = append(ds.TopPages, topEntry{k, c})
+	}
+	sort.Slice(ds.TopPages, func(i, j int) bool { return ds.TopPages[i].Count > ds.TopPages[j].Count })
+	if len(ds.TopPages) > 10 {
+		ds.TopPages = ds.TopPages[:10]
+	}
+
+	p90s := make(map[string]int64, len(d.durations))
+	for page, pd := range d.durations {
+		if pd.seen < d.min {
+			continue
+		}
+		sort.Slice(pd.samples, func(i, j int) bool { return pd.samples[i] < pd.samples[j] })
+		p90 := percentile(pd.samples, 90)
+		p90s[page] = p90
+		if prev, ok := d.prevP90[page]; ok && prev > 0 && float64(p90) >= float64(prev)*d.regression {
+			ds.Regressions = append(ds.Regressions, digestRegression{page, pd.seen, p90, prev})
+		}
+	}
+	sort.Slice(ds.Regressions, func(i, j int) bool {
+		return float64(ds.Regressions[i].P90)/float64(ds.Regressions[i].PrevP90) > float64(ds.Regressions[j].P90)/float64(ds.Regressions[j].PrevP90)
+	})
+
+	d.prevP90 = p90s
+	d.start = now
+	d.reset()
+	return ds
+}
+
+func (d *digest) run(ctx context.Context) {
+	for {
+		next := d.schedule.Next(time.Now())
+		if next.IsZero() {
+			d.log.Error().Msg("schedule never matches, not sending digests")
+			return
+		}
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case now := <-t.C:
+			ds := d.Summary(now.In(next.Location()))
+			err := d.send(ctx, ds)
+			if err != nil {
+				d.log.Error().Err(err).Msg("send digest")
+				d.sent.WithLabelValues(d.name, "error").Inc()
+				continue
+			}
+			d.log.Info().Int("new", len(ds.NewFingerprints)+ds.MoreNew).Int("regressions", len(ds.Regressions)).Msg("sent digest")
+			d.sent.WithLabelValues(d.name, "success").Inc()
+		}
+	}
+}
+
+// digests are the configured digests, all fed the same records
+type digests []*digest
+
+func newDigests(ctx context.Context, o digestOpts, loc *time.Location, log zerolog.Logger, f promauto.Factory) digests {
+	sent := f.NewCounterVec(prometheus.CounterOpts{
+		Name: "digests",
+	}, []string{"digest", "outcome"})
+	var ds digests
+	if o.smtp != "" {
+		h, m, _ := parseClock(o.at)
+		ds = append(ds, newDigest(ctx, "email", dailyAt{h, m, loc}, o.sendMail, o.regression, o.min, log, sent))
+	}
+	if o.webhook != "" {
+		c, _ := parseCron(o.cron, loc)
+		client := &http.Client{Timeout: 10 * time.Second}
+		ds = append(ds, newDigest(ctx, "webhook", c, func(ctx context.Context, sum digestSummary) error {
+			kind, u, _ := parseWebhook(o.webhook)
+			body := struct {
+				digestSummary
+				Text string `json:"text"`
+			}{sum, sum.Text()}
+			err := postWebhook(ctx, client, kind, u, body, body.Text)
+			if err != nil {
+				return fmt.Errorf("webhook %s: %w", hostOf(u), err)
+			}
+			return nil
+		}, o.regression, o.min, log, sent))
+	}
+	return ds
+}
+
+func (ds digests) CSP(fingerprint, class string, r CSPReport) {
+	for _, d := range ds {
+		d.CSP(fingerprint, class, r)
+	}
+}
+
+func (ds digests) Beacon(page string, durMs int64) {
+	for _, d := range ds {
+		d.Beacon(page, durMs)
+	}
+}
+
+func (o digestOpts) sendMail(ctx context.Context, ds digestSummary) error {
+	var auth smtp.Auth
+	if o.user != "" {
+		host, _, _ := net.SplitHostPort(o.smtp)
+		auth = smtp.PlainAuth("", o.user, o.password, host)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", o.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(o.to, ", "))
+	fmt.Fprintf(&b, "Subject: statslogger digest %s\r\n", ds.End.Format("2006-01-02"))
+	fmt.Fprintf(&b, "Date: %s\r\n", ds.End.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(ds.Text(), "\n", "\r\n"))
+	err := smtp.SendMail(o.smtp, auth, o.from, o.to, []byte(b.String()))
+	if err != nil {
+		return fmt.Errorf("smtp %s: %w", o.smtp, err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+// exemplar links a metric to the sampled trace in ctx, if any
+func exemplar(ctx context.Context) prometheus.Labels {
+	sc := trace.SpanFromContext(ctx).SpanContext()
+	if !sc.IsValid() || !sc.IsSampled() {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": sc.TraceID.String()}
+}
+
+// incWithExemplar increments c, with the trace and any extra label pairs in kv as the exemplar
+func incWithExemplar(ctx context.Context, c prometheus.Counter, kv ...string) {
+	e := exemplar(ctx)
+	for i := 0; i+1 < len(kv); i += 2 {
+		if e == nil {
+			e = prometheus.Labels{}
+		}
+		e[kv[i]] = kv[i+1]
+	}
+	if e != nil {
+		if ea, ok := c.(prometheus.ExemplarAdder); ok {
+			ea.AddWithExemplar(1, e)
+			return
+		}
+	}
+	c.Inc()
+}
+
+func observeWithExemplar(ctx context.Context, o prometheus.Observer, v float64) {
+	if e := exemplar(ctx); e != nil {
+		if eo, ok := o.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(v, e)
+			return
+		}
+	}
+	o.Observe(v)
+}
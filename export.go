@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.seankhliao.com/apis/saver/v1"
+)
+
+// exportFlush is the number of rows written between flushes
+const exportFlush = 100
+
+var exportHeaders = map[string][]string{
+	"csp":    {"time", "remote", "user_agent", "referrer", "disposition", "blocked_uri", "source_file", "document_uri", "violated_directive", "effective_directive", "line_number", "status_code", "fingerprint", "class", "metadata"},
+	"beacon": {"time", "remote", "user_agent", "referrer", "duration_ms", "src_page", "dst_page", "metadata"},
+	"top":    {"window", "kind", "key", "count"},
+}
+
+// export streams CSV for ?type=csp|beacon, filtered as /debug/reports,
+// or ?type=top for the top counts of every kind in ?window=
+func (s *Server) export(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	typ := r.FormValue("type")
+	header, ok := exportHeaders[typ]
+	if !ok {
+		http.Error(w, "type: expected one of csp, beacon, top", http.StatusBadRequest)
+		return
+	}
+
+	var rows func(yield func([]string) error) error
+	switch typ {
+	case "top":
+		window := time.Hour
+		if len(s.top.windows) > 0 {
+			window = s.top.windows[0].window
+		}
+		if v := r.FormValue("window"); v != "" {
+			var err error
+			window, err = time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, "invalid window", http.StatusBadRequest)
+				return
+			}
+		}
+		if _, _, ok := s.top.Durations(window, now); !ok {
+			http.Error(w, fmt.Sprintf("window %v not in top.windows", window), http.StatusNotFound)
+			return
+		}
+		rows = func(yield func([]string) error) error {
+			for _, kind := range []string{"page", "violation", "directive"} {
+				es, _ := s.top.Top(kind, window, s.top.capacity, now)
+				for _, e := range es {
+					err := yield([]string{window.String(), kind, e.Key, strconv.FormatUint(e.Count, 10)})
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+	default:
+		q, err := parseRecordQuery(r, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.handler = typ
+		rows = func(yield func([]string) error) error {
+			for _, rec := range s.recent.Query(q) {
+				err := yield(exportRow(rec))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	w.Header().Set("content-type", "text/csv; charset=utf-8")
+	w.Header().Set("content-disposition", fmt.Sprintf(`attachment; filename="statslogger-%s-%s.csv"`, typ, now.UTC().Format("20060102T150405Z")))
+	cw := csv.NewWriter(w)
+	flusher, _ := w.(http.Flusher)
+	var n int
+	err := cw.Write(header)
+	if err == nil {
+		err = rows(func(row []string) error {
+			for i, c := range row {
+				row[i] = csvCell(c)
+			}
+			err := cw.Write(row)
+			n++
+			if n%exportFlush == 0 {
+				cw.Flush()
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			return err
+		})
+	}
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		s.log.Error().Err(err).Str("type", typ).Msg("export csv")
+	}
+}
+
+func exportRow(rec record) []string {
+	row := []string{rec.Time.UTC().Format(time.RFC3339Nano)}
+	remote := func(hr *saver.HTTPRemote) []string {
+		if hr == nil {
+			return []string{"", "", ""}
+		}
+		return []string{hr.Remote, hr.UserAgent, hr.Referrer}
+	}
+	switch m := rec.Report.(type) {
+	case *saver.CSPRequest:
+		row = append(row, remote(m.HttpRemote)...)
+		row = append(row,
+			m.Disposition, m.BlockedUri, m.SourceFile, m.DocumentUri,
+			m.ViolatedDirective, m.EffectiveDirective,
+			strconv.FormatInt(m.LineNumber, 10), strconv.FormatInt(m.StatusCode, 10),
+			rec.Metadata["csp-fingerprint"], rec.Metadata["csp-class"],
+		)
+	case *saver.BeaconRequest:
+		row = append(row, remote(m.HttpRemote)...)
+		row = append(row, strconv.FormatInt(m.DurationMs, 10), m.SrcPage, m.DstPage)
+	}
+	keys := make([]string, 0, len(rec.Metadata))
+	for k := range rec.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		kvs = append(kvs, k+"="+rec.Metadata[k])
+	}
+	return append(row, strings.Join(kvs, "; "))
+}
+
+// csvCell stops spreadsheets from evaluating client controlled values as formulas
+func csvCell(c string) string {
+	if c == "" || !strings.ContainsRune("=+-@\t\r", rune(c[0])) {
+		return c
+	}
+	if _, err := strconv.ParseFloat(c, 64); err == nil {
+		return c
+	}
+	return "'" + c
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// exprCond is a compiled condition over the fields of a report,
+// looked up by field as in filter rules
+type exprCond func(field func(string) string) bool
+
+type exprValue func(field func(string) string) string
+
+// parseExpr compiles a CEL style condition:
+// report.blocked_uri.startsWith("data:") && report.effective_directive == "img-src".
+// Fields are report. followed by the filter rule field name with _ for -,
+// compared as strings with == and != or with the startsWith, endsWith, contains,
+// and matches (RE2) methods, combined with &&, ||, ! and parentheses.
+// Only this subset of CEL is supported, which is all string fields need.
+func parseExpr(src string) (exprCond, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	p := &exprParser{toks: toks}
+	c, err := p.or()
+	if err == nil && p.pos < len(p.toks) {
+		err = fmt.Errorf("unexpected %s", p.toks[p.pos].s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	return c, nil
+}
+
+type exprToken struct {
+	kind byte // i(dent), s(tring), n(umber), p(unctuation)
+	s    string
+}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			toks = append(toks, exprToken{'i', src[i:j]})
+			i = j
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i + 1
+			for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+				j++
+			}
+			toks = append(toks, exprToken{'n', src[i:j]})
+			i = j
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			lit := src[i+1 : j]
+			if c == '\'' {
+				lit = strings.ReplaceAll(strings.ReplaceAll(lit, `\'`, `'`), `"`, `\"`)
+			}
+			s, err := strconv.Unquote(`"` + lit + `"`)
+			if err != nil {
+				return nil, fmt.Errorf("string %s: %w", src[i:j+1], err)
+			}
+			toks = append(toks, exprToken{'s', s})
+			i = j + 1
+		default:
+			op := src[i : i+1]
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case "&&", "||", "==", "!=":
+					op = two
+				}
+			}
+			switch op {
+			case "&&", "||", "==", "!=", "!", "(", ")", ".":
+			default:
+				return nil, fmt.Errorf("unexpected %s", op)
+			}
+			toks = append(toks, exprToken{'p', op})
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+type exprParser struct {
+	toks []exprToken
+	pos  int
+}
+
+// accept consumes the next token if it's the punctuation or identifier s
+func (p *exprParser) accept(s string) bool {
+	if p.pos < len(p.toks) && (p.toks[p.pos].kind == 'p' || p.toks[p.pos].kind == 'i') && p.toks[p.pos].s == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(s string) error {
+	if !p.accept(s) {
+		return p.unexpected("expected " + s)
+	}
+	return nil
+}
+
+func (p *exprParser) unexpected(want string) error {
+	if p.pos >= len(p.toks) {
+		return fmt.Errorf("%s, got end of expression", want)
+	}
+	return fmt.Errorf("%s, got %s", want, p.toks[p.pos].s)
+}
+
+func (p *exprParser) or() (exprCond, error) {
+	l, err := p.and()
+	for err == nil && p.accept("||") {
+		var r exprCond
+		r, err = p.and()
+		l = func(l, r exprCond) exprCond {
+			return func(f func(string) string) bool { return l(f) || r(f) }
+		}(l, r)
+	}
+	return l, err
+}
+
+func (p *exprParser) and() (exprCond, error) {
+	l, err := p.unary()
+	for err == nil && p.accept("&&") {
+		var r exprCond
+		r, err = p.unary()
+		l = func(l, r exprCond) exprCond {
+			return func(f func(string) string) bool { return l(f) && r(f) }
+		}(l, r)
+	}
+	return l, err
+}
+
+func (p *exprParser) unary() (exprCond, error) {
+	if p.accept("!") {
+		c, err := p.unary()
+		return func(f func(string) string) bool { return !c(f) }, err
+	}
+	if p.accept("(") {
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expect(")")
+	}
+	for _, b := range []bool{true, false} {
+		if p.accept(strconv.FormatBool(b)) {
+			b := b
+			return func(func(string) string) bool { return b }, nil
+		}
+	}
+	return p.test()
+}
+
+// test is a comparison or method call on a value
+func (p *exprParser) test() (exprCond, error) {
+	l, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case p.accept("=="), p.accept("!="):
+		eq := p.toks[p.pos-1].s == "=="
+		r, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return func(f func(string) string) bool { return (l(f) == r(f)) == eq }, nil
+	case p.accept("."):
+		if p.pos >= len(p.toks) || p.toks[p.pos].kind != 'i' {
+			return nil, p.unexpected("expected a method")
+		}
+		method := p.toks[p.pos].s
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.toks) || p.toks[p.pos].kind != 's' {
+			return nil, p.unexpected("expected a string argument")
+		}
+		arg := p.toks[p.pos].s
+		p.pos++
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		var test func(v string) bool
+		switch method {
+		case "startsWith":
+			test = func(v string) bool { return strings.HasPrefix(v, arg) }
+		case "endsWith":
+			test = func(v string) bool { return strings.HasSuffix(v, arg) }
+		case "contains":
+			test = func(v string) bool { return strings.Contains(v, arg) }
+		case "matches":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("matches: %w", err)
+			}
+			test = re.MatchString
+		default:
+			return nil, fmt.Errorf("unknown method %s", method)
+		}
+		return func(f func(string) string) bool { return test(l(f)) }, nil
+	}
+	return nil, p.unexpected("expected ==, != or a method call")
+}
+
+// value is a report field or a literal
+func (p *exprParser) value() (exprValue, error) {
+	if p.pos >= len(p.toks) {
+		return nil, p.unexpected("expected a value")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	switch {
+	case t.kind == 's', t.kind == 'n':
+		return func(func(string) string) string { return t.s }, nil
+	case t.kind == 'i' && t.s == "report":
+		if err := p.expect("."); err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.toks) || p.toks[p.pos].kind != 'i' {
+			return nil, p.unexpected("expected a field")
+		}
+		name := strings.ReplaceAll(p.toks[p.pos].s, "_", "-")
+		p.pos++
+		return func(f func(string) string) string { return f(name) }, nil
+	}
+	p.pos--
+	return nil, p.unexpected("expected report.field or a literal")
+}
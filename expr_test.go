@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestParseExpr(t *testing.T) {
+	fields := map[string]string{
+		"blocked-uri":         "data:image/png;base64,AAAA",
+		"effective-directive": "img-src",
+		"document-uri":        "https://example.com/post/1",
+		"status-code":         "200",
+	}
+	field := func(name string) string { return fields[name] }
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`report.blocked_uri.startsWith("data:") && report.effective_directive == "img-src"`, true},
+		{`report.blocked_uri.startsWith("data:") && report.effective_directive == 'script-src'`, false},
+		{`report.effective_directive != "img-src" || report.document_uri.endsWith("/1")`, true},
+		{`!(report.document_uri.contains("/post/"))`, false},
+		{`report.document_uri.matches("^https://[a-z]+\\.com/")`, true},
+		{`report.status_code == 200`, true},
+		{`report.source_file == ""`, true},
+		{`true && !false`, true},
+	}
+	for _, tt := range tests {
+		c, err := parseExpr(tt.expr)
+		if err != nil {
+			t.Errorf("parseExpr(%s): %v", tt.expr, err)
+			continue
+		}
+		if got := c(field); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{
+		``,
+		`report.blocked_uri`,
+		`report.blocked_uri.size() > 3`,
+		`report.blocked_uri.matches("(")`,
+		`report.blocked_uri == "data`,
+		`(report.blocked_uri == "x"`,
+		`blocked_uri == "x"`,
+	} {
+		if _, err := parseExpr(expr); err == nil {
+			t.Errorf("parseExpr(%s): expected an error", expr)
+		}
+	}
+}
+
+func TestFilterExpr(t *testing.T) {
+	var rs filterRules
+	err := rs.Set(`drop if report.blocked_uri.startsWith("data:") && report.effective_directive == "img-src"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r CSPReport
+	r.CspReport.BlockedURI = "data:"
+	r.CspReport.EffectiveDirective = "img-src"
+	if drop, _ := rs.apply(r.field); drop != "filter" {
+		t.Errorf("drop = %q, want filter", drop)
+	}
+	r.CspReport.EffectiveDirective = "font-src"
+	if drop, _ := rs.apply(r.field); drop != "" {
+		t.Errorf("drop = %q, want forwarded", drop)
+	}
+}
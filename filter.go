@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// filterRules is a repeatable flag of rules evaluated in order before forwarding,
+// each rule is an action followed by space separated conditions, all of which have to match:
+// drop source-file=moz-extension://*
+// actions are drop, keep (forward, skipping later rules), tag:name (add a tag and continue),
+// conditions are field=glob (* matches anything) or field~regexp,
+// or if followed by an expression (see parseExpr):
+// drop if report.blocked_uri.startsWith("data:") && report.effective_directive == "img-src"
+type filterRules []filterRule
+
+type filterRule struct {
+	src    string
+	action string
+	tag    string
+	reason string // recorded for dropped reports
+	conds  []filterCond
+	expr   exprCond
+}
+
+type filterCond struct {
+	field string
+	re    *regexp.Regexp
+}
+
+func (rs *filterRules) String() string {
+	if rs == nil {
+		return ""
+	}
+	var ss []string
+	for _, r := range *rs {
+		ss = append(ss, r.src)
+	}
+	return strings.Join(ss, "; ")
+}
+
+func (rs *filterRules) Set(v string) error {
+	fields := strings.Fields(v)
+	if len(fields) < 2 {
+		return fmt.Errorf("filter rule %q: expected action field=glob|field~regexp ...", v)
+	}
+	r := filterRule{src: strings.Join(fields, " "), action: fields[0], reason: "filter"}
+	if strings.HasPrefix(r.action, "tag:") {
+		r.action, r.tag = "tag", strings.TrimPrefix(r.action, "tag:")
+	}
+	switch {
+	case r.action == "drop", r.action == "keep":
+	case r.action == "tag" && r.tag != "":
+	default:
+		return fmt.Errorf("filter rule %q: unknown action %s", v, fields[0])
+	}
+	if fields[1] == "if" {
+		src := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(v), fields[0]))
+		r.src = fields[0] + " " + src
+		var err error
+		r.expr, err = parseExpr(strings.TrimPrefix(src, "if"))
+		if err != nil {
+			return fmt.Errorf("filter rule %q: %w", v, err)
+		}
+		*rs = append(*rs, r)
+		return nil
+	}
+	for _, f := range fields[1:] {
+		i := strings.IndexAny(f, "=~")
+		if i <= 0 {
+			return fmt.Errorf("filter rule %q: condition %q: expected field=glob or field~regexp", v, f)
+		}
+		expr := f[i+1:]
+		if f[i] == '=' {
+			expr = globRegexp(expr)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("filter rule %q: condition %q: %w", v, f, err)
+		}
+		r.conds = append(r.conds, filterCond{field: f[:i], re: re})
+	}
+	*rs = append(*rs, r)
+	return nil
+}
+
+// globRegexp converts a glob where * matches any characters to an anchored regexp
+func globRegexp(g string) string {
+	parts := strings.Split(g, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return "^" + strings.Join(parts, ".*") + "$"
+}
+
+// apply evaluates the rules against the fields returned by field,
+// returning why the report should be dropped, empty to forward, and the tags to attach
+func (rs filterRules) apply(field func(string) string) (drop string, tags []string) {
+	for _, r := range rs {
+		if !r.match(field) {
+			continue
+		}
+		switch r.action {
+		case "drop":
+			return r.reason, tags
+		case "keep":
+			return "", tags
+		case "tag":
+			tags = append(tags, r.tag)
+		}
+	}
+	return "", tags
+}
+
+// noiseRules drop csp violations caused by the browser
+// or things injected into the page rather than the page itself
+var noiseRules = []string{
+	`drop source-file~^(chrome|moz|safari|safari-web|ms-browser)-extension:`,
+	`drop blocked-uri~^(chrome|moz|safari|safari-web|ms-browser)-extension:`,
+	`drop blocked-uri~^about(:blank)?$`,
+	`drop document-uri~^about:`,
+	// in app browsers and injected toolbars
+	`drop blocked-uri~^(webviewprogressproxy|mxaddon-pkg|mxjscall|gsa|jar|ms-appx-web):`,
+	// page translators
+	`drop blocked-uri~^https://translate\.(googleapis|google)\.com(/|$)`,
+	`drop blocked-uri~^data(:|$) source-file~^(https://translate\.|[a-z-]+-extension:)`,
+}
+
+// noiseFilter is noiseRules parsed
+func noiseFilter() filterRules {
+	var rs filterRules
+	for _, r := range noiseRules {
+		if err := rs.Set(r); err != nil {
+			panic(err)
+		}
+	}
+	for i := range rs {
+		rs[i].reason = "noise"
+	}
+	return rs
+}
+
+func (r filterRule) match(field func(string) string) bool {
+	if r.expr != nil && !r.expr(field) {
+		return false
+	}
+	for _, c := range r.conds {
+		if !c.re.MatchString(field(c.field)) {
+			return false
+		}
+	}
+	return true
+}
+
+// field returns the report field by its json name
+func (r CSPReport) field(name string) string {
+	c := r.CspReport
+	switch name {
+	case "original-policy":
+		return c.OriginalPolicy
+	case "violated-directive":
+		return c.ViolatedDirective
+	case "effective-directive":
+		return c.EffectiveDirective
+	case "directive":
+		return r.directive()
+	case "referrer":
+		return c.Referrer
+	case "script-sample":
+		return c.ScriptSample
+	case "status-code":
+		return strconv.FormatInt(c.StatusCode, 10)
+	case "line-number":
+		return strconv.FormatInt(c.LineNumber, 10)
+	case "disposition":
+		return r.disposition()
+	case "blocked-uri":
+		return c.BlockedURI
+	case "document-uri":
+		return c.DocumentURI
+	case "source-file":
+		return c.SourceFile
+	case "class":
+		return r.classify()
+	}
+	return ""
+}
+
+// appendTags attaches the tags from matching filter rules to the forwarded record
+func appendTags(md metadata.MD, tags []string) {
+	if len(tags) > 0 {
+		md.Append("tags", strings.Join(tags, ","))
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+)
+
+// stringList is a comma separated flag value
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = nil
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+func (l stringList) contains(v string) bool {
+	for _, s := range l {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
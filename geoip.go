@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+type geoOpts struct {
+	db    string
+	asn   string
+	watch time.Duration
+}
+
+func (o *geoOpts) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.db, "geoip.db", "", "path to a GeoLite2 City or Country mmdb, disabled if empty")
+	fs.StringVar(&o.asn, "geoip.asn", "", "path to a GeoLite2 ASN mmdb, disabled if empty")
+	fs.DurationVar(&o.watch, "geoip.watch", time.Hour, "interval to check the mmdb files for updates and reload them, 0 to disable")
+}
+
+// files are the configured databases
+func (o geoOpts) files() []string {
+	var fns []string
+	for _, fn := range []string{o.db, o.asn} {
+		if fn != "" {
+			fns = append(fns, fn)
+		}
+	}
+	return fns
+}
+
+func (o geoOpts) geoIP() (*geoIP, error) {
+	var g geoIP
+	var err error
+	if o.db != "" {
+		g.db, err = openMMDB(o.db)
+		if err != nil {
+			return nil, fmt.Errorf("geoip.db: %w", err)
+		}
+	}
+	if o.asn != "" {
+		g.asn, err = openMMDB(o.asn)
+		if err != nil {
+			return nil, fmt.Errorf("geoip.asn: %w", err)
+		}
+	}
+	return &g, nil
+}
+
+type geoIP struct {
+	db  *mmdb
+	asn *mmdb
+}
+
+type geoInfo struct {
+	Country string
+	Region  string
+	ASN     string
+	ASOrg   string
+}
+
+// countryLabel bounds a country code for use as a metric label
+func countryLabel(c string) string {
+	if c == "" {
+		return "unknown"
+	}
+	if len(c) != 2 || c[0] < 'A' || c[0] > 'Z' || c[1] < 'A' || c[1] > 'Z' {
+		return "other"
+	}
+	return c
+}
+
+func (g *geoIP) Lookup(addr string) (geoInfo, error) {
+	var gi geoInfo
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return gi, nil
+	}
+	if g.db != nil {
+		v, err := g.db.Lookup(ip)
+		if err != nil {
+			return gi, fmt.Errorf("lookup geoip: %w", err)
+		}
+		gi.Country, _ = mmdbPath(v, "country", "iso_code").(string)
+		gi.Region, _ = mmdbPath(v, "subdivisions", 0, "iso_code").(string)
+	}
+	if g.asn != nil {
+		v, err := g.asn.Lookup(ip)
+		if err != nil {
+			return gi, fmt.Errorf("lookup asn: %w", err)
+		}
+		if n, ok := mmdbPath(v, "autonomous_system_number").(uint64); ok {
+			gi.ASN = strconv.FormatUint(n, 10)
+		}
+		gi.ASOrg, _ = mmdbPath(v, "autonomous_system_organization").(string)
+	}
+	return gi, nil
+}
+
+// metadata are key value pairs to forward
+func (gi geoInfo) metadata() []string {
+	var kv []string
+	for _, f := range []struct{ k, v string }{
+		{"geo-country", gi.Country},
+		{"geo-region", gi.Region},
+		{"geo-asn", gi.ASN},
+		{"geo-as-org", gi.ASOrg},
+	} {
+		if f.v != "" {
+			kv = append(kv, f.k, f.v)
+		}
+	}
+	return kv
+}
+
+// mmdbPath walks decoded maps (string keys) and arrays (int keys)
+func mmdbPath(v interface{}, path ...interface{}) interface{} {
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			m, _ := v.(map[string]interface{})
+			v = m[p]
+		case int:
+			a, _ := v.([]interface{})
+			if p >= len(a) {
+				return nil
+			}
+			v = a[p]
+		}
+	}
+	return v
+}
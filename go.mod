@@ -3,11 +3,17 @@ module go.seankhliao.com/statslogger
 go 1.14
 
 require (
+	github.com/felixge/httpsnoop v1.0.1
 	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
 	github.com/rs/zerolog v1.18.0
 	go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.12.0
+	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.12.0
 	go.opentelemetry.io/otel v0.12.0
+	go.opentelemetry.io/otel/exporters/trace/jaeger v0.12.0
+	go.opentelemetry.io/otel/sdk v0.12.0
 	go.seankhliao.com/apis v0.0.0-20200925201609-7c5465abda54
 	go.seankhliao.com/usvc v0.8.9
 	google.golang.org/grpc v1.32.0
+	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// grafana serves the simple json datasource api, also usable by the infinity plugin,
+// over the top.windows slots:
+// violations, beacons, violations.<directive>, beacons.<page>, and duration.p50|p90|p99
+// as time series, and top.pages, top.sources, top.directives as tables
+func (s *Server) grafana(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/grafana") {
+	case "", "/":
+		// connection test
+		w.WriteHeader(http.StatusOK)
+	case "/search":
+		s.grafanaSearch(w, r)
+	case "/query":
+		s.grafanaQuery(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var grafanaTargets = []string{
+	"violations", "beacons",
+	"duration.p50", "duration.p90", "duration.p99",
+	"top.pages", "top.sources", "top.directives",
+}
+
+func (s *Server) grafanaSearch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	targets := append([]string{}, grafanaTargets...)
+	if window := s.grafanaWindow(time.Time{}); window > 0 {
+		now := time.Now()
+		ds, _ := s.top.Top("directive", window, 50, now)
+		for _, e := range ds {
+			targets = append(targets, "violations."+e.Key)
+		}
+		ps, _ := s.top.Top("page", window, 50, now)
+		for _, e := range ps {
+			targets = append(targets, "beacons."+e.Key)
+		}
+	}
+	out := []string{}
+	for _, t := range targets {
+		if strings.Contains(t, req.Target) {
+			out = append(out, t)
+		}
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// grafanaWindow is the shortest of top.windows reaching back to from,
+// or the longest if none do
+func (s *Server) grafanaWindow(from time.Time) time.Duration {
+	now := time.Now()
+	var best, longest time.Duration
+	for _, tw := range s.top.windows {
+		if tw.window > longest {
+			longest = tw.window
+		}
+		if !now.Add(-tw.window).After(from) && (best == 0 || tw.window < best) {
+			best = tw.window
+		}
+	}
+	if best == 0 {
+		return longest
+	}
+	return best
+}
+
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+func (s *Server) grafanaQuery(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Range struct {
+			From time.Time `json:"from"`
+			To   time.Time `json:"to"`
+		} `json:"range"`
+		Targets []struct {
+			Target string `json:"target"`
+		} `json:"targets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if req.Range.To.IsZero() {
+		req.Range.To = now
+	}
+	window := s.grafanaWindow(req.Range.From)
+
+	out := []interface{}{}
+	for _, t := range req.Targets {
+		if t.Target == "" {
+			continue
+		}
+		if kind := strings.TrimPrefix(t.Target, "top."); kind != t.Target {
+			kind = map[string]string{"pages": "page", "sources": "violation", "directives": "directive"}[kind]
+			es, _ := s.top.Top(kind, window, 100, now)
+			tbl := grafanaTable{
+				Type:    "table",
+				Columns: []grafanaColumn{{"key", "string"}, {"count", "number"}},
+				Rows:    [][]interface{}{},
+			}
+			for _, e := range es {
+				tbl.Rows = append(tbl.Rows, []interface{}{e.Key, e.Count})
+			}
+			out = append(out, tbl)
+			continue
+		}
+
+		value := grafanaValue(t.Target)
+		if value == nil {
+			continue
+		}
+		series := grafanaSeries{Target: t.Target, Datapoints: [][2]float64{}}
+		s.top.Each(window, now, func(start time.Time, slot *topSlot) {
+			if start.Before(req.Range.From.Truncate(window/topSlots)) || start.After(req.Range.To) {
+				return
+			}
+			if slot == nil {
+				slot = &topSlot{}
+			}
+			v, ok := value(slot)
+			if !ok {
+				return
+			}
+			series.Datapoints = append(series.Datapoints, [2]float64{v, float64(start.UnixNano() / int64(time.Millisecond))})
+		})
+		out = append(out, series)
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// grafanaValue extracts the value of a time series target from a slot,
+// false if the slot has no value for it
+func grafanaValue(target string) func(*topSlot) (float64, bool) {
+	sum := func(kind, key string) func(*topSlot) (float64, bool) {
+		return func(s *topSlot) (float64, bool) {
+			if key != "" {
+				return float64(s.Kinds[kind][key]), true
+			}
+			var n uint64
+			for _, c := range s.Kinds[kind] {
+				n += c
+			}
+			return float64(n), true
+		}
+	}
+	switch {
+	case target == "violations":
+		return sum("directive", "")
+	case target == "beacons":
+		return sum("page", "")
+	case strings.HasPrefix(target, "violations."):
+		return sum("directive", strings.TrimPrefix(target, "violations."))
+	case strings.HasPrefix(target, "beacons."):
+		return sum("page", strings.TrimPrefix(target, "beacons."))
+	case strings.HasPrefix(target, "duration.p"):
+		var p int
+		switch target {
+		case "duration.p50":
+			p = 50
+		case "duration.p90":
+			p = 90
+		case "duration.p99":
+			p = 99
+		default:
+			return nil
+		}
+		return func(s *topSlot) (float64, bool) {
+			if len(s.Durations) == 0 {
+				return 0, false
+			}
+			ds := append([]int64{}, s.Durations...)
+			sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+			return float64(percentile(ds, p)), true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.seankhliao.com/apis/saver/v1"
+)
+
+// a small read only graphql endpoint over the buffered records and aggregates,
+// queries only: no mutations, fragments, directives or introspection
+
+type gqlArg struct {
+	name, typ string
+}
+
+type gqlFieldDef struct {
+	name string
+	typ  string
+	list bool
+	args []gqlArg
+}
+
+type gqlType struct {
+	name   string
+	fields []gqlFieldDef
+}
+
+func (t gqlType) field(name string) (gqlFieldDef, bool) {
+	for _, f := range t.fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return gqlFieldDef{}, false
+}
+
+var gqlScalars = map[string]bool{"String": true, "Int": true}
+
+var recordArgs = []gqlArg{{"page", "String"}, {"q", "String"}, {"since", "String"}, {"until", "String"}, {"limit", "Int"}}
+
+var gqlSchema = []gqlType{
+	{"Query", []gqlFieldDef{
+		{"violations", "Violation", true, append([]gqlArg{{"fingerprint", "String"}}, recordArgs...)},
+		{"beacons", "Beacon", true, recordArgs},
+		{"stats", "Stats", false, []gqlArg{{"window", "String"}, {"n", "Int"}}},
+		{"uniques", "Unique", true, []gqlArg{{"n", "Int"}}},
+		{"online", "Online", true, nil},
+	}},
+	{"Violation", []gqlFieldDef{
+		{name: "time", typ: "String"},
+		{name: "fingerprint", typ: "String"},
+		{name: "class", typ: "String"},
+		{name: "disposition", typ: "String"},
+		{name: "blocked_uri", typ: "String"},
+		{name: "source_file", typ: "String"},
+		{name: "document_uri", typ: "String"},
+		{name: "violated_directive", typ: "String"},
+		{name: "effective_directive", typ: "String"},
+		{name: "line_number", typ: "Int"},
+		{name: "status_code", typ: "Int"},
+		{name: "http_remote", typ: "Remote"},
+		{name: "metadata", typ: "Metadata", list: true},
+	}},
+	{"Beacon", []gqlFieldDef{
+		{name: "time", typ: "String"},
+		{name: "duration_ms", typ: "Int"},
+		{name: "src_page", typ: "String"},
+		{name: "dst_page", typ: "String"},
+		{name: "http_remote", typ: "Remote"},
+		{name: "metadata", typ: "Metadata", list: true},
+	}},
+	{"Remote", []gqlFieldDef{
+		{name: "timestamp", typ: "String"},
+		{name: "remote", typ: "String"},
+		{name: "user_agent", typ: "String"},
+		{name: "referrer", typ: "String"},
+	}},
+	{"Metadata", []gqlFieldDef{
+		{name: "key", typ: "String"},
+		{name: "value", typ: "String"},
+	}},
+	{"Stats", []gqlFieldDef{
+		{name: "window", typ: "String"},
+		{name: "directives", typ: "Count", list: true},
+		{name: "sources", typ: "Count", list: true},
+		{name: "pages", typ: "Count", list: true},
+		{name: "durations", typ: "Durations"},
+	}},
+	{"Count", []gqlFieldDef{
+		{name: "key", typ: "String"},
+		{name: "count", typ: "Int"},
+	}},
+	{"Durations", []gqlFieldDef{
+		{name: "beacons", typ: "Int"},
+		{name: "sampled", typ: "Int"},
+		{name: "p50_ms", typ: "Int"},
+		{name: "p90_ms", typ: "Int"},
+		{name: "p99_ms", typ: "Int"},
+	}},
+	{"Unique", []gqlFieldDef{
+		{name: "site", typ: "String"},
+		{name: "page", typ: "String"},
+		{name: "visitors", typ: "Int"},
+	}},
+	{"Online", []gqlFieldDef{
+		{name: "site", typ: "String"},
+		{name: "visitors", typ: "Int"},
+	}},
+}
+
+func gqlLookup(name string) (gqlType, bool) {
+	for _, t := range gqlSchema {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return gqlType{}, false
+}
+
+// gqlSDL is the schema in the graphql schema language
+func gqlSDL() string {
+	var b strings.Builder
+	for i, t := range gqlSchema {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "type %s {\n", t.name)
+		for _, f := range t.fields {
+			b.WriteString("  " + f.name)
+			if len(f.args) > 0 {
+				var as []string
+				for _, a := range f.args {
+					as = append(as, a.name+": "+a.typ)
+				}
+				b.WriteString("(" + strings.Join(as, ", ") + ")")
+			}
+			typ := f.typ
+			if f.list {
+				typ = "[" + typ + "]"
+			}
+			b.WriteString(": " + typ + "\n")
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// gqlSelection is a field in a selection set
+type gqlSelection struct {
+	alias string
+	name  string
+	args  map[string]interface{}
+	sel   []gqlSelection
+}
+
+// gqlMaxDepth bounds selection set nesting,
+// well past what the schema needs but short of exhausting the stack
+const gqlMaxDepth = 16
+
+type gqlParser struct {
+	src   string
+	pos   int
+	tok   string // punctuator, name, number, or quoted string
+	vars  map[string]interface{}
+	depth int
+}
+
+func parseGraphQL(query string, vars map[string]interface{}) ([]gqlSelection, error) {
+	p := &gqlParser{src: query, vars: vars}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	switch p.tok {
+	case "{":
+	case "query":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if isGQLName(p.tok) {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if p.tok == "(" {
+			if err := p.skipVariableDefs(); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("only queries are supported, got %q", p.tok)
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("unexpected %q after query, only one operation is supported", p.tok)
+	}
+	return sel, nil
+}
+
+func isGQLName(tok string) bool {
+	if tok == "" {
+		return false
+	}
+	for i, r := range tok {
+		if r != '_' && !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && (i == 0 || !(r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// next reads the next token into p.tok, "" at the end
+func (p *gqlParser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return nil
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case strings.IndexByte("{}():$!=[]", c) >= 0:
+		p.pos++
+	case c == '"':
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			return fmt.Errorf("unterminated string at %d", start)
+		}
+		p.pos++
+	case c == '-' || (c >= '0' && c <= '9'):
+		p.pos++
+		for p.pos < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+	case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		for p.pos < len(p.src) && isGQLName(p.src[start:p.pos+1]) {
+			p.pos++
+		}
+	default:
+		return fmt.Errorf("unsupported syntax %q at %d", c, start)
+	}
+	p.tok = p.src[start:p.pos]
+	return nil
+}
+
+func (p *gqlParser) expect(tok string) error {
+	if p.tok != tok {
+		return fmt.Errorf("expected %q, got %q", tok, p.tok)
+	}
+	return p.next()
+}
+
+// skipVariableDefs skips ($name: Type = default, ...), values come from the request
+func (p *gqlParser) skipVariableDefs() error {
+	for depth := 0; ; {
+		switch p.tok {
+		case "":
+			return fmt.Errorf("unterminated variable definitions")
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+		if err := p.next(); err != nil {
+			return err
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if p.depth++; p.depth > gqlMaxDepth {
+		return nil, fmt.Errorf("selections nested deeper than %d", gqlMaxDepth)
+	}
+	defer func() { p.depth-- }()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []gqlSelection
+	for p.tok != "}" {
+		if !isGQLName(p.tok) {
+			return nil, fmt.Errorf("expected field name, got %q", p.tok)
+		}
+		sel := gqlSelection{name: p.tok}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok == ":" {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if !isGQLName(p.tok) {
+				return nil, fmt.Errorf("expected field name after alias %s, got %q", sel.name, p.tok)
+			}
+			sel.alias, sel.name = sel.name, p.tok
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if sel.alias == "" {
+			sel.alias = sel.name
+		}
+		if p.tok == "(" {
+			var err error
+			sel.args, err = p.arguments()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if p.tok == "{" {
+			var err error
+			sel.sel, err = p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+		}
+		sels = append(sels, sel)
+	}
+	return sels, p.next()
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for p.tok != ")" {
+		name := p.tok
+		if !isGQLName(name) {
+			return nil, fmt.Errorf("expected argument name, got %q", name)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %w", name, err)
+		}
+		args[name] = v
+	}
+	return args, p.next()
+}
+
+// value reads a scalar or variable, lists and objects aren't needed by the schema
+func (p *gqlParser) value() (interface{}, error) {
+	tok := p.tok
+	var v interface{}
+	switch {
+	case tok == "$":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		v = p.vars[p.tok]
+	case strings.HasPrefix(tok, `"`):
+		var s string
+		if err := json.Unmarshal([]byte(tok), &s); err != nil {
+			return nil, fmt.Errorf("invalid string %s", tok)
+		}
+		v = s
+	case tok == "true" || tok == "false":
+		v = tok == "true"
+	case tok == "null":
+	case tok != "" && (tok[0] == '-' || (tok[0] >= '0' && tok[0] <= '9')):
+		f, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", tok)
+		}
+		v = f
+	default:
+		return nil, fmt.Errorf("unsupported value %q", tok)
+	}
+	return v, p.next()
+}
+
+// gqlObject keeps the fields in selection order
+type gqlObject []gqlKV
+
+type gqlKV struct {
+	k string
+	v interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, kv := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(kv.k)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(kv.v)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlValue is v round tripped through json, for selecting fields from
+func gqlValue(v interface{}) interface{} {
+	b, _ := json.Marshal(v)
+	var out interface{}
+	json.Unmarshal(b, &out)
+	return out
+}
+
+// project selects sel from v of type typ
+func project(sel []gqlSelection, typ string, list bool, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if list {
+		vs, _ := v.([]interface{})
+		out := make([]interface{}, 0, len(vs))
+		for _, e := range vs {
+			pe, err := project(sel, typ, false, e)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, pe)
+		}
+		return out, nil
+	}
+	if gqlScalars[typ] {
+		return v, nil
+	}
+	t, _ := gqlLookup(typ)
+	m, _ := v.(map[string]interface{})
+	var out gqlObject
+	for _, s := range sel {
+		if s.name == "__typename" {
+			out = append(out, gqlKV{s.alias, typ})
+			continue
+		}
+		f, _ := t.field(s.name)
+		pv, err := project(s.sel, f.typ, f.list, m[s.name])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, gqlKV{s.alias, pv})
+	}
+	return out, nil
+}
+
+// validateSelection checks sel against typ before anything is resolved
+func validateSelection(sel []gqlSelection, t gqlType) error {
+	for _, s := range sel {
+		if s.name == "__typename" {
+			continue
+		}
+		f, ok := t.field(s.name)
+		if !ok {
+			return fmt.Errorf("cannot query field %s on type %s", s.name, t.name)
+		}
+		for a, v := range s.args {
+			var typ string
+			for _, fa := range f.args {
+				if fa.name == a {
+					typ = fa.typ
+				}
+			}
+			if typ == "" {
+				return fmt.Errorf("unknown argument %s on field %s", a, s.name)
+			}
+			ok := v == nil
+			switch v := v.(type) {
+			case string:
+				ok = typ == "String"
+			case float64:
+				ok = typ == "Int" && v == float64(int(v))
+			}
+			if !ok {
+				return fmt.Errorf("argument %s on field %s: expected %s", a, s.name, typ)
+			}
+		}
+		if gqlScalars[f.typ] {
+			if len(s.sel) > 0 {
+				return fmt.Errorf("field %s of type %s has no subfields", s.name, f.typ)
+			}
+			continue
+		}
+		if len(s.sel) == 0 {
+			return fmt.Errorf("field %s of type %s needs a selection of subfields", s.name, f.typ)
+		}
+		ft, _ := gqlLookup(f.typ)
+		if err := validateSelection(s.sel, ft); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func gqlString(args map[string]interface{}, name string) string {
+	s, _ := args[name].(string)
+	return s
+}
+
+func gqlInt(args map[string]interface{}, name string, def int) int {
+	if f, ok := args[name].(float64); ok {
+		return int(f)
+	}
+	return def
+}
+
+// gqlRecords resolves violations and beacons from the buffered records
+func (s *Server) gqlRecords(handler string, args map[string]interface{}, now time.Time) (interface{}, error) {
+	q := recordQuery{
+		handler:     handler,
+		fingerprint: gqlString(args, "fingerprint"),
+		page:        gqlString(args, "page"),
+		text:        strings.ToLower(gqlString(args, "q")),
+		limit:       gqlInt(args, "limit", 0),
+	}
+	for _, t := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &q.since}, {"until", &q.until}} {
+		var err error
+		*t.dst, err = parseSince(t.name, gqlString(args, t.name), now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	out := []interface{}{}
+	for _, rec := range s.recent.Query(q) {
+		m, _ := gqlValue(rec.Report).(map[string]interface{})
+		if m == nil {
+			continue
+		}
+		m["time"] = rec.Time.UTC().Format(time.RFC3339Nano)
+		if _, ok := rec.Report.(*saver.CSPRequest); ok {
+			m["fingerprint"] = rec.Metadata["csp-fingerprint"]
+			m["class"] = rec.Metadata["csp-class"]
+		}
+		var md []interface{}
+		for k, v := range rec.Metadata {
+			md = append(md, map[string]interface{}{"key": k, "value": v})
+		}
+		m["metadata"] = md
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func (s *Server) gqlResolve(sel gqlSelection, now time.Time) (interface{}, error) {
+	switch sel.name {
+	case "violations":
+		return s.gqlRecords("csp", sel.args, now)
+	case "beacons":
+		return s.gqlRecords("beacon", sel.args, now)
+	case "stats":
+		window := time.Hour
+		if len(s.top.windows) > 0 {
+			window = s.top.windows[0].window
+		}
+		if v := gqlString(sel.args, "window"); v != "" {
+			var err error
+			window, err = time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("window: %w", err)
+			}
+		}
+		st, ok := s.windowStats(window, gqlInt(sel.args, "n", 10), now)
+		if !ok {
+			return nil, fmt.Errorf("window %v not in top.windows", window)
+		}
+		return gqlValue(st), nil
+	case "uniques":
+		_, cs := s.uniques.Estimates()
+		if n := gqlInt(sel.args, "n", 10); len(cs) > n {
+			cs = cs[:n]
+		}
+		return gqlValue(cs), nil
+	case "online":
+		out := []interface{}{}
+		for site, n := range s.online.Count(now) {
+			out = append(out, map[string]interface{}{"site": site, "visitors": n})
+		}
+		return gqlValue(out), nil
+	}
+	return nil, nil
+}
+
+type gqlError struct {
+	Message string   `json:"message"`
+	Path    []string `json:"path,omitempty"`
+}
+
+// graphql serves POST {"query": "...", "variables": {...}} or GET ?query=,
+// and the schema on GET without a query
+func (s *Server) graphql(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query     string                 `json:"query"`
+		Variables map[string]interface{} `json:"variables"`
+	}
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.FormValue("query")
+		if req.Query == "" {
+			w.Header().Set("content-type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, gqlSDL())
+			return
+		}
+		if v := r.FormValue("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "invalid variables", http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	sel, err := parseGraphQL(req.Query, req.Variables)
+	if err == nil {
+		query, _ := gqlLookup("Query")
+		err = validateSelection(sel, query)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"errors": []gqlError{{Message: err.Error()}},
+		})
+		return
+	}
+
+	now := time.Now()
+	query, _ := gqlLookup("Query")
+	var data gqlObject
+	var errs []gqlError
+	for _, f := range sel {
+		if f.name == "__typename" {
+			data = append(data, gqlKV{f.alias, "Query"})
+			continue
+		}
+		def, _ := query.field(f.name)
+		v, err := s.gqlResolve(f, now)
+		if err == nil {
+			v, err = project(f.sel, def.typ, def.list, v)
+		}
+		if err != nil {
+			errs = append(errs, gqlError{err.Error(), []string{f.alias}})
+			v = nil
+		}
+		data = append(data, gqlKV{f.alias, v})
+	}
+	json.NewEncoder(w).Encode(struct {
+		Data   gqlObject  `json:"data"`
+		Errors []gqlError `json:"errors,omitempty"`
+	}{data, errs})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		vars  map[string]interface{}
+		want  []gqlSelection
+	}{
+		{
+			"shorthand", `{ stats }`, nil,
+			[]gqlSelection{{alias: "stats", name: "stats"}},
+		}, {
+			"named with variables", `query Q($h: String = "csp") { records(handler: $h) { id } }`,
+			map[string]interface{}{"h": "beacon"},
+			[]gqlSelection{{alias: "records", name: "records", args: map[string]interface{}{"handler": "beacon"}, sel: []gqlSelection{
+				{alias: "id", name: "id"},
+			}}},
+		}, {
+			"nesting", `{ a { b { c d } e } }`, nil,
+			[]gqlSelection{{alias: "a", name: "a", sel: []gqlSelection{
+				{alias: "b", name: "b", sel: []gqlSelection{{alias: "c", name: "c"}, {alias: "d", name: "d"}}},
+				{alias: "e", name: "e"},
+			}}},
+		}, {
+			"arguments", `{ records(handler: "csp", limit: 5, since: -1.5e2, all: true, x: null) }`, nil,
+			[]gqlSelection{{alias: "records", name: "records", args: map[string]interface{}{
+				"handler": "csp", "limit": 5.0, "since": -150.0, "all": true, "x": nil,
+			}}},
+		}, {
+			"aliases", `{ csp: records(handler: "csp") { n: id } beacon: records }`, nil,
+			[]gqlSelection{
+				{alias: "csp", name: "records", args: map[string]interface{}{"handler": "csp"}, sel: []gqlSelection{{alias: "n", name: "id"}}},
+				{alias: "beacon", name: "records"},
+			},
+		}, {
+			"comments and commas", "{\n  # all of it\n  a, b # trailing\n}", nil,
+			[]gqlSelection{{alias: "a", name: "a"}, {alias: "b", name: "b"}},
+		}, {
+			"escaped string", `{ a(s: "say \"hi\"\n") }`, nil,
+			[]gqlSelection{{alias: "a", name: "a", args: map[string]interface{}{"s": "say \"hi\"\n"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGraphQL(tt.query, tt.vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseGraphQL = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGraphQLInvalid(t *testing.T) {
+	for _, query := range []string{
+		``,
+		`mutation { a }`,
+		`subscription { a }`,
+		`{ a`,
+		`{ a } { b }`,
+		`{ a: }`,
+		`{ 1a }`,
+		`{ a(b) }`,
+		`{ a(b: ) }`,
+		`{ a(b: [1]) }`,
+		`{ a(b: "x) }`,
+		`{ a(b: 1.2.3) }`,
+		`{ a @skip }`,
+		`{ ...f }`,
+		`query ($a: Int { a }`,
+		strings.Repeat("{ a ", gqlMaxDepth+1) + strings.Repeat("}", gqlMaxDepth+1),
+		strings.Repeat("{ a ", 1<<20),
+	} {
+		name := query
+		if len(name) > 40 {
+			name = name[:40]
+		}
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseGraphQL(query, nil); err == nil {
+				t.Errorf("parseGraphQL = nil, want error")
+			}
+		})
+	}
+}
+
+func TestParseGraphQLMaxDepth(t *testing.T) {
+	query := strings.Repeat("{ a ", gqlMaxDepth) + strings.Repeat("}", gqlMaxDepth)
+	sel, err := parseGraphQL(query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	depth := 0
+	for ; sel != nil; sel = sel[0].sel {
+		depth++
+	}
+	if depth != gqlMaxDepth {
+		t.Errorf("depth = %d, want %d", depth, gqlMaxDepth)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+// readyz reports unready while the saver connection is failing,
+// so traffic goes to instances that can forward reports.
+// Dry runs don't connect and are always ready.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	if s.dryRun {
+		w.Write([]byte("ok\n"))
+		return
+	} else if s.cc == nil {
+		http.Error(w, "saver: not connected", http.StatusServiceUnavailable)
+		return
+	}
+	state := s.cc.GetState()
+	switch state {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		http.Error(w, "saver: "+state.String(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+const (
+	healthy   = "healthy"
+	degraded  = "degraded"
+	unhealthy = "unhealthy"
+)
+
+type dependencyHealth struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]dependencyHealth `json:"dependencies"`
+}
+
+// health checks the saver, which reports can't be forwarded without,
+// and the shared ban list, which fails open
+func (s *Server) health(ctx context.Context) healthReport {
+	hr := healthReport{
+		Status:       healthy,
+		Dependencies: make(map[string]dependencyHealth),
+	}
+	worse := func(status string) {
+		if status == unhealthy || hr.Status == healthy {
+			hr.Status = status
+		}
+	}
+
+	if s.dryRun {
+		hr.Dependencies["saver"] = dependencyHealth{healthy, "dry run"}
+	} else if s.cc == nil {
+		hr.Dependencies["saver"] = dependencyHealth{unhealthy, "not connected"}
+		worse(unhealthy)
+	} else {
+		state := s.cc.GetState()
+		dh := dependencyHealth{healthy, state.String()}
+		switch state {
+		case connectivity.Connecting:
+			dh.Status = degraded
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			dh.Status = unhealthy
+		}
+		hr.Dependencies["saver"] = dh
+		worse(dh.Status)
+	}
+
+	if p, ok := s.bans.(interface{ Ping(context.Context) error }); ok {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		dh := dependencyHealth{Status: healthy}
+		if err := p.Ping(ctx); err != nil {
+			dh = dependencyHealth{degraded, err.Error()}
+		}
+		hr.Dependencies["ban list"] = dh
+		worse(dh.Status)
+	}
+	return hr
+}
+
+// healthz serves the health of each dependency and an overall verdict,
+// failing only if unhealthy
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	hr := s.health(r.Context())
+	w.Header().Set("content-type", "application/json")
+	if hr.Status == unhealthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(hr)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyzWithoutConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+		want   int
+	}{
+		{"dry run", true, http.StatusOK},
+		{"not connected", false, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{dryRun: tt.dryRun}
+			w := httptest.NewRecorder()
+			s.readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+			if w.Code != tt.want {
+				t.Errorf("readyz = %d, want %d", w.Code, tt.want)
+			}
+			hr := s.health(httptest.NewRequest("GET", "/healthz", nil).Context())
+			if got := hr.Dependencies["saver"].Status; (got == healthy) != tt.dryRun {
+				t.Errorf("saver health = %s", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of index bits,
+// 2^12 registers for about 1.6% standard error
+const hllPrecision = 12
+
+// hll is a HyperLogLog sketch estimating the number of distinct strings added
+type hll [1 << hllPrecision]uint8
+
+func (h *hll) Add(v string) {
+	f := fnv.New64a()
+	f.Write([]byte(v))
+	x := mix64(f.Sum64())
+	i := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h[i] {
+		h[i] = rank
+	}
+}
+
+// Estimate is the approximate number of distinct values added
+func (h *hll) Estimate() uint64 {
+	m := float64(len(h))
+	var sum float64
+	var zeros int
+	for _, r := range h {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for small cardinalities
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+// mix64 is the splitmix64 finalizer, spreading fnv's output over all bits
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHLLEstimate(t *testing.T) {
+	// three standard errors, 1.04/sqrt(m)
+	bound := 3 * 1.04 / math.Sqrt(1<<hllPrecision)
+	for _, n := range []int{0, 1, 10, 100, 1000, 5000, 10000, 100000, 1000000} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			var h hll
+			for i := 0; i < n; i++ {
+				h.Add("visitor-" + strconv.Itoa(i))
+			}
+			got := h.Estimate()
+			if n == 0 {
+				if got != 0 {
+					t.Errorf("Estimate = %d, want 0", got)
+				}
+				return
+			}
+			if err := math.Abs(float64(got)-float64(n)) / float64(n); err > bound {
+				t.Errorf("Estimate = %d, want %d within %.1f%%, off by %.1f%%", got, n, bound*100, err*100)
+			}
+
+			// repeats don't count
+			for i := 0; i < n; i++ {
+				h.Add("visitor-" + strconv.Itoa(i))
+			}
+			if again := h.Estimate(); again != got {
+				t.Errorf("Estimate after repeats = %d, want %d", again, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"go.seankhliao.com/apis/saver/v1"
+	"go.seankhliao.com/usvc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type ingestOpts struct {
+	addr  string
+	web   bool
+	token string
+}
+
+func (o *ingestOpts) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.addr, "grpc.addr", "", "host:port to serve the saver.v1.Saver CSP and Beacon rpcs on for ingestion, disabled if empty")
+	fs.BoolVar(&o.web, "grpc.web", false, "serve the same rpcs as grpc-web on the service port at /saver.v1.Saver/")
+	fs.Var(secretString(&o.token), "grpc.token", "bearer token allowing callers to submit http_remote on behalf of clients, also allowed with a verified client certificate")
+}
+
+// ingest accepts the saver's own request types over grpc,
+// replaying them through the http handlers
+// so they get the same filtering, privacy, and enrichment as browser reports
+type ingest struct {
+	csp    http.HandlerFunc
+	beacon http.HandlerFunc
+	cspURL string
+	bcnURL string
+	token  string
+}
+
+func (s *Server) newIngest() *ingest {
+	in := &ingest{
+		cspURL: s.routeOpts.path(s.routeOpts.csp),
+		bcnURL: s.routeOpts.path(s.routeOpts.beacon),
+		token:  s.ingestOpts.token,
+	}
+	if s.routeOpts.enabled("csp") {
+		in.csp = s.accessLog("/csp", s.csp)
+	}
+	if s.routeOpts.enabled("beacon") {
+		in.beacon = s.accessLog("/beacon", s.beacon)
+	}
+	return in
+}
+
+// setupIngest starts the grpc and grpc-web endpoints if enabled
+func (s *Server) setupIngest(ctx context.Context, u *usvc.USVC) error {
+	if s.ingestOpts.addr == "" && !s.ingestOpts.web {
+		return nil
+	}
+	in := s.newIngest()
+	if s.ingestOpts.web {
+		u.ServiceMux.Handle("/saver.v1.Saver/", in)
+		allowPreflight(u.ServiceServer, "content-type, x-grpc-web, x-user-agent, x-request-id", "/saver.v1.Saver/")
+	}
+	if s.ingestOpts.addr == "" {
+		return nil
+	}
+	var creds credentials.TransportCredentials
+	if tlsConf := u.ServiceServer.TLSConfig; tlsConf != nil && len(tlsConf.Certificates) > 0 {
+		creds = credentials.NewTLS(tlsConf)
+	}
+	return in.serve(ctx, s.ingestOpts.addr, creds, s.log)
+}
+
+// serve listens on addr until ctx is done,
+// separate from usvc.GRPCServer which would replace the http service endpoint
+func (in *ingest) serve(ctx context.Context, addr string, creds credentials.TransportCredentials, log zerolog.Logger) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen grpc.addr: %w", err)
+	}
+	var opts []grpc.ServerOption
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	srv := grpc.NewServer(opts...)
+	saver.RegisterSaverService(srv, &saver.SaverService{
+		CSP:    in.CSP,
+		Beacon: in.Beacon,
+	})
+	go func() {
+		log.Info().Str("addr", addr).Msg("starting grpc ingest endpoint")
+		err := srv.Serve(l)
+		if err != nil {
+			log.Error().Err(err).Msg("serve grpc ingest")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	return nil
+}
+
+func (in *ingest) CSP(ctx context.Context, req *saver.CSPRequest) (*saver.CSPResponse, error) {
+	if in.csp == nil {
+		return nil, status.Error(codes.Unimplemented, "csp handler disabled by http.handlers")
+	}
+	var rep CSPReport
+	c := &rep.CspReport
+	c.Disposition = req.Disposition
+	c.BlockedURI = req.BlockedUri
+	c.SourceFile = req.SourceFile
+	c.DocumentURI = req.DocumentUri
+	c.ViolatedDirective = req.ViolatedDirective
+	c.EffectiveDirective = req.EffectiveDirective
+	c.StatusCode = req.StatusCode
+	c.LineNumber = req.LineNumber
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	err = in.replay(ctx, in.csp, in.cspURL, "application/csp-report", bytes.NewReader(b), req.HttpRemote)
+	if err != nil {
+		return nil, err
+	}
+	return &saver.CSPResponse{}, nil
+}
+
+func (in *ingest) Beacon(ctx context.Context, req *saver.BeaconRequest) (*saver.BeaconResponse, error) {
+	if in.beacon == nil {
+		return nil, status.Error(codes.Unimplemented, "beacon handler disabled by http.handlers")
+	}
+	form := url.Values{
+		"src": {req.SrcPage},
+		"dst": {req.DstPage},
+		"dur": {strconv.FormatInt(req.DurationMs, 10)},
+	}
+	if req.HttpRemote != nil && req.HttpRemote.Referrer != "" && in.trusted(ctx) {
+		form.Set("ref", req.HttpRemote.Referrer)
+	}
+	err := in.replay(ctx, in.beacon, in.bcnURL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), req.HttpRemote)
+	if err != nil {
+		return nil, err
+	}
+	return &saver.BeaconResponse{}, nil
+}
+
+// replay runs h with an equivalent http request, converting the response status
+func (in *ingest) replay(ctx context.Context, h http.HandlerFunc, u, contentType string, body io.Reader, remote *saver.HTTPRemote) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, u, body)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	r.Header.Set("content-type", contentType)
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, k := range []string{"user-agent", "x-request-id", "x-forwarded-for", "dnt", "sec-gpc", "x-api-key"} {
+		if vs := md.Get(k); len(vs) > 0 {
+			r.Header.Set(k, vs[0])
+		}
+	}
+	// submitted on behalf of a client,
+	// x-forwarded-for from the metadata is only used if the peer is in http.trusted-proxies
+	if remote != nil && in.trusted(ctx) {
+		if remote.UserAgent != "" {
+			r.Header.Set("user-agent", remote.UserAgent)
+		}
+		if remote.Referrer != "" {
+			r.Header.Set("referer", remote.Referrer)
+		}
+		if remote.Remote != "" {
+			r.RemoteAddr = remote.Remote
+			r.Header.Del("x-forwarded-for")
+		}
+	}
+
+	rec := &statusRecorder{header: make(http.Header)}
+	h(rec, r)
+	if rec.code == 0 || rec.code < 300 {
+		return nil
+	}
+	code := codes.Internal
+	switch rec.code {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = codes.InvalidArgument
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, strings.TrimSpace(rec.body.String()))
+}
+
+// trusted is true for callers allowed to describe the client in http_remote:
+// those with grpc.token or a verified client certificate
+func (in *ingest) trusted(ctx context.Context) bool {
+	if in.token != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, v := range md.Get("authorization") {
+			if subtle.ConstantTimeCompare([]byte(v), []byte("Bearer "+in.token)) == 1 {
+				return true
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if ti, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(ti.State.VerifiedChains) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// statusRecorder is a ResponseWriter keeping the status and body
+type statusRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (sr *statusRecorder) Header() http.Header { return sr.header }
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.code == 0 {
+		sr.code = code
+	}
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	sr.WriteHeader(http.StatusOK)
+	return sr.body.Write(b)
+}
+
+// ServeHTTP serves unary grpc-web calls, binary or base64 text
+func (in *ingest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ct := r.Header.Get("content-type")
+	if r.Method != http.MethodPost || !strings.HasPrefix(ct, "application/grpc-web") {
+		http.Error(w, "expected grpc-web POST", http.StatusUnsupportedMediaType)
+		return
+	}
+	text := strings.HasPrefix(ct, "application/grpc-web-text")
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, 1<<20)
+	if text {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, "read body", http.StatusBadRequest)
+		return
+	}
+
+	md := metadata.MD{}
+	for k, vs := range r.Header {
+		md.Set(k, vs...)
+	}
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		p := &peer.Peer{Addr: addr}
+		if r.TLS != nil {
+			p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+		}
+		ctx = peer.NewContext(ctx, p)
+	}
+
+	var resp proto.Message
+	err = status.Error(codes.InvalidArgument, "expected one uncompressed message")
+	if len(b) >= 5 && b[0] == 0 && int(binary.BigEndian.Uint32(b[1:5])) == len(b)-5 {
+		msg := b[5:]
+		switch strings.TrimPrefix(r.URL.Path, "/saver.v1.Saver/") {
+		case "CSP":
+			req := &saver.CSPRequest{}
+			if err = proto.Unmarshal(msg, req); err == nil {
+				resp, err = in.CSP(ctx, req)
+			}
+		case "Beacon":
+			req := &saver.BeaconRequest{}
+			if err = proto.Unmarshal(msg, req); err == nil {
+				resp, err = in.Beacon(ctx, req)
+			}
+		default:
+			err = status.Errorf(codes.Unimplemented, "unknown method %s", r.URL.Path)
+		}
+	}
+
+	var out bytes.Buffer
+	if err == nil {
+		mb, _ := proto.Marshal(resp)
+		writeGRPCWebFrame(&out, 0, mb)
+	}
+	st := status.Convert(err)
+	trailer := fmt.Sprintf("grpc-status: %d\r\ngrpc-message: %s\r\n", st.Code(), url.PathEscape(st.Message()))
+	writeGRPCWebFrame(&out, 0x80, []byte(trailer))
+
+	w.Header().Set("content-type", ct)
+	w.Header().Set("access-control-expose-headers", "grpc-status, grpc-message")
+	if text {
+		w.Write([]byte(base64.StdEncoding.EncodeToString(out.Bytes())))
+		return
+	}
+	w.Write(out.Bytes())
+}
+
+func writeGRPCWebFrame(w *bytes.Buffer, flag byte, b []byte) {
+	var hdr [5]byte
+	hdr[0] = flag
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(b)))
+	w.Write(hdr[:])
+	w.Write(b)
+}
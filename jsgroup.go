@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/metadata"
+)
+
+type jsGroupOpts struct {
+	window time.Duration
+	frames int
+}
+
+func (o *jsGroupOpts) Flags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.window, "js.group", 0, "forward the message and stack of a js error group once per window, later beacons carry the group and its count so far, at least 1s, 0 to disable")
+	fs.IntVar(&o.frames, "js.group.frames", 5, "number of top stack frames, with columns stripped, grouping js errors")
+}
+
+func (o jsGroupOpts) validate() error {
+	if o.window > 0 && o.window < time.Second {
+		return fmt.Errorf("js.group: %v shorter than 1s", o.window)
+	}
+	if o.frames < 1 {
+		return fmt.Errorf("js.group.frames: %d less than 1", o.frames)
+	}
+	return nil
+}
+
+// jsFrame is the location at the end of a stack frame,
+// preceded by "at fn (" in chrome or "fn@" in firefox and safari
+var jsFrame = regexp.MustCompile(`^\s*(?:at\s+)?(?:(.*?)\s*\(|(.*?)@)?(\S+):(\d+):(\d+)\)?\s*$`)
+
+// stackFingerprint groups errors by the function, script and line of their top frames,
+// columns vary with minification and query strings with builds.
+// Errors without a parsable stack are grouped by their message,
+// with the location from the client script's "at file:line:col" suffix treated the same.
+func stackFingerprint(msg, stack string, frames int) string {
+	var parts []string
+	for _, line := range strings.Split(stack, "\n") {
+		if len(parts) == frames {
+			break
+		}
+		m := jsFrame.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		fn := strings.TrimPrefix(m[1]+m[2], "async ")
+		parts = append(parts, fn+" "+stripQuery(m[3])+":"+m[4])
+	}
+	if len(parts) == 0 {
+		parts = append(parts, jsLocation.ReplaceAllStringFunc(msg, func(loc string) string {
+			m := jsLocation.FindStringSubmatch(loc)
+			return stripQuery(m[1]) + ":" + m[2]
+		}))
+	}
+	h := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(h[:8])
+}
+
+func stripQuery(u string) string {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		return u[:i]
+	}
+	return u
+}
+
+// jsGroups counts the errors in a group within a window
+type jsGroups struct {
+	jsGroupOpts
+	started  prometheus.Counter
+	repeated prometheus.Counter
+
+	mu     sync.Mutex
+	groups map[string]*jsGroup
+}
+
+type jsGroup struct {
+	first time.Time
+	count int
+}
+
+func newJSGroups(ctx context.Context, o jsGroupOpts, f promauto.Factory) *jsGroups {
+	g := &jsGroups{
+		jsGroupOpts: o,
+		started: f.NewCounter(prometheus.CounterOpts{
+			Name: "js_error_groups",
+		}),
+		repeated: f.NewCounter(prometheus.CounterOpts{
+			Name: "js_error_group_repeats",
+		}),
+		groups: make(map[string]*jsGroup),
+	}
+	if o.window > 0 {
+		go g.sweep(ctx)
+	}
+	return g
+}
+
+// Seen counts an error in its group,
+// returning the count in the window so far and when the window started
+func (g *jsGroups) Seen(key string, t time.Time) (int, time.Time) {
+	if g.window <= 0 {
+		return 1, t
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	grp, ok := g.groups[key]
+	if !ok || t.Sub(grp.first) >= g.window {
+		grp = &jsGroup{first: t}
+		g.groups[key] = grp
+		g.started.Inc()
+	} else {
+		g.repeated.Inc()
+	}
+	grp.count++
+	return grp.count, grp.first
+}
+
+func (g *jsGroups) sweep(ctx context.Context) {
+	t := time.NewTicker(g.window)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			g.mu.Lock()
+			for key, grp := range g.groups {
+				if now.Sub(grp.first) >= g.window {
+					delete(g.groups, key)
+				}
+			}
+			g.mu.Unlock()
+		}
+	}
+}
+
+// jsErrorMetadata adds a beacon's js errors to the forwarded metadata:
+// the count, the group, and the message and stack for the first of a group in the window,
+// or the group's count so far for the rest
+func (s *Server) jsErrorMetadata(ctx context.Context, n int, msg, stack string, md metadata.MD) {
+	msg, stack = s.sourceMaps.Resolve(ctx, msg), s.sourceMaps.Resolve(ctx, stack)
+	group := stackFingerprint(msg, stack, s.jsGroupOpts.frames)
+	count, since := s.jsGroups.Seen(group, time.Now())
+	md.Append("js-errors", strconv.Itoa(n))
+	md.Append("js-error-group", group)
+	if count > 1 {
+		md.Append("js-error-group-count", strconv.Itoa(count))
+		md.Append("js-error-group-since", since.UTC().Format(time.RFC3339))
+		return
+	}
+	md.Append("js-error-bin", s.privacyOpts.scrubText(msg))
+	if stack != "" {
+		md.Append("js-error-stack", s.privacyOpts.scrubText(stack))
+	}
+}
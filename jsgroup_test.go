@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+func TestStackFingerprint(t *testing.T) {
+	const chrome = "TypeError: x is undefined\n" +
+		"    at render (https://example.com/app.js?v=1:10:200)\n" +
+		"    at async load (https://example.com/app.js?v=1:20:5)\n" +
+		"    at https://example.com/main.js:1:1"
+	base := stackFingerprint("x is undefined", chrome, 5)
+	for name, tt := range map[string]struct {
+		msg, stack string
+		same       bool
+	}{
+		"columns and build": {"x is undefined", "TypeError: x is undefined\n" +
+			"    at render (https://example.com/app.js?v=2:10:999)\n" +
+			"    at async load (https://example.com/app.js?v=2:20:1)\n" +
+			"    at https://example.com/main.js:1:7", true},
+		"message": {"y is undefined", "TypeError: y is undefined\n" +
+			"    at render (https://example.com/app.js:10:1)\n" +
+			"    at load (https://example.com/app.js:20:1)\n" +
+			"    at https://example.com/main.js:1:1", true},
+		"firefox": {"x is undefined", "render@https://example.com/app.js:10:200\n" +
+			"load@https://example.com/app.js:20:5\n" +
+			"@https://example.com/main.js:1:1", true},
+		"line": {"x is undefined", "TypeError: x is undefined\n" +
+			"    at render (https://example.com/app.js:11:200)\n" +
+			"    at load (https://example.com/app.js:20:5)\n" +
+			"    at https://example.com/main.js:1:1", false},
+		"below frames": {"x is undefined", chrome + "\n    at other (https://example.com/other.js:1:1)", true},
+	} {
+		if got := stackFingerprint(tt.msg, tt.stack, 3) == base; got != tt.same {
+			t.Errorf("%s: same group = %v, want %v", name, got, tt.same)
+		}
+	}
+
+	a := stackFingerprint("boom at https://example.com/app.js?v=1:3:40", "", 5)
+	b := stackFingerprint("boom at https://example.com/app.js?v=2:3:7", "", 5)
+	if a != b {
+		t.Errorf("messages differing in column and query grouped apart")
+	}
+}
+
+func TestJSGroups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g := newJSGroups(ctx, jsGroupOpts{window: time.Minute, frames: 5}, promauto.With(prometheus.NewRegistry()))
+	start := time.Now()
+	for i, tt := range []struct {
+		key   string
+		t     time.Time
+		count int
+		since time.Time
+	}{
+		{"a", start, 1, start},
+		{"a", start.Add(time.Second), 2, start},
+		{"b", start.Add(time.Second), 1, start.Add(time.Second)},
+		{"a", start.Add(30 * time.Second), 3, start},
+		{"a", start.Add(time.Minute), 1, start.Add(time.Minute)},
+	} {
+		count, since := g.Seen(tt.key, tt.t)
+		if count != tt.count || !since.Equal(tt.since) {
+			t.Errorf("%d: Seen(%s) = %d since %v, want %d since %v", i, tt.key, count, since, tt.count, tt.since)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+type kAnonOpts struct {
+	k      int
+	window time.Duration
+}
+
+func (o *kAnonOpts) Flags(fs *flag.FlagSet) {
+	fs.IntVar(&o.k, "kanon.k", 0, "withhold reports until k distinct clients reported the same page, country, browser, 0 to disable. withheld reports are dropped, not forwarded later")
+	fs.DurationVar(&o.window, "kanon.window", time.Hour, "window to count distinct clients in, withheld counts are exported and logged at the end")
+}
+
+func (o kAnonOpts) validate() error {
+	if o.k > 0 && o.window <= 0 {
+		return fmt.Errorf("kanon.window must be positive with kanon.k set")
+	}
+	return nil
+}
+
+// kAnon tracks distinct clients per combination of dimensions
+type kAnon struct {
+	kAnonOpts
+	log      zerolog.Logger
+	withheld prometheus.Counter
+	// last window's totals, the groups themselves are what k hides
+	lastReports prometheus.Gauge
+	lastGroups  prometheus.Gauge
+	salt        []byte
+
+	mu     sync.Mutex
+	groups map[string]*kGroup
+}
+
+type kGroup struct {
+	clients  map[string]struct{}
+	withheld int
+}
+
+func newKAnon(ctx context.Context, o kAnonOpts, log zerolog.Logger, f promauto.Factory) *kAnon {
+	ka := &kAnon{
+		kAnonOpts: o,
+		log:       log,
+		withheld: f.NewCounter(prometheus.CounterOpts{
+			Name: "kanon_withheld_reports",
+		}),
+		lastReports: f.NewGauge(prometheus.GaugeOpts{
+			Name: "kanon_last_window_withheld_reports",
+		}),
+		lastGroups: f.NewGauge(prometheus.GaugeOpts{
+			Name: "kanon_last_window_withheld_groups",
+		}),
+		salt:   make([]byte, 32),
+		groups: make(map[string]*kGroup),
+	}
+	rand.Read(ka.salt)
+	if o.k > 0 {
+		go ka.rotate(ctx)
+	}
+	return ka
+}
+
+// Allow records a report from client and returns true if it can be forwarded.
+// Reports from the first k-1 clients of a group are dropped for good,
+// buffering them would keep the identifying rare reports in memory
+func (ka *kAnon) Allow(page, country, ua, client string) bool {
+	if ka.k <= 0 {
+		return true
+	}
+	if pu, err := url.Parse(page); err == nil {
+		page = pu.Host + pu.Path
+	}
+	key := strings.Join([]string{page, country, uaFamily(ua)}, "|")
+
+	ka.mu.Lock()
+	defer ka.mu.Unlock()
+	g, ok := ka.groups[key]
+	if !ok {
+		g = &kGroup{clients: make(map[string]struct{})}
+		ka.groups[key] = g
+	}
+	g.clients[client] = struct{}{}
+	if len(g.clients) >= ka.k {
+		return true
+	}
+	g.withheld++
+	ka.withheld.Inc()
+	return false
+}
+
+// hash identifies a group in logs without revealing it,
+// only comparable within a process
+func (ka *kAnon) hash(key string) string {
+	m := hmac.New(sha256.New, ka.salt)
+	m.Write([]byte(key))
+	return hex.EncodeToString(m.Sum(nil)[:8])
+}
+
+func (ka *kAnon) rotate(ctx context.Context) {
+	t := time.NewTicker(ka.window)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			ka.mu.Lock()
+			groups := ka.groups
+			ka.groups = make(map[string]*kGroup)
+			ka.mu.Unlock()
+
+			var reports, withheld int
+			for key, g := range groups {
+				if g.withheld == 0 {
+					continue
+				}
+				reports += g.withheld
+				withheld++
+				ka.log.Debug().Str("group_hash", ka.hash(key)).Int("reports", g.withheld).Int("clients", len(g.clients)).Msg("withheld below k")
+			}
+			ka.lastReports.Set(float64(reports))
+			ka.lastGroups.Set(float64(withheld))
+			ka.log.Info().Int("reports", reports).Int("groups", withheld).Msg("withheld below k")
+		}
+	}
+}
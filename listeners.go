@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+type listenOpts struct {
+	unix     string
+	unixMode string
+	extra    extraListeners
+}
+
+func (o *listenOpts) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.unix, "addr.unix", "", "path of a unix socket to also serve reports on, without tls")
+	fs.StringVar(&o.unixMode, "addr.unix.mode", "0660", "permissions of the unix socket")
+	fs.Var(&o.extra, "addr.extra", "additional host:port[=handler,...] to serve reports on without tls, handlers: csp, beacon, reports, all if none listed, repeatable")
+}
+
+type extraListener struct {
+	addr     string
+	handlers []string
+}
+
+// extraListeners is a repeatable flag of addresses with their handlers
+type extraListeners []extraListener
+
+func (l *extraListeners) String() string {
+	if l == nil {
+		return ""
+	}
+	var ss []string
+	for _, e := range *l {
+		s := e.addr
+		if len(e.handlers) > 0 {
+			s += "=" + strings.Join(e.handlers, ",")
+		}
+		ss = append(ss, s)
+	}
+	return strings.Join(ss, " ")
+}
+
+func (l *extraListeners) Set(v string) error {
+	var e extraListener
+	i := strings.Index(v, "=")
+	if i < 0 {
+		e.addr = v
+	} else {
+		e.addr = v[:i]
+		var hs stringList
+		hs.Set(v[i+1:])
+		for _, h := range hs {
+			if h != "csp" && h != "beacon" && h != "reports" {
+				return fmt.Errorf("unknown handler %q", h)
+			}
+		}
+		e.handlers = hs
+	}
+	if e.addr == "" {
+		return fmt.Errorf("empty address")
+	}
+	*l = append(*l, e)
+	return nil
+}
+
+// onlyPaths restricts h to paths, nil allows all
+func onlyPaths(h http.Handler, paths []string) http.Handler {
+	if paths == nil {
+		return h
+	}
+	allowed := newLabelSet(paths)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed[r.URL.Path] {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveExtraListeners starts a server for each extra listener,
+// sharing the middleware of srv but only serving the selected handlers
+func (o listenOpts) serveExtraListeners(ctx context.Context, srv *http.Server, paths map[string]string, log zerolog.Logger) ([]*http.Server, error) {
+	var srvs []*http.Server
+	for _, e := range o.extra {
+		var ps []string
+		for _, h := range e.handlers {
+			ps = append(ps, paths[h])
+		}
+		l, err := net.Listen("tcp", e.addr)
+		if err != nil {
+			return nil, fmt.Errorf("listen %s: %w", e.addr, err)
+		}
+		esrv := &http.Server{
+			Handler:           onlyPaths(srv.Handler, ps),
+			ReadHeaderTimeout: srv.ReadHeaderTimeout,
+			MaxHeaderBytes:    srv.MaxHeaderBytes,
+			ErrorLog:          srv.ErrorLog,
+		}
+		serveExtra(esrv, []net.Listener{l}, log)
+		srvs = append(srvs, esrv)
+	}
+	go func() {
+		<-ctx.Done()
+		for _, esrv := range srvs {
+			go esrv.Shutdown(context.Background())
+		}
+	}()
+	return srvs, nil
+}
+
+// listeners opens the additional listeners for the service server
+func (o listenOpts) listeners() ([]net.Listener, error) {
+	var ls []net.Listener
+	if o.unix != "" {
+		mode, err := strconv.ParseUint(o.unixMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parse addr.unix.mode: %w", err)
+		}
+		// left behind by an unclean exit
+		if err := os.Remove(o.unix); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+		l, err := net.Listen("unix", o.unix)
+		if err != nil {
+			return nil, fmt.Errorf("listen unix: %w", err)
+		}
+		err = os.Chmod(o.unix, os.FileMode(mode))
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("chmod socket: %w", err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// systemdListeners are the sockets passed by systemd socket activation
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("parse LISTEN_FDS: %w", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var ls []net.Listener
+	for i := 0; i < n; i++ {
+		// passed fds start after stdin, stdout, stderr
+		fd := 3 + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd listener %s: %w", name, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// serveExtra serves srv on additional listeners,
+// they're closed with the rest on srv.Shutdown
+func serveExtra(srv *http.Server, ls []net.Listener, log zerolog.Logger) {
+	for _, l := range ls {
+		go func(l net.Listener) {
+			log.Info().Str("addr", l.Addr().String()).Msg("starting extra service listener")
+			err := srv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error().Err(err).Str("addr", l.Addr().String()).Msg("serve")
+			}
+		}(l)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rs/zerolog"
+)
+
+// dynamicLevel moves the level set by -log.lvl to zerolog's global level
+// so it can be changed at runtime,
+// returning a logger that otherwise doesn't filter
+func dynamicLevel(lg zerolog.Logger) zerolog.Logger {
+	zerolog.SetGlobalLevel(lg.GetLevel())
+	return lg.Level(zerolog.TraceLevel)
+}
+
+// logLevelSignals makes SIGUSR1 more verbose and SIGUSR2 less verbose
+func logLevelSignals(ctx context.Context, lg zerolog.Logger) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-c:
+				lvl := zerolog.GlobalLevel()
+				if sig == syscall.SIGUSR1 && lvl > zerolog.TraceLevel {
+					lvl--
+				} else if sig == syscall.SIGUSR2 && lvl < zerolog.PanicLevel {
+					lvl++
+				}
+				zerolog.SetGlobalLevel(lvl)
+				lg.WithLevel(zerolog.NoLevel).Str("level", lvl.String()).Str("signal", sig.String()).Msg("log level changed")
+			}
+		}
+	}()
+}
+
+// logLevel reports the current log level,
+// or sets it with PUT/POST level=
+func (s *Server) logLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut || r.Method == http.MethodPost {
+		lvl := zerolog.GlobalLevel()
+		err := levelFlag{&lvl}.Set(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		zerolog.SetGlobalLevel(lvl)
+		s.log.WithLevel(zerolog.NoLevel).Str("level", levelFlag{&lvl}.String()).Msg("log level changed")
+	}
+	lvl := zerolog.GlobalLevel()
+	fmt.Fprintln(w, levelFlag{&lvl}.String())
+}
@@ -1,26 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/otel/api/global"
 	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/label"
 	"go.seankhliao.com/apis/saver/v1"
+	"go.seankhliao.com/statslogger/collector"
 	"go.seankhliao.com/usvc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -28,147 +38,834 @@ const (
 )
 
 func main() {
-	os.Exit(usvc.Exec(context.Background(), &Server{}, os.Args))
+	if len(os.Args) > 1 && (os.Args[1] == "help" || os.Args[1] == "-help") {
+		usage(os.Stdout, os.Args[0])
+		return
+	}
+	cmd, args := subcommand(os.Args)
+	os.Exit(commands[cmd](args))
 }
 
 type Server struct {
-	saverAddr string
-	client    saver.SaverClient
-	cc        *grpc.ClientConn
+	args       []string // command line, before expanding config
+	fs         *flag.FlagSet
+	configFile string
+	watchEvery time.Duration
+
+	saverAddr  string
+	routeOpts  routeOpts
+	listen     listenOpts
+	response   responseOpts
+	ingestOpts ingestOpts
+	proxyOpts  proxyOpts
+	schemaOpts schemaOpts
+	tenantOpts tenantOpts
+	tenants    *tenants
+	trusted    trustedProxies
+	shutdown   time.Duration
+	dryRun     bool
+	client     saver.SaverClient
+	cc         *grpc.ClientConn
+	collector  *collector.Collector
+
+	allowDomains stringList
+	privacyOpts  privacyOpts
+	redact       redactRules
+	filters      filterRules
+	noise        bool
+	cspStrict    bool
+	geoOpts      geoOpts
+	live         atomic.Value // *reloadable
+	reloadMu     sync.Mutex
+	kAnonOpts    kAnonOpts
+	kanon        *kAnon
+	dedupOpts    dedupOpts
+	dedup        *dedup
+	sampleOpts   sampleOpts
+	sampler      *sampler
+	rollupOpts   rollupOpts
+	rollup       *rollup
+	pipelineOpts pipelineOpts
+	pipeline     pipeline
+	anomalyOpts  anomalyOpts
+	anomalies    *anomalies
+	alertOpts    alertOpts
+	alerts       *alerter
+	digestOpts   digestOpts
+	digests      digests
+	sessTimeout  time.Duration
+	normalize    normalizeOpts
+	refSources   stringList
+	spamFile     string
+	spamWatch    time.Duration
+	referrers    referrerSources
+	sessions     *sessions
+
+	adminToken string
+	debugOpts  debugOpts
+	nRecent    int
+	recent     *recentRecords
+	tail       *tail
+	traceOpts  traceOpts
+	otlpOpts   otlpOpts
 
-	log    zerolog.Logger
-	tracer trace.Tracer
+	abuseOpts abuseOpts
+	bans      banList
+	abuse     abuseMetrics
 
-	cspc    prometheus.Counter
-	beaconc prometheus.Counter
+	log       zerolog.Logger
+	accessLvl zerolog.Level
+	auditLvl  zerolog.Level
+	tracer    trace.Tracer
+
+	requests *prometheus.CounterVec
+	droppedc *prometheus.CounterVec
+	dntc     *prometheus.CounterVec
+	saverh   *prometheus.HistogramVec
+	sizes    *prometheus.HistogramVec
+
+	metricOpts       metricOpts
+	metricNamespace  string
+	metricDirectives stringList
+	directives       labelSet
+	violations       *prometheus.CounterVec
+	countryCSP       *prometheus.CounterVec
+	countryViews     *prometheus.CounterVec
+	invalid          *prometheus.CounterVec
+	metricPages      stringList
+	beacons          *prometheus.CounterVec
+	beaconDur        *prometheus.HistogramVec
+	outliers         *prometheus.CounterVec
+	beaconOpts       beaconOpts
+	scriptOpts       clientScriptOpts
+	sourceMapOpts    sourceMapOpts
+	sourceMaps       *sourceMaps
+	jsGroupOpts      jsGroupOpts
+	jsGroups         *jsGroups
+	vitals           *prometheus.HistogramVec
+	cls              *prometheus.HistogramVec
+	jsErrors         *prometheus.CounterVec
+	reportingc       *prometheus.CounterVec
+	nelc             *prometheus.CounterVec
+	schemac          *prometheus.CounterVec
+	uniquesOpts      uniquesOpts
+	uniques          *uniques
+	onlineOpts       onlineOpts
+	online           *online
+	topOpts          topOpts
+	bucketOpts       bucketOpts
+	top              *top
 }
 
 func (s *Server) Flags(fs *flag.FlagSet) {
+	s.fs = fs
+	fs.DurationVar(&s.watchEvery, "config.watch", 0, "interval to check -config for changes and reload, 0 to disable")
+	fs.StringVar(&s.configFile, "config", "", "toml file of flag values, [table] key = value for -table.key, flags override the file")
 	fs.StringVar(&s.saverAddr, "saver", "saver:443", "url to connect to saver")
+	s.routeOpts.Flags(fs)
+	s.listen.Flags(fs)
+	s.response.Flags(fs)
+	s.ingestOpts.Flags(fs)
+	s.proxyOpts.Flags(fs)
+	s.schemaOpts.Flags(fs)
+	s.tenantOpts.Flags(fs)
+	fs.Var(&s.trusted, "http.trusted-proxies", "comma separated ips or cidrs of proxies whose x-forwarded-for is used to find the client address, unix for addr.unix peers, none if empty")
+	fs.DurationVar(&s.shutdown, "shutdown.timeout", 0, "time to drain connections on shutdown before closing them, 0 to wait indefinitely")
+	fs.BoolVar(&s.dryRun, "dry-run", false, "log records instead of forwarding them to saver")
+	fs.Var(&s.allowDomains, "allow.domains", "comma separated domains (and their subdomains) to accept reports for, all if empty")
+	s.accessLvl = zerolog.InfoLevel
+	fs.Var(levelFlag{&s.accessLvl}, "log.access", "level to log accesses at, disabled to turn off")
+	s.auditLvl = zerolog.Disabled
+	fs.Var(levelFlag{&s.auditLvl}, "log.drops", "level to log dropped reports at, disabled to turn off")
+	fs.Var(secretString(&s.adminToken), "admin.token", "bearer token for admin endpoints on the metrics port, disabled if empty")
+	s.debugOpts.Flags(fs)
+	fs.IntVar(&s.nRecent, "debug.reports", 100, "number of recently forwarded reports to keep for /debug/reports")
+	s.traceOpts.Flags(fs)
+	s.otlpOpts.Flags(fs)
+	s.abuseOpts.Flags(fs)
+	s.privacyOpts.Flags(fs)
+	fs.Var(&s.redact, "redact", "comma separated field=action rules applied to forwarded records, actions: drop, hash, truncate:n")
+	fs.Var(&s.filters, "filter", "rule applied to reports before forwarding: action field=glob|field~regexp ..., actions: drop, keep, tag:name, repeatable")
+	fs.BoolVar(&s.cspStrict, "csp.strict", false, "reject csp reports missing required fields or with malformed urls with 400")
+	fs.BoolVar(&s.noise, "filter.noise", true, "drop csp violations from browser extensions, in app browsers, and page translators, after the filter rules")
+	s.geoOpts.Flags(fs)
+	s.kAnonOpts.Flags(fs)
+	s.dedupOpts.Flags(fs)
+	s.sampleOpts.Flags(fs)
+	s.rollupOpts.Flags(fs)
+	s.pipelineOpts.Flags(fs)
+	s.beaconOpts.Flags(fs)
+	s.scriptOpts.Flags(fs)
+	s.sourceMapOpts.Flags(fs)
+	s.jsGroupOpts.Flags(fs)
+	s.uniquesOpts.Flags(fs)
+	s.onlineOpts.Flags(fs)
+	s.topOpts.Flags(fs)
+	s.bucketOpts.Flags(fs)
+	s.anomalyOpts.Flags(fs)
+	s.alertOpts.Flags(fs)
+	s.digestOpts.Flags(fs)
+	s.metricOpts.Flags(fs)
+	fs.StringVar(&s.metricNamespace, "metrics.runtime-namespace", "", "additionally export go and process metrics with this namespace")
+	s.metricDirectives = cspDirectives
+	fs.Var(&s.metricDirectives, "metrics.directives", "comma separated csp directives to export as metric labels, others are counted as other")
+	fs.Var(&s.metricPages, "metrics.pages", "comma separated page path patterns (path.Match) to export beacon metrics for, others are counted as other")
+	s.normalize.Flags(fs)
+	fs.StringVar(&s.spamFile, "referrer.spam", "", "file of referrer spam domains, one per line, beacons with these referrers are dropped")
+	fs.DurationVar(&s.spamWatch, "referrer.spam.watch", time.Hour, "interval to check -referrer.spam for changes and reload, 0 to disable")
+	fs.Var(&s.refSources, "referrer.sources", "comma separated domain=source mappings for beacon traffic sources, added to the built in search and social ones, domain.* matches any tld")
+	fs.DurationVar(&s.sessTimeout, "session.timeout", 0, "inactivity before a visitor starts a new anonymous session for beacons, 0 to disable")
 }
 
 func (s *Server) Setup(ctx context.Context, u *usvc.USVC) error {
-	s.log = u.Logger
+	s.log = dynamicLevel(u.Logger)
+	logLevelSignals(ctx, s.log)
+	if errs := s.validate(); len(errs) > 0 {
+		return configErrors(errs)
+	}
+	u.ServiceServer.Handler = serviceHandler(u.ServiceMux)
+	err := s.traceOpts.install(ctx)
+	if err != nil {
+		return err
+	}
 	s.tracer = global.Tracer(name)
+	s.debugOpts.setup()
 
-	s.cspc = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "statslogger_csp_requests",
+	f, err := s.metricOpts.factory()
+	if err != nil {
+		return err
+	}
+	registerRuntimeMetrics(f, s.metricNamespace)
+	s.tenants, err = newTenants(s.tenantOpts, &f)
+	if err != nil {
+		return err
+	}
+	s.requests = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "requests_total",
+	}, s.tenantLabels("handler", "outcome"))
+	s.droppedc = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "dropped_reports",
+	}, s.tenantLabels("handler", "reason"))
+	s.dntc = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "dnt_requests",
+	}, []string{"handler", "action"})
+	s.saverh = f.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "saver_latency_s",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"rpc", "outcome"})
+	s.sizes = f.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "request_size_bytes",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+	}, []string{"handler"})
+	s.directives = newLabelSet(s.metricDirectives)
+	s.violations = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "csp_violations",
+	}, s.tenantLabels("directive", "disposition", "class"))
+	s.countryCSP = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "csp_violations_by_country",
+	}, []string{"country"})
+	s.countryViews = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "beacons_by_country",
+	}, []string{"country"})
+	s.invalid = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "csp_invalid_reports",
+	}, []string{"reason"})
+	s.beacons = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "beacons",
+	}, s.tenantLabels("page"))
+	s.beaconDur = f.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "beacon_duration_s",
+		Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800},
+	}, []string{"page"})
+	s.outliers = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "beacon_duration_outliers",
+	}, []string{"reason"})
+	s.vitals = f.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "beacon_vitals_s",
+		Buckets: []float64{0.1, 0.2, 0.5, 1, 1.8, 2.5, 4, 8, 15},
+	}, []string{"page", "vital"})
+	s.cls = f.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "beacon_cls",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1},
+	}, []string{"page"})
+	s.jsErrors = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "beacon_js_errors",
+	}, []string{"page"})
+	s.reportingc = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "reporting_api",
+	}, []string{"type"})
+	s.nelc = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "network_errors",
+	}, []string{"type", "phase"})
+	s.schemac = f.NewCounterVec(prometheus.CounterOpts{
+		Name: "schema_validation",
+	}, []string{"schema", "result"})
+	s.abuse = newAbuseMetrics(f)
+
+	// parsing and validation are shared with the collector package,
+	// the rest is done here
+	s.collector = collector.New(nil,
+		collector.WithStrict(s.cspStrict),
+		collector.WithRemote(func(r *http.Request) *saver.HTTPRemote { return s.httpRemote(r, false) }),
+		collector.WithReject(s.reject),
+		collector.WithCSPHandler(s.forwardCSP),
+		collector.WithBeaconHandler(s.forwardBeacon),
+	)
+	s.pipeline, err = s.pipelineOpts.pipeline(s)
+	if err != nil {
+		return err
+	}
+	rl, err := loadReloadable(s)
+	if err != nil {
+		return err
+	}
+	s.live.Store(rl)
+	if u.ServiceServer.TLSConfig != nil && len(u.ServiceServer.TLSConfig.Certificates) > 0 {
+		u.ServiceServer.TLSConfig.GetCertificate = s.getCertificate
+	}
+	s.reloadSignals(ctx)
+	watchFiles(ctx, s.geoOpts.watch, s.geoOpts.files(), func() {
+		err := s.reloadGeo()
+		if err != nil {
+			s.log.Error().Err(err).Msg("reload geoip")
+			return
+		}
+		s.log.Info().Strs("files", s.geoOpts.files()).Msg("reloaded geoip")
 	})
-	s.beaconc = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "statslogger_beacon_requests",
+	if s.configFile != "" {
+		watchFiles(ctx, s.watchEvery, []string{s.configFile}, func() { s.reloadLogged("config.watch") })
+	}
+	if s.spamFile != "" {
+		watchFiles(ctx, s.spamWatch, []string{s.spamFile}, func() { s.reloadLogged("referrer.spam") })
+	}
+	s.kanon = newKAnon(ctx, s.kAnonOpts, s.log, f)
+	s.rollup = newRollup(ctx, s.rollupOpts, s.log, f, func() saver.SaverClient { return s.client })
+	s.alerts = newAlerter(ctx, s.alertOpts, s.log, f)
+	s.anomalies = newAnomalies(ctx, s.anomalyOpts, s.log, f, s.alerts.Spike)
+	zones, _ := s.bucketOpts.locations()
+	digestZone, ok := zones[""]
+	if !ok {
+		digestZone = time.UTC
+	}
+	s.digests = newDigests(ctx, s.digestOpts, digestZone, s.log, f)
+	s.sampler = newSampler(s.sampleOpts, s.log, f)
+	s.sourceMaps = newSourceMaps(s.sourceMapOpts, s.log, f)
+	s.jsGroups = newJSGroups(ctx, s.jsGroupOpts, f)
+	s.dedup = newDedup(ctx, s.dedupOpts, s.log, f, func(ctx context.Context, req *saver.CSPRequest) error {
+		_, err := s.client.CSP(ctx, req)
+		return err
 	})
+	s.sessions = newSessions(ctx, s.sessTimeout)
+	s.uniques = newUniques(ctx, s.uniquesOpts, f)
+	s.online = newOnline(ctx, s.onlineOpts, f)
+	s.top, err = newTop(ctx, s.topOpts, s.log)
+	if err != nil {
+		return err
+	}
+	s.referrers, err = newReferrerSources(s.refSources)
+	if err != nil {
+		return err
+	}
+	s.bans, err = s.abuseOpts.banList(ctx)
+	if err != nil {
+		return fmt.Errorf("setup ban list: %w", err)
+	}
 
-	u.ServiceMux.HandleFunc("/csp", s.csp)
-	u.ServiceMux.HandleFunc("/beacon", s.beacon)
+	// usvc's /metrics doesn't negotiate openmetrics, needed for exemplars
+	u.MetricMux.Handle("/metrics/openmetrics", promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	}))
 
-	var err error
-	s.cc, err = grpc.Dial(s.saverAddr, grpc.WithTransportCredentials(credentials.NewTLS(u.ServiceServer.TLSConfig)), grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor(s.tracer)))
-	if err != nil {
-		return fmt.Errorf("connect to stream: %w", err)
+	u.MetricMux.HandleFunc("/readyz", s.readyz)
+	u.MetricMux.HandleFunc("/healthz", s.healthz)
+	u.MetricMux.HandleFunc("/version", serveVersion)
+	s.recent = newRecentRecords(s.nRecent)
+	u.MetricMux.HandleFunc("/debug/reports", s.admin(s.recent.ServeHTTP))
+	u.MetricMux.HandleFunc("/debug/config", s.admin(s.config))
+	u.MetricMux.HandleFunc("/debug/loglevel", s.admin(s.logLevel))
+	s.tail = newTail()
+	u.MetricMux.HandleFunc("/tail", s.admin(s.tail.ServeHTTP))
+	u.MetricMux.HandleFunc("/stats/uniques", s.admin(s.uniques.ServeHTTP))
+	u.MetricMux.HandleFunc("/stats/online", s.admin(s.online.ServeHTTP))
+	u.MetricMux.HandleFunc("/stats/top", s.admin(s.top.ServeHTTP))
+	u.MetricMux.HandleFunc("/stats", s.admin(s.stats))
+	u.MetricMux.HandleFunc("/export", s.admin(s.export))
+	u.MetricMux.HandleFunc("/graphql", s.admin(s.graphql))
+	u.MetricMux.HandleFunc("/grafana/", s.admin(s.grafana))
+	u.MetricMux.HandleFunc("/dashboard", s.admin(s.dashboard))
+	// streaming responses for /tail and pprof
+	u.MetricServer.WriteTimeout = 0
+	s.otlpOpts.run(ctx, prometheus.DefaultGatherer, s.log)
+
+	if s.routeOpts.enabled("csp") {
+		u.ServiceMux.HandleFunc(s.routeOpts.path(s.routeOpts.csp), s.accessLog("/csp", s.csp))
+	}
+	if s.routeOpts.enabled("beacon") {
+		u.ServiceMux.HandleFunc(s.routeOpts.path(s.routeOpts.beacon), s.accessLog("/beacon", s.beacon))
+	}
+	if s.routeOpts.enabled("reports") {
+		u.ServiceMux.HandleFunc(s.routeOpts.path(s.routeOpts.reports), s.accessLog("/reports", s.reports))
+		allowPreflight(u.ServiceServer, "content-type", s.routeOpts.path(s.routeOpts.reports))
 	}
-	s.client = saver.NewSaverClient(s.cc)
+	if s.routeOpts.enabled("schemas") {
+		p := s.routeOpts.path(s.routeOpts.schemas) + "/"
+		u.ServiceMux.HandleFunc(p, s.schemasHandler(p))
+	}
+	if s.routeOpts.enabled("script") {
+		u.ServiceMux.HandleFunc(s.routeOpts.path(s.routeOpts.script), s.script)
+	}
+	// before anything starts serving reports
+	if s.dryRun {
+		s.client = dryRunSaver{}
+	} else {
+		s.cc, err = grpc.Dial(s.saverAddr, grpc.WithTransportCredentials(credentials.NewTLS(u.ServiceServer.TLSConfig)), grpc.WithChainUnaryInterceptor(
+			otelgrpc.UnaryClientInterceptor(s.tracer, otelgrpc.WithPropagators(saverPropagators())),
+			saverLatency(s.saverh),
+		))
+		if err != nil {
+			return fmt.Errorf("connect to stream: %w", err)
+		}
+		s.client = saver.NewSaverClient(s.cc)
 
-	go func() {
-		<-ctx.Done()
-		s.cc.Close()
-	}()
+		go func() {
+			<-ctx.Done()
+			<-s.rollup.done
+			s.cc.Close()
+		}()
+	}
 
+	err = s.setupIngest(ctx, u)
+	if err != nil {
+		return err
+	}
+	err = s.setupProxy(u)
+	if err != nil {
+		return err
+	}
+	s.setupTenants(u)
+
+	ls, err := s.listen.listeners()
+	if err != nil {
+		return err
+	}
+	sls, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+	if len(sls) > 0 {
+		tlsConf := u.ServiceServer.TLSConfig
+		if tlsConf != nil && len(tlsConf.Certificates) > 0 {
+			for i := range sls {
+				sls[i] = tls.NewListener(sls[i], tlsConf)
+			}
+		}
+		// usvc always listens on -addr,
+		// keep it off the sockets systemd owns
+		u.ServiceServer.Addr = "localhost:0"
+		ls = append(ls, sls...)
+	}
+	serveExtra(u.ServiceServer, ls, s.log)
+	srvs, err := s.listen.serveExtraListeners(ctx, u.ServiceServer, map[string]string{
+		"csp":     s.routeOpts.path(s.routeOpts.csp),
+		"beacon":  s.routeOpts.path(s.routeOpts.beacon),
+		"reports": s.routeOpts.path(s.routeOpts.reports),
+	}, s.log)
+	if err != nil {
+		return err
+	}
+	shutdownAfter(ctx, s.shutdown, s.log, append(srvs, u.ServiceServer, u.MetricServer)...)
 	return nil
 }
 
-type CSPReport struct {
-	CspReport struct {
-		OriginalPolicy     string `json:"original-policy"`
-		ViolatedDirective  string `json:"violated-directive"`
-		Referrer           string `json:"referrer"`
-		ScriptSample       string `json:"script-sample"`
-		StatusCode         int64  `json:"status-code"`
-		LineNumber         int64  `json:"line-number"`
-		Disposition        string `json:"disposition"`
-		BlockedURI         string `json:"blocked-uri"`
-		EffectiveDirective string `json:"effective-directive"`
-		DocumentURI        string `json:"document-uri"`
-		SourceFile         string `json:"source-file"`
-	} `json:"csp-report"`
-}
+// CSPReport is a report with the checks and groupings statslogger needs
+type CSPReport collector.Report
 
 func (s *Server) csp(w http.ResponseWriter, r *http.Request) {
-	ctx, span := s.tracer.Start(r.Context(), "csp")
+	ctx, span := s.traceOpts.tracer("csp").Start(r.Context(), "csp")
 	defer span.End()
 
-	h := r.URL.Path
-	remote := r.Header.Get("x-forwarded-for")
-	if remote == "" {
-		remote = r.RemoteAddr
+	if s.banned(ctx, w, r) || s.dnt(w, r) || s.tenant(w, r) {
+		return
+	}
+	if s.schemaOpts.mode != "off" {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		var v interface{}
+		if err == nil && json.Unmarshal(body, &v) == nil && s.checkSchema(w, r, "csp", v) {
+			return
+		}
+		// a truncated body fails to parse as it would have
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
 	}
+	s.collector.CSP(w, r.WithContext(ctx))
+}
 
-	var cspReport CSPReport
-	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&cspReport)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		s.log.Error().Str("handler", h).Err(err).Msg("unmarshal csp report")
+// forwardCSP takes over from the collector once a report is parsed and validated
+func (s *Server) forwardCSP(w http.ResponseWriter, r *http.Request, rep collector.Report, cspRequest *saver.CSPRequest) {
+	ctx := r.Context()
+	span, log := trace.SpanFromContext(ctx), zerolog.Ctx(ctx)
+	cspReport := CSPReport(rep)
+	if !s.current().allow.Allowed(cspReport.CspReport.DocumentURI) {
+		s.drop(w, r, "domain")
+		return
+	}
+	site := s.tenantOf(r)
+	drop, tags := s.current().filter.apply(withTenant(cspReport.field, site))
+	if drop != "" {
+		s.drop(w, r, drop)
+		return
+	}
+	dedupKey := cspReport.dedupKey(s.privacyOpts.visitor(r, time.Now()))
+	if s.dedup.Duplicate(dedupKey, time.Now()) {
+		s.drop(w, r, "duplicate")
+		return
+	}
+	fingerprint, class := cspReport.fingerprint(s.normalize), cspReport.classify()
+	s.anomalies.Record(fingerprint, class, cspReport)
+	s.alerts.Seen(fingerprint, class, cspReport)
+	s.digests.CSP(fingerprint, class, cspReport)
+	rate := s.sampler.Keep(cspReport, fingerprint)
+	if rate == 0 {
+		s.drop(w, r, "sampled")
+		return
+	}
+	gi := s.lookupGeo(r)
+	if !s.kanon.Allow(cspReport.CspReport.DocumentURI, gi.Country, r.UserAgent(), s.privacyOpts.visitor(r, time.Now())) {
+		s.drop(w, r, "kanon")
 		return
 	}
 
-	cspRequest := &saver.CSPRequest{
-		HttpRemote: &saver.HTTPRemote{
-			Timestamp: time.Now().Format(time.RFC3339),
-			Remote:    remote,
-			UserAgent: r.UserAgent(),
-			Referrer:  r.Referer(),
-		},
-		Disposition:        cspReport.CspReport.Disposition,
-		BlockedUri:         cspReport.CspReport.BlockedURI,
-		SourceFile:         cspReport.CspReport.SourceFile,
-		DocumentUri:        cspReport.CspReport.DocumentURI,
-		ViolatedDirective:  cspReport.CspReport.ViolatedDirective,
-		EffectiveDirective: cspReport.CspReport.EffectiveDirective,
-		StatusCode:         cspReport.CspReport.StatusCode,
-		LineNumber:         cspReport.CspReport.LineNumber,
+	span.SetAttributes(
+		label.String("csp.directive", cspReport.directive()),
+		label.String("csp.disposition", cspReport.disposition()),
+		label.String("csp.blocked_host", hostOf(cspReport.CspReport.BlockedURI)),
+		label.Int64("csp.report_size", r.ContentLength),
+	)
+	span.SetAttributes(
+		label.String("csp.class", class),
+		label.String("csp.fingerprint", fingerprint),
+	)
+	s.top.Add("violation", cspReport.blockedSource(), time.Now())
+	s.top.Add("directive", cspReport.directive(), time.Now())
+	if s.geoOpts.db != "" {
+		s.countryCSP.WithLabelValues(countryLabel(gi.Country)).Inc()
 	}
+	incWithExemplar(ctx, s.violations.WithLabelValues(s.tenantValues(r,
+		s.directives.label(cspReport.directive()),
+		cspReport.disposition(),
+		class,
+	)...), "fingerprint", fingerprint)
+
+	cspRequest.DocumentUri = s.normalize.url(cspRequest.DocumentUri, "")
 
-	_, err = s.client.CSP(ctx, cspRequest)
+	// not in the saver schema
+	md := metadata.Pairs("csp-class", class, "csp-fingerprint", fingerprint)
+	if cspReport.CspReport.ScriptSample != "" {
+		md.Append("csp-script-sample-bin", s.privacyOpts.scrubText(cspReport.CspReport.ScriptSample))
+	}
+	if rate < 1 {
+		md.Append("sample-rate", strconv.FormatFloat(rate, 'g', -1, 64))
+	}
+	appendTags(md, tags)
+	if site != "" {
+		md.Append("tenant", site)
+	}
+	ctx, msg, ok := s.process(ctx, w, r, &event{r: r, handler: handlerName(r), msg: cspRequest, md: md})
+	if !ok {
+		return
+	}
+	cspRequest, ok = msg.(*saver.CSPRequest)
+	if !ok {
+		s.response.httpError(ctx, w, http.StatusInternalServerError, fmt.Errorf("pipeline returned %T", msg))
+		s.count(r, "process-error")
+		return
+	}
+	if s.rollup.enabled() {
+		s.rollup.CSP(fingerprint, class, cspRequest)
+		s.count(r, "rollup")
+		s.response.accepted(w)
+		return
+	}
+	_, err := s.client.CSP(ctx, cspRequest)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		s.log.Error().Str("handler", h).Err(err).Msg("write to saver")
+		s.response.httpError(ctx, w, http.StatusInternalServerError, err)
+		log.Error().Err(err).Msg("write to saver")
+		s.count(r, "forward-error")
 		return
 	}
-	w.WriteHeader(http.StatusNoContent)
+	s.dedup.Forwarded(ctx, dedupKey, cspRequest, time.Now())
+	s.forwarded(ctx, r, cspRequest)
+	s.count(r, "success")
+	s.response.accepted(w)
 }
 
 func (s *Server) beacon(w http.ResponseWriter, r *http.Request) {
-	ctx, span := s.tracer.Start(r.Context(), "beacon")
+	ctx, span := s.traceOpts.tracer("beacon").Start(r.Context(), "beacon")
 	defer span.End()
 
-	h := r.URL.Path
-	remote := r.Header.Get("x-forwarded-for")
-	if remote == "" {
-		remote = r.RemoteAddr
+	if s.banned(ctx, w, r) || s.dnt(w, r) || s.tenant(w, r) {
+		return
+	}
+	s.collector.Beacon(w, r.WithContext(ctx))
+}
+
+// forwardBeacon takes over from the collector once a beacon is parsed
+func (s *Server) forwardBeacon(w http.ResponseWriter, r *http.Request, b collector.Beacon, beaconRequest *saver.BeaconRequest) {
+	ctx := r.Context()
+	span, log := trace.SpanFromContext(ctx), zerolog.Ctx(ctx)
+	if s.schemaOpts.mode != "off" && s.checkSchema(w, r, "beacon", formObject(r.Form)) {
+		return
+	}
+	dur, outlier, dropDur := s.beaconOpts.duration(b.DurationMs)
+	if outlier != "" {
+		s.outliers.WithLabelValues(outlier).Inc()
+		if dropDur {
+			s.drop(w, r, "duration")
+			return
+		}
+	}
+	if !s.current().allow.Allowed(r.FormValue("src")) {
+		s.drop(w, r, "domain")
+		return
+	}
+	site := s.tenantOf(r)
+	drop, tags := s.current().filter.apply(withTenant(r.FormValue, site))
+	if drop != "" {
+		s.drop(w, r, drop)
+		return
+	}
+	if s.current().spam.spam(beaconReferrer(r)) {
+		s.drop(w, r, "referrer-spam")
+		return
 	}
+	consented := s.privacyOpts.consented(r)
+	if !consented && s.privacyOpts.consent == "drop" {
+		s.drop(w, r, "consent")
+		return
+	}
+	gi := s.lookupGeo(r)
+	if !s.kanon.Allow(r.FormValue("src"), gi.Country, r.UserAgent(), s.privacyOpts.visitor(r, time.Now())) {
+		s.drop(w, r, "kanon")
+		return
+	}
+	span.SetAttributes(
+		label.Int64("beacon.duration_ms", dur),
+		label.String("beacon.src_host", hostOf(r.FormValue("src"))),
+	)
+	beaconRequest.DurationMs = dur
+	if !consented {
+		beaconRequest.HttpRemote = s.httpRemote(r, true)
+	}
+	beaconRequest.SrcPage = s.normalize.url(b.Src, "")
+	beaconRequest.DstPage = s.normalize.url(b.Dst, b.Src)
 
-	// get data
-	r.ParseForm()
-	dur, err := strconv.ParseInt(strings.TrimSuffix(r.FormValue("dur"), "ms"), 10, 64)
+	md := metadata.MD{}
+	appendTags(md, tags)
+	if site != "" {
+		md.Append("tenant", site)
+	}
+	if site := r.FormValue("site"); site != "" && siteKey.MatchString(site) {
+		md.Append("site", site)
+	}
+	if vs := vitalsMetadata(beaconVitals(r)); vs != "" {
+		md.Append("vitals", vs)
+	}
+	if n, msg := s.beaconErrors(r); n > 0 {
+		s.jsErrorMetadata(ctx, n, msg, beaconStack(r), md)
+	}
+	ctx, msg, ok := s.process(ctx, w, r, &event{r: r, handler: handlerName(r), msg: beaconRequest, md: md, consented: consented})
+	if !ok {
+		return
+	}
+	beaconRequest, ok = msg.(*saver.BeaconRequest)
+	if !ok {
+		s.response.httpError(ctx, w, http.StatusInternalServerError, fmt.Errorf("pipeline returned %T", msg))
+		s.count(r, "process-error")
+		return
+	}
+	page := s.current().pages.label(r.FormValue("src"))
+	if s.rollup.enabled() {
+		s.rollup.Beacon(beaconRequest)
+		s.beaconMetrics(r, page, gi.Country, dur)
+		s.count(r, "rollup")
+		s.response.accepted(w)
+		return
+	}
+	_, err := s.client.Beacon(ctx, beaconRequest)
 	if err != nil {
-		s.log.Warn().Str("handler", h).Err(err).Msg("parse duration")
+		s.response.httpError(ctx, w, http.StatusInternalServerError, err)
+		log.Error().Err(err).Msg("write to saver")
+		s.count(r, "forward-error")
+		return
+	}
+	s.forwarded(ctx, r, beaconRequest)
+	s.beaconMetrics(r, page, gi.Country, dur)
+	s.count(r, "success")
+	s.response.accepted(w)
+}
+
+func (s *Server) beaconMetrics(r *http.Request, page, country string, durMs int64) {
+	now, site, visitor := time.Now(), s.siteLabel(r), s.privacyOpts.visitor(r, time.Now())
+	s.uniques.Add(site, page, visitor, now)
+	s.online.Seen(site, visitor, now)
+	s.top.Add("page", pageKey(s.privacyOpts.scrubURL(s.normalize.url(r.FormValue("src"), ""))), now)
+	s.beacons.WithLabelValues(s.tenantValues(r, page)...).Inc()
+	if s.geoOpts.db != "" {
+		s.countryViews.WithLabelValues(countryLabel(country)).Inc()
+	}
+	if durMs > 0 {
+		s.beaconDur.WithLabelValues(page).Observe(float64(durMs) / 1000)
+		s.top.Duration(durMs, now)
+		s.digests.Beacon(page, durMs)
+	}
+	for name, v := range beaconVitals(r) {
+		if name == "cls" {
+			s.cls.WithLabelValues(page).Observe(v)
+			continue
+		}
+		s.vitals.WithLabelValues(page, name).Observe(v / 1000)
 	}
-	beaconRequest := &saver.BeaconRequest{
-		HttpRemote: &saver.HTTPRemote{
-			Timestamp: time.Now().Format(time.RFC3339),
-			Remote:    remote,
-			UserAgent: r.UserAgent(),
-			Referrer:  r.Referer(),
-		},
-		DurationMs: dur,
-		SrcPage:    r.FormValue("src"),
-		DstPage:    r.FormValue("dst"),
+	if n, _ := s.beaconErrors(r); n > 0 {
+		s.jsErrors.WithLabelValues(page).Add(float64(n))
 	}
+}
 
-	_, err = s.client.Beacon(ctx, beaconRequest)
+// siteLabel is the site a beacon is counted under for uniques and visitors online,
+// bounded as the page is whatever the client sends:
+// its tenant, or the allow.domains entry its page is under, other if neither
+func (s *Server) siteLabel(r *http.Request) string {
+	if site := s.tenantOf(r); site != "" {
+		return site
+	}
+	if d := s.current().allow.match(r.FormValue("src")); d != "" {
+		return d
+	}
+	return "other"
+}
+
+// beaconReferrer is where the visitor came from to the page:
+// the ref field set from document.referrer,
+// or the request's referer if it isn't just the page itself
+func beaconReferrer(r *http.Request) string {
+	if ref := r.FormValue("ref"); ref != "" {
+		return ref
+	}
+	if ref := r.Referer(); ref != r.FormValue("src") {
+		return ref
+	}
+	return ""
+}
+
+// httpRemote describes the client,
+// anonymous leaves out all identifying fields
+func (s *Server) httpRemote(r *http.Request, anonymous bool) *saver.HTTPRemote {
+	return s.privacyOpts.httpRemote(r, anonymous)
+}
+
+// dnt records and drops requests opting out of tracking if configured,
+// returning true if the request was handled
+func (s *Server) dnt(w http.ResponseWriter, r *http.Request) bool {
+	if s.privacyOpts.dnt == "ignore" || !optedOut(r) {
+		return false
+	}
+	s.dntc.WithLabelValues(handlerName(r), s.privacyOpts.dnt).Inc()
+	if s.privacyOpts.dnt == "drop" {
+		s.drop(w, r, "dnt")
+		return true
+	}
+	return false
+}
+
+func (s *Server) lookupGeo(r *http.Request) geoInfo {
+	if s.privacyOpts.minimal {
+		return geoInfo{}
+	}
+	gi, err := s.current().geo.Lookup(clientIP(r))
+	if err != nil {
+		zerolog.Ctx(r.Context()).Warn().Err(err).Msg("lookup geoip")
+	}
+	return gi
+}
+
+// forwarded makes a forwarded report available for debugging
+func (s *Server) forwarded(ctx context.Context, r *http.Request, m proto.Message) {
+	rec := newRecord(ctx, handlerName(r), m)
+	s.recent.Add(rec)
+	s.tail.Publish(rec)
+}
+
+// count records the outcome of a request
+func (s *Server) count(r *http.Request, outcome string) {
+	incWithExemplar(r.Context(), s.requests.WithLabelValues(s.tenantValues(r, handlerName(r), outcome)...))
+}
+
+// reject answers reports the collector couldn't parse or validate
+func (s *Server) reject(w http.ResponseWriter, r *http.Request, outcome string, err error) {
+	var ierr *collector.InvalidError
+	if errors.As(err, &ierr) {
+		s.invalid.WithLabelValues(ierr.Reason).Inc()
+	}
+	s.response.httpError(r.Context(), w, http.StatusBadRequest, err)
+	s.count(r, outcome)
+	s.strike(r.Context(), r)
+}
+
+// drop accepts and discards a request
+func (s *Server) drop(w http.ResponseWriter, r *http.Request, reason string) {
+	s.audit(r, reason)
+	s.count(r, "dropped")
+	s.response.accepted(w)
+}
+
+// audit records why a report wasn't forwarded
+func (s *Server) audit(r *http.Request, reason string) {
+	s.droppedc.WithLabelValues(s.tenantValues(r, handlerName(r), reason)...).Inc()
+	if s.auditLvl == zerolog.Disabled {
+		return
+	}
+	zerolog.Ctx(r.Context()).WithLevel(s.auditLvl).
+		Str("reason", reason).
+		Str("client", s.httpRemote(r, false).Remote).
+		Str("user_agent", uaFamily(r.UserAgent())).
+		Msg("dropped")
+}
+
+// hostOf is the host of u if it's a url,
+// or u itself for keywords like inline, eval
+func hostOf(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil || pu.Host == "" {
+		return u
+	}
+	return pu.Host
+}
+
+// banned writes a response and returns true if the client is banned
+func (s *Server) banned(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	banned, err := s.bans.Banned(ctx, clientIP(r))
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		s.log.Error().Str("handler", h).Err(err).Msg("write to saver")
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("check ban")
+		return false
+	}
+	if banned {
+		s.abuse.blocked.Inc()
+		s.audit(r, "banned")
+		s.count(r, "banned")
+		s.response.httpError(ctx, w, http.StatusTooManyRequests, nil)
+	}
+	return banned
+}
+
+// strike records a bad request from the client
+func (s *Server) strike(ctx context.Context, r *http.Request) {
+	s.abuse.strikes.Inc()
+	client := clientIP(r)
+	banned, err := s.bans.Strike(ctx, client)
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("record strike")
 		return
 	}
-	w.WriteHeader(http.StatusNoContent)
+	if banned {
+		s.abuse.bans.Inc()
+		zerolog.Ctx(r.Context()).Warn().Str("client", client).Msg("client banned")
+	}
 }
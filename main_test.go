@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"go.seankhliao.com/apis/saver/v1"
+	"go.seankhliao.com/usvc"
+	"google.golang.org/grpc"
+)
+
+// recordSaver keeps the records it's sent
+type recordSaver struct {
+	dryRunSaver
+	mu   sync.Mutex
+	csp  []*saver.CSPRequest
+	http []*saver.HTTPRequest
+}
+
+func (rs *recordSaver) HTTP(ctx context.Context, in *saver.HTTPRequest, opts ...grpc.CallOption) (*saver.HTTPResponse, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.http = append(rs.http, in)
+	return &saver.HTTPResponse{}, nil
+}
+
+func (rs *recordSaver) CSP(ctx context.Context, in *saver.CSPRequest, opts ...grpc.CallOption) (*saver.CSPResponse, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.csp = append(rs.csp, in)
+	return &saver.CSPResponse{}, nil
+}
+
+var testServers int32
+
+// newTestServer runs Setup with args as a usvc service would,
+// usvc's own service handler fails the test if it's still in place.
+// Each server gets its own metric namespace, registration is global.
+func newTestServer(t *testing.T, args ...string) (*Server, http.Handler, *recordSaver) {
+	t.Helper()
+	s := &Server{}
+	fs := newFlagSet("statslogger", s)
+	n := atomic.AddInt32(&testServers, 1)
+	err := fs.Parse(append([]string{"-dry-run", fmt.Sprintf("-metrics.namespace=test%d", n)}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	u := &usvc.USVC{
+		Logger:     zerolog.Nop(),
+		ServiceMux: http.NewServeMux(),
+		MetricMux:  http.NewServeMux(),
+		ServiceServer: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("usvc handler served %s", r.URL.Path)
+		})},
+		MetricServer: &http.Server{},
+	}
+	err = s.Setup(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &recordSaver{}
+	s.client = rs
+	return s, u.ServiceServer.Handler, rs
+}
+
+func TestNoRawRemote(t *testing.T) {
+	_, h, rs := newTestServer(t, "-privacy.ip=hash")
+	req := httptest.NewRequest("POST", "/csp", strings.NewReader(`{"csp-report":{
+		"document-uri":"https://example.com/",
+		"violated-directive":"script-src",
+		"blocked-uri":"https://evil.example/x.js"
+	}}`))
+	req.RemoteAddr = "203.0.113.7:4321"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if len(rs.http) > 0 {
+		t.Errorf("sent %d http records", len(rs.http))
+	}
+	if len(rs.csp) != 1 {
+		t.Fatalf("sent %d csp records, status %d", len(rs.csp), w.Code)
+	}
+	if remote := rs.csp[0].HttpRemote.Remote; strings.Contains(remote, "203.0.113.7") {
+		t.Errorf("raw remote forwarded: %s", remote)
+	}
+}
+
+func TestCSPWithoutDirective(t *testing.T) {
+	_, h, rs := newTestServer(t)
+	req := httptest.NewRequest("POST", "/csp", strings.NewReader(`{"csp-report":{
+		"document-uri":"https://example.com/",
+		"violated-directive":"",
+		"effective-directive":"",
+		"blocked-uri":"inline"
+	}}`))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code >= 300 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if len(rs.csp) != 1 {
+		t.Errorf("sent %d csp records", len(rs.csp))
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type metricOpts struct {
+	namespace string
+	subsystem string
+	labels    stringList
+}
+
+func (o *metricOpts) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.namespace, "metrics.namespace", "statslogger", "prefix for exported metric names")
+	fs.StringVar(&o.subsystem, "metrics.subsystem", "", "added after metrics.namespace in exported metric names")
+	fs.Var(&o.labels, "metrics.labels", "comma separated name=value labels added to all exported metrics, eg site=example,env=prod")
+}
+
+// factory registers metrics with the configured prefix and constant labels
+func (o metricOpts) factory() (promauto.Factory, error) {
+	var prefix string
+	for _, p := range []string{o.namespace, o.subsystem} {
+		if p == "" {
+			continue
+		}
+		if !metricNameRe.MatchString(p) {
+			return promauto.Factory{}, fmt.Errorf("invalid metric name part: %q", p)
+		}
+		prefix += p + "_"
+	}
+	labels := make(prometheus.Labels)
+	for _, kv := range o.labels {
+		i := strings.Index(kv, "=")
+		if i < 0 || !metricNameRe.MatchString(kv[:i]) || strings.HasPrefix(kv[:i], "__") {
+			return promauto.Factory{}, fmt.Errorf("invalid metric label: %q", kv)
+		}
+		labels[kv[:i]] = kv[i+1:]
+	}
+
+	var reg prometheus.Registerer = prometheus.DefaultRegisterer
+	if len(labels) > 0 {
+		reg = prometheus.WrapRegistererWith(labels, reg)
+	}
+	reg = prometheus.WrapRegistererWithPrefix(prefix, reg)
+	return promauto.With(reg), nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// mmdb is a reader for MaxMind DB files
+// https://maxmind.github.io/MaxMind-DB/
+type mmdb struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint
+	ipv4Start  uint
+	meta       map[string]interface{}
+}
+
+var mmdbMetaStart = []byte("\xab\xcd\xefMaxMind.com")
+
+func openMMDB(fn string) (*mmdb, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("read mmdb %s: %w", fn, err)
+	}
+	i := bytes.LastIndex(b, mmdbMetaStart)
+	if i < 0 {
+		return nil, fmt.Errorf("read mmdb %s: metadata not found", fn)
+	}
+	d := &mmdb{buf: b}
+	mv, _, err := d.decode(b[i+len(mmdbMetaStart):], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("read mmdb %s metadata: %w", fn, err)
+	}
+	var ok bool
+	d.meta, ok = mv.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("read mmdb %s: metadata not a map", fn)
+	}
+	nodeCount := toUint(d.meta["node_count"])
+	d.recordSize = uint(toUint(d.meta["record_size"]))
+	d.ipVersion = uint(toUint(d.meta["ip_version"]))
+	switch d.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("read mmdb %s: unsupported record size %d", fn, d.recordSize)
+	}
+	// checked before multiplying so it can't overflow
+	if nodeCount > uint64(len(b)) {
+		return nil, fmt.Errorf("read mmdb %s: truncated search tree", fn)
+	}
+	d.nodeCount = uint(nodeCount)
+	d.dataStart = d.nodeCount*d.recordSize/4 + 16
+	if d.dataStart > uint(i) {
+		return nil, fmt.Errorf("read mmdb %s: truncated search tree", fn)
+	}
+
+	if d.ipVersion == 6 {
+		for i := 0; i < 96 && d.ipv4Start < d.nodeCount; i++ {
+			d.ipv4Start = d.record(d.ipv4Start, 0)
+		}
+	}
+	return d, nil
+}
+
+// Lookup returns the decoded record for ip, nil if not found
+func (d *mmdb) Lookup(ip net.IP) (interface{}, error) {
+	var node uint
+	bits := []byte(ip.To4())
+	if bits != nil {
+		node = d.ipv4Start
+	} else if d.ipVersion == 6 {
+		bits = ip.To16()
+	}
+	if bits == nil {
+		return nil, nil
+	}
+	for i := 0; i < len(bits)*8 && node < d.nodeCount; i++ {
+		node = d.record(node, uint(bits[i/8]>>(7-uint(i%8))&1))
+	}
+	if node <= d.nodeCount {
+		return nil, nil
+	} else if node < d.nodeCount+16 {
+		return nil, fmt.Errorf("mmdb: record %d points into the data separator", node)
+	}
+	v, _, err := d.decode(d.buf[d.dataStart:], node-d.nodeCount-16, 0)
+	return v, err
+}
+
+// record is the left (0) or right (1) record of node,
+// in bounds as node < nodeCount and the tree fits before dataStart
+func (d *mmdb) record(node, bit uint) uint {
+	b := d.buf[node*d.recordSize/4:]
+	switch d.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+var errMMDBShort = errors.New("mmdb: unexpected end of data")
+
+// decode the value at off in data, returning the offset after it
+func (d *mmdb) decode(data []byte, off uint, depth int) (interface{}, uint, error) {
+	if depth > 64 {
+		return nil, 0, errors.New("mmdb: data nested too deeply")
+	}
+	if off >= uint(len(data)) {
+		return nil, 0, errMMDBShort
+	}
+	ctrl := data[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+		if off+ss+1 > uint(len(data)) {
+			return nil, 0, errMMDBShort
+		}
+		var p uint
+		switch ss {
+		case 0:
+			p = vvv<<8 | uint(data[off])
+		case 1:
+			p = (vvv<<16 | uint(data[off])<<8 | uint(data[off+1])) + 2048
+		case 2:
+			p = (vvv<<24 | uint(data[off])<<16 | uint(data[off+1])<<8 | uint(data[off+2])) + 526336
+		case 3:
+			p = uint(binary.BigEndian.Uint32(data[off:]))
+		}
+		v, _, err := d.decode(data, p, depth+1)
+		return v, off + ss + 1, err
+	}
+	if typ == 0 {
+		if off >= uint(len(data)) {
+			return nil, 0, errMMDBShort
+		}
+		typ = 7 + uint(data[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(data)) {
+			return nil, 0, errMMDBShort
+		}
+		var s uint
+		for _, c := range data[off : off+n] {
+			s = s<<8 | uint(c)
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + s
+		case 2:
+			size = 285 + s
+		case 3:
+			size = 65821 + s
+		}
+	}
+
+	// every entry takes at least a byte,
+	// don't let a bad size allocate more than the data could hold
+	if (typ == 7 || typ == 11) && size > uint(len(data))-off {
+		return nil, 0, errMMDBShort
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(data, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := d.decode(data, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			ks, _ := k.(string)
+			m[ks] = v
+			off = next
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(data, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case 14: // bool
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(data)) {
+		return nil, 0, errMMDBShort
+	}
+	b := data[off : off+size]
+	off += size
+	switch typ {
+	case 2: // string
+		return string(b), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("mmdb: bad double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 4: // bytes
+		return append([]byte(nil), b...), off, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128 (truncated)
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, off, nil
+	case 8: // int32
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		return int64(int32(u)), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("mmdb: bad float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unsupported type %d", typ)
+}
+
+func toUint(v interface{}) uint64 {
+	u, _ := v.(uint64)
+	return u
+}
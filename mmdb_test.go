@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// mmdbEnc writes the types of the mmdb data section the tests need
+type mmdbEnc struct{ bytes.Buffer }
+
+func (e *mmdbEnc) ctrl(typ, size int) {
+	if typ > 7 {
+		e.WriteByte(byte(size))
+		e.WriteByte(byte(typ - 7))
+		return
+	}
+	e.WriteByte(byte(typ<<5 | size))
+}
+
+func (e *mmdbEnc) str(s string) {
+	e.ctrl(2, len(s))
+	e.WriteString(s)
+}
+
+func (e *mmdbEnc) uint32(u uint32) {
+	e.ctrl(6, 4)
+	e.Write([]byte{byte(u >> 24), byte(u >> 16), byte(u >> 8), byte(u)})
+}
+
+func (e *mmdbEnc) value(v interface{}) {
+	switch v := v.(type) {
+	case string:
+		e.str(v)
+	case uint32:
+		e.uint32(v)
+	case map[string]interface{}:
+		e.ctrl(7, len(v))
+		var ks []string
+		for k := range v {
+			ks = append(ks, k)
+		}
+		sort.Strings(ks)
+		for _, k := range ks {
+			e.str(k)
+			e.value(v[k])
+		}
+	case []interface{}:
+		e.ctrl(11, len(v))
+		for _, x := range v {
+			e.value(x)
+		}
+	}
+}
+
+// testMMDB is an ipv4 database with 24 bit records, mapping 1.0.0.0/8 to rec
+func testMMDB(rec map[string]interface{}) []byte {
+	const prefix, nodeCount = 0x01, 8
+	var tree []byte
+	for i := 0; i < nodeCount; i++ {
+		var recs [2]uint32
+		bit := prefix >> (7 - i) & 1
+		recs[1-bit] = nodeCount // empty
+		recs[bit] = uint32(i + 1)
+		if i == nodeCount-1 {
+			recs[bit] = nodeCount + 16 // data at offset 0
+		}
+		for _, r := range recs {
+			tree = append(tree, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	var data, meta mmdbEnc
+	data.value(rec)
+	meta.value(map[string]interface{}{
+		"node_count":  uint32(nodeCount),
+		"record_size": uint32(24),
+		"ip_version":  uint32(4),
+	})
+
+	var b bytes.Buffer
+	b.Write(tree)
+	b.Write(make([]byte, 16))
+	b.Write(data.Bytes())
+	b.Write(mmdbMetaStart)
+	b.Write(meta.Bytes())
+	return b.Bytes()
+}
+
+func writeMMDB(t *testing.T, b []byte) string {
+	dir, err := ioutil.TempDir("", "statslogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fn := filepath.Join(dir, "test.mmdb")
+	err = ioutil.WriteFile(fn, b, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+var testMMDBRecord = map[string]interface{}{
+	"country":      map[string]interface{}{"iso_code": "AU"},
+	"subdivisions": []interface{}{map[string]interface{}{"iso_code": "NSW"}},
+}
+
+func TestMMDBLookup(t *testing.T) {
+	d, err := openMMDB(writeMMDB(t, testMMDB(testMMDBRecord)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want interface{}
+	}{
+		{"1.2.3.4", map[string]interface{}{
+			"country":      map[string]interface{}{"iso_code": "AU"},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "NSW"}},
+		}},
+		{"1.255.255.255", map[string]interface{}{
+			"country":      map[string]interface{}{"iso_code": "AU"},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "NSW"}},
+		}},
+		{"2.0.0.1", nil},
+		{"0.1.0.0", nil},
+		{"2001:db8::1", nil},
+	}
+	for _, tt := range tests {
+		got, err := d.Lookup(net.ParseIP(tt.ip))
+		if err != nil {
+			t.Errorf("Lookup(%s): %v", tt.ip, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if got := mmdbPath(mustLookup(t, d, "1.2.3.4"), "subdivisions", 0, "iso_code"); got != "NSW" {
+		t.Errorf("subdivision = %v", got)
+	}
+}
+
+func mustLookup(t *testing.T, d *mmdb, ip string) interface{} {
+	v, err := d.Lookup(net.ParseIP(ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestMMDBInvalid(t *testing.T) {
+	valid := testMMDB(testMMDBRecord)
+	metaAt := bytes.LastIndex(valid, mmdbMetaStart)
+	meta := func(m map[string]interface{}) []byte {
+		var e mmdbEnc
+		e.value(m)
+		return append(append(append([]byte(nil), valid[:metaAt]...), mmdbMetaStart...), e.Bytes()...)
+	}
+	tests := map[string][]byte{
+		"empty":               nil,
+		"no metadata":         valid[:metaAt],
+		"short metadata":      valid[:len(valid)-3],
+		"record size":         meta(map[string]interface{}{"node_count": uint32(8), "record_size": uint32(20), "ip_version": uint32(4)}),
+		"node count overflow": meta(map[string]interface{}{"node_count": uint32(0xffffffff), "record_size": uint32(32), "ip_version": uint32(6)}),
+		"tree past metadata":  meta(map[string]interface{}{"node_count": uint32(metaAt), "record_size": uint32(24), "ip_version": uint32(4)}),
+		// map claiming 2^24 entries
+		"huge map": append(append([]byte(nil), mmdbMetaStart...), 7<<5|31, 0xff, 0xff, 0xff),
+	}
+	for name, b := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := openMMDB(writeMMDB(t, b)); err == nil {
+				t.Error("openMMDB = nil, want error")
+			}
+		})
+	}
+}
+
+// TestMMDBCorrupt checks every single byte corruption is an error or a result, never a panic
+func TestMMDBCorrupt(t *testing.T) {
+	valid := testMMDB(testMMDBRecord)
+	dir, err := ioutil.TempDir("", "statslogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "test.mmdb")
+	for i := range valid {
+		for _, c := range []byte{0x00, 0xff, valid[i] ^ 0x80, valid[i] + 1} {
+			b := append([]byte(nil), valid...)
+			b[i] = c
+			err = ioutil.WriteFile(fn, b, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := openMMDB(fn)
+			if err != nil {
+				continue
+			}
+			for _, ip := range []string{"1.2.3.4", "2.0.0.1", "0.0.0.0", "255.255.255.255"} {
+				d.Lookup(net.ParseIP(ip))
+			}
+		}
+	}
+}
+
+func TestMMDBSeparatorRecord(t *testing.T) {
+	b := testMMDB(testMMDBRecord)
+	// right record of the last node, into the 16 zero bytes before the data
+	b[7*6+3], b[7*6+4], b[7*6+5] = 0, 0, 8+5
+	d, err := openMMDB(writeMMDB(t, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Lookup(net.ParseIP("1.2.3.4")); err == nil {
+		t.Error("Lookup = nil, want error")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"net/url"
+	"strings"
+)
+
+type normalizeOpts struct {
+	enabled bool
+	paths   stringList
+}
+
+func (o *normalizeOpts) Flags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.enabled, "normalize", false, "normalize page urls (document-uri, src, dst) before forwarding: lowercase host, drop fragment and trailing slash, resolve relative urls")
+	fs.Var(&o.paths, "normalize.paths", "comma separated path patterns to collapse page paths to, :name matches a segment, eg /post/:id")
+}
+
+// url normalizes u, resolving it against base if relative.
+// Unparseable urls are left as is
+func (o normalizeOpts) url(u, base string) string {
+	if !o.enabled || u == "" {
+		return u
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	if !pu.IsAbs() && base != "" {
+		bu, err := url.Parse(base)
+		if err == nil && bu.IsAbs() {
+			pu = bu.ResolveReference(pu)
+		}
+	}
+	pu.Host = strings.ToLower(pu.Host)
+	pu.Fragment = ""
+	if len(pu.Path) > 1 {
+		pu.Path = strings.TrimRight(pu.Path, "/")
+		if pu.Path == "" {
+			pu.Path = "/"
+		}
+		pu.RawPath = ""
+	}
+	if p, ok := o.collapse(pu.Path); ok {
+		pu.Path, pu.RawPath = p, ""
+	}
+	return pu.String()
+}
+
+// collapse matches p against the configured patterns,
+// returning the first matching one
+func (o normalizeOpts) collapse(p string) (string, bool) {
+	segs := strings.Split(p, "/")
+	for _, pat := range o.paths {
+		psegs := strings.Split(pat, "/")
+		if len(psegs) != len(segs) {
+			continue
+		}
+		match := true
+		for i, ps := range psegs {
+			if !strings.HasPrefix(ps, ":") && ps != segs[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return pat, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type onlineOpts struct {
+	window time.Duration
+}
+
+func (o *onlineOpts) Flags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.window, "online.window", 5*time.Minute, "visitors with a beacon in this window are counted as online, 0 to disable")
+}
+
+// online tracks visitors seen recently per site
+type online struct {
+	onlineOpts
+	gauge *prometheus.GaugeVec
+
+	mu   sync.Mutex
+	seen map[uniqueKey]time.Time // site, visitor token
+}
+
+func newOnline(ctx context.Context, o onlineOpts, f promauto.Factory) *online {
+	on := &online{
+		onlineOpts: o,
+		gauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "visitors_online",
+		}, []string{"site"}),
+		seen: make(map[uniqueKey]time.Time),
+	}
+	if o.window > 0 {
+		go on.run(ctx)
+	}
+	return on
+}
+
+// Seen records a visitor on site at t
+func (on *online) Seen(site, visitor string, t time.Time) {
+	if on.window <= 0 {
+		return
+	}
+	on.mu.Lock()
+	defer on.mu.Unlock()
+	on.seen[uniqueKey{site, visitor}] = t
+}
+
+// Count is the number of visitors per site in the window before now,
+// forgetting older ones
+func (on *online) Count(now time.Time) map[string]int {
+	on.mu.Lock()
+	defer on.mu.Unlock()
+	counts := make(map[string]int)
+	for k, t := range on.seen {
+		if now.Sub(t) > on.window {
+			delete(on.seen, k)
+			continue
+		}
+		counts[k.site]++
+	}
+	return counts
+}
+
+func (on *online) run(ctx context.Context) {
+	t := time.NewTicker(15 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			counts := on.Count(now)
+			on.gauge.Reset()
+			for site, n := range counts {
+				on.gauge.WithLabelValues(site).Set(float64(n))
+			}
+		}
+	}
+}
+
+func (on *online) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	counts := on.Count(time.Now())
+	var total int
+	for _, n := range counts {
+		total += n
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Window   string         `json:"window"`
+		Visitors int            `json:"visitors"`
+		Sites    map[string]int `json:"sites"`
+	}{on.window.String(), total, counts})
+}
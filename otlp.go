@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+)
+
+type otlpOpts struct {
+	endpoint string
+	interval time.Duration
+}
+
+func (o *otlpOpts) Flags(fs *flag.FlagSet) {
+	fs.Var(withCredentials(&o.endpoint), "otlp.metrics", "OTLP/HTTP endpoint to push metrics to, eg. http://otel-collector:4318/v1/metrics, disabled if empty")
+	fs.DurationVar(&o.interval, "otlp.interval", 30*time.Second, "interval between metric pushes")
+}
+
+func (o otlpOpts) validate() error {
+	if o.endpoint != "" && o.interval <= 0 {
+		return fmt.Errorf("otlp.interval must be positive with otlp.metrics set")
+	}
+	return nil
+}
+
+// otlpExporter pushes everything in a prometheus registry as OTLP/HTTP JSON,
+// so deployments without a prometheus scraper still get metrics
+type otlpExporter struct {
+	otlpOpts
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	log      zerolog.Logger
+	start    time.Time
+}
+
+func (o otlpOpts) run(ctx context.Context, g prometheus.Gatherer, log zerolog.Logger) {
+	if o.endpoint == "" {
+		return
+	}
+	e := &otlpExporter{
+		otlpOpts: o,
+		gatherer: g,
+		client:   &http.Client{Timeout: o.interval},
+		log:      log.With().Str("module", "otlp").Logger(),
+		start:    time.Now(),
+	}
+	go func() {
+		t := time.NewTicker(o.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				err := e.push(ctx)
+				if err != nil {
+					e.log.Error().Err(err).Msg("push metrics")
+				}
+			}
+		}
+	}()
+}
+
+func (e *otlpExporter) push(ctx context.Context) error {
+	mfs, err := e.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gather: %w", err)
+	}
+	b, err := json.Marshal(e.convert(mfs, time.Now()))
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("content-type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("send: %s", res.Status)
+	}
+	return nil
+}
+
+// otlp json encoding, see opentelemetry-proto metrics/v1
+type (
+	otlpKV struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	}
+	otlpPoint struct {
+		Attributes     []otlpKV  `json:"attributes,omitempty"`
+		StartTime      string    `json:"startTimeUnixNano"`
+		Time           string    `json:"timeUnixNano"`
+		AsDouble       *float64  `json:"asDouble,omitempty"`
+		Count          string    `json:"count,omitempty"`
+		Sum            *float64  `json:"sum,omitempty"`
+		BucketCounts   []string  `json:"bucketCounts,omitempty"`
+		ExplicitBounds []float64 `json:"explicitBounds,omitempty"`
+	}
+	otlpSeries struct {
+		Temporality int         `json:"aggregationTemporality,omitempty"`
+		Monotonic   bool        `json:"isMonotonic,omitempty"`
+		Points      []otlpPoint `json:"dataPoints"`
+	}
+	otlpMetric struct {
+		Name      string      `json:"name"`
+		Help      string      `json:"description,omitempty"`
+		Sum       *otlpSeries `json:"sum,omitempty"`
+		Gauge     *otlpSeries `json:"gauge,omitempty"`
+		Histogram *otlpSeries `json:"histogram,omitempty"`
+	}
+	otlpScopeMetrics struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource struct {
+			Attributes []otlpKV `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+)
+
+const otlpCumulative = 2
+
+func otlpAttrs(kv ...string) []otlpKV {
+	var attrs []otlpKV
+	for i := 0; i+1 < len(kv); i += 2 {
+		var a otlpKV
+		a.Key, a.Value.StringValue = kv[i], kv[i+1]
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+func (e *otlpExporter) convert(mfs []*dto.MetricFamily, t time.Time) otlpRequest {
+	start, now := strconv.FormatInt(e.start.UnixNano(), 10), strconv.FormatInt(t.UnixNano(), 10)
+	var metrics []otlpMetric
+	for _, mf := range mfs {
+		om := otlpMetric{Name: mf.GetName(), Help: mf.GetHelp()}
+		series := &otlpSeries{}
+		for _, m := range mf.GetMetric() {
+			var kv []string
+			for _, lp := range m.GetLabel() {
+				kv = append(kv, lp.GetName(), lp.GetValue())
+			}
+			p := otlpPoint{Attributes: otlpAttrs(kv...), StartTime: start, Time: now}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				v := m.GetCounter().GetValue()
+				p.AsDouble = &v
+			case dto.MetricType_GAUGE:
+				v := m.GetGauge().GetValue()
+				p.AsDouble = &v
+			case dto.MetricType_UNTYPED:
+				v := m.GetUntyped().GetValue()
+				p.AsDouble = &v
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				sum := h.GetSampleSum()
+				p.Count, p.Sum = strconv.FormatUint(h.GetSampleCount(), 10), &sum
+				var prev uint64
+				for _, b := range h.GetBucket() {
+					p.ExplicitBounds = append(p.ExplicitBounds, b.GetUpperBound())
+					p.BucketCounts = append(p.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-prev, 10))
+					prev = b.GetCumulativeCount()
+				}
+				p.BucketCounts = append(p.BucketCounts, strconv.FormatUint(h.GetSampleCount()-prev, 10))
+			default:
+				// summaries have no otlp equivalent worth converting
+				continue
+			}
+			series.Points = append(series.Points, p)
+		}
+		if len(series.Points) == 0 {
+			continue
+		}
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			series.Temporality, series.Monotonic = otlpCumulative, true
+			om.Sum = series
+		case dto.MetricType_HISTOGRAM:
+			series.Temporality = otlpCumulative
+			om.Histogram = series
+		default:
+			om.Gauge = series
+		}
+		metrics = append(metrics, om)
+	}
+
+	var sm otlpScopeMetrics
+	sm.Scope.Name = name
+	sm.Metrics = metrics
+	var rm otlpResourceMetrics
+	rm.Resource.Attributes = otlpAttrs("service.name", "statslogger")
+	rm.ScopeMetrics = []otlpScopeMetrics{sm}
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{rm}}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// pageList maps urls to a bounded set of page labels,
+// entries are path.Match patterns and the matching pattern is the label
+type pageList []string
+
+func (l pageList) label(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "other"
+	}
+	p := pu.EscapedPath()
+	if p == "" {
+		p = "/"
+	} else if len(p) > 1 {
+		p = strings.TrimSuffix(p, "/")
+	}
+	for _, pat := range l {
+		if ok, _ := path.Match(pat, p); ok {
+			return pat
+		}
+	}
+	return "other"
+}
+
+// pageKey is the host and path of a page, without query or fragment
+func pageKey(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil || pu.Host == "" {
+		return ""
+	}
+	return strings.ToLower(pu.Host) + pu.Path
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.seankhliao.com/apis/saver/v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// event is a report on its way to the saver
+type event struct {
+	r         *http.Request
+	handler   string
+	msg       proto.Message // saver request
+	md        metadata.MD   // sent as grpc metadata
+	consented bool
+}
+
+// Processor transforms an event before it's forwarded,
+// returning true to drop it
+type Processor interface {
+	Process(ctx context.Context, e *event) (*event, bool, error)
+}
+
+// ProcessorFunc adapts a function to a Processor
+type ProcessorFunc func(ctx context.Context, e *event) (*event, bool, error)
+
+func (f ProcessorFunc) Process(ctx context.Context, e *event) (*event, bool, error) {
+	return f(ctx, e)
+}
+
+// processors are the named processors available to -pipeline,
+// scrub and redact are always run last
+var processors = map[string]func(s *Server) Processor{
+	"redact": func(s *Server) Processor {
+		return ProcessorFunc(func(ctx context.Context, e *event) (*event, bool, error) {
+			salt := s.privacyOpts.dailySalt(time.Now())
+			s.current().redact.apply(e.msg, salt)
+			s.current().redact.applyMD(e.md, salt)
+			return e, false, nil
+		})
+	},
+	"request-id": func(s *Server) Processor {
+		return ProcessorFunc(func(ctx context.Context, e *event) (*event, bool, error) {
+			e.md.Append("request-id", requestID(ctx))
+			return e, false, nil
+		})
+	},
+	"ua": func(s *Server) Processor {
+		return ProcessorFunc(func(ctx context.Context, e *event) (*event, bool, error) {
+			if !s.privacyOpts.minimal {
+				appendMD(e.md, parseUA(e.r.UserAgent()).metadata())
+			}
+			return e, false, nil
+		})
+	},
+	"geo": func(s *Server) Processor {
+		return ProcessorFunc(func(ctx context.Context, e *event) (*event, bool, error) {
+			appendMD(e.md, s.lookupGeo(e.r).metadata())
+			return e, false, nil
+		})
+	},
+	"scrub": func(s *Server) Processor {
+		return ProcessorFunc(func(ctx context.Context, e *event) (*event, bool, error) {
+			switch m := e.msg.(type) {
+			case *saver.CSPRequest:
+				m.BlockedUri = s.privacyOpts.scrubURL(m.BlockedUri)
+				m.SourceFile = s.privacyOpts.scrubURL(m.SourceFile)
+				m.DocumentUri = s.privacyOpts.scrubURL(m.DocumentUri)
+			case *saver.BeaconRequest:
+				m.SrcPage = s.privacyOpts.scrubURL(m.SrcPage)
+				m.DstPage = s.privacyOpts.scrubURL(m.DstPage)
+			}
+			return e, false, nil
+		})
+	},
+	"referrer": func(s *Server) Processor {
+		return ProcessorFunc(func(ctx context.Context, e *event) (*event, bool, error) {
+			if _, ok := e.msg.(*saver.BeaconRequest); ok && !s.privacyOpts.minimal {
+				e.md.Append("traffic-source", s.referrers.classify(beaconReferrer(e.r), e.r.FormValue("src")))
+			}
+			return e, false, nil
+		})
+	},
+	"exec": func(s *Server) Processor {
+		return newScriptProc(s.pipelineOpts, s.log)
+	},
+	"time": func(s *Server) Processor {
+		zs, _ := s.bucketOpts.locations()
+		return bucketProc(zs)
+	},
+	"session": func(s *Server) Processor {
+		return ProcessorFunc(func(ctx context.Context, e *event) (*event, bool, error) {
+			if _, ok := e.msg.(*saver.BeaconRequest); ok && e.consented && !s.privacyOpts.minimal {
+				if id := s.sessions.ID(s.privacyOpts.visitor(e.r, time.Now()), time.Now()); id != "" {
+					e.md.Append("session-id", id)
+				}
+			}
+			return e, false, nil
+		})
+	},
+}
+
+func appendMD(md metadata.MD, kv []string) {
+	for i := 0; i+1 < len(kv); i += 2 {
+		md.Append(kv[i], kv[i+1])
+	}
+}
+
+type pipelineOpts struct {
+	names        stringList
+	exec         string
+	execTimeout  time.Duration
+	execWorkers  int
+	execFailOpen bool
+}
+
+func (o *pipelineOpts) Flags(fs *flag.FlagSet) {
+	o.names = stringList{"request-id", "ua", "geo", "time", "referrer", "session"}
+	fs.Var(&o.names, "pipeline", "comma separated processors applied in order to reports before forwarding, available: exec, geo, referrer, request-id, session, time, ua. -privacy.query and -redact are always applied after them")
+	fs.StringVar(&o.exec, "pipeline.exec", "", "command for the exec processor, reads a json event per line on stdin and writes it back, modified or with drop: true, on stdout. events are sent before -privacy.query and -redact are applied")
+	fs.DurationVar(&o.execTimeout, "pipeline.exec.timeout", time.Second, "time to wait for the exec processor to respond, it's restarted if exceeded")
+	fs.IntVar(&o.execWorkers, "pipeline.exec.workers", 2, "copies of the exec processor command to run, each handles one event at a time")
+	fs.BoolVar(&o.execFailOpen, "pipeline.exec.fail-open", false, "forward events unchanged if the exec processor fails or times out instead of failing the report")
+}
+
+func (o pipelineOpts) validate() error {
+	for _, n := range o.names {
+		if _, ok := processors[n]; !ok {
+			return fmt.Errorf("pipeline: unknown processor %s", n)
+		}
+		if n == "exec" && strings.TrimSpace(o.exec) == "" {
+			return fmt.Errorf("pipeline: exec needs pipeline.exec")
+		}
+		if n == "exec" && o.execWorkers < 1 {
+			return fmt.Errorf("pipeline.exec.workers: %d, need at least 1", o.execWorkers)
+		}
+	}
+	return nil
+}
+
+// pipeline is an ordered chain of processors
+type pipeline []Processor
+
+func (o pipelineOpts) pipeline(s *Server) (pipeline, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	var p pipeline
+	for _, n := range o.names {
+		// always run last below, wherever it is listed
+		if n == "scrub" || n == "redact" {
+			continue
+		}
+		p = append(p, processors[n](s))
+	}
+	// last so -privacy.query and -redact hold whatever -pipeline is set to
+	// and cover what the processors added
+	return append(p, processors["scrub"](s), processors["redact"](s)), nil
+}
+
+// run passes e through every processor, stopping at the first drop or error
+func (p pipeline) run(ctx context.Context, e *event) (*event, bool, error) {
+	for _, proc := range p {
+		var drop bool
+		var err error
+		e, drop, err = proc.Process(ctx, e)
+		if err != nil || drop {
+			return e, drop, err
+		}
+	}
+	return e, false, nil
+}
+
+// process runs the pipeline on e, returning a context carrying the metadata
+// and the message to forward, or false if the response was already written
+func (s *Server) process(ctx context.Context, w http.ResponseWriter, r *http.Request, e *event) (context.Context, proto.Message, bool) {
+	e, drop, err := s.pipeline.run(ctx, e)
+	if err != nil {
+		s.response.httpError(ctx, w, http.StatusInternalServerError, err)
+		zerolog.Ctx(ctx).Error().Err(err).Msg("process report")
+		s.count(r, "process-error")
+		return ctx, nil, false
+	} else if drop {
+		s.drop(w, r, "pipeline")
+		return ctx, nil, false
+	}
+	return metadata.NewOutgoingContext(ctx, e.md), e.msg, true
+}
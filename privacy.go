@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.seankhliao.com/apis/saver/v1"
+)
+
+type privacyOpts struct {
+	minimal  bool
+	ip       string
+	ipv4Bits int
+	ipv6Bits int
+	secret   string
+	dnt      string
+	consent  string
+	query    string
+	ua       string
+	scrub    bool
+	allowQ   stringList
+
+	mu      sync.Mutex
+	saltDay string
+	salt    []byte
+}
+
+func (o *privacyOpts) Flags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.minimal, "privacy.minimal", false, "forward no client details (address, user agent, referrer, location), only the reports")
+	fs.StringVar(&o.ip, "privacy.ip", "raw", "how to forward client ips: raw, truncate, hash, drop")
+	fs.IntVar(&o.ipv4Bits, "privacy.ipv4.bits", 24, "prefix length to keep of ipv4 addresses when truncating")
+	fs.IntVar(&o.ipv6Bits, "privacy.ipv6.bits", 48, "prefix length to keep of ipv6 addresses when truncating")
+	fs.StringVar(&o.dnt, "privacy.dnt", "ignore", "how to handle requests with DNT or Sec-GPC set: ignore, drop, strip")
+	fs.StringVar(&o.consent, "privacy.consent", "ignore", "how to handle beacons without consent=1: ignore, drop, aggregate (forward without client details)")
+	fs.StringVar(&o.query, "privacy.query", "keep", "how to handle query strings and fragments in forwarded urls: keep, strip, hash")
+	fs.StringVar(&o.ua, "privacy.ua", "keep", "how to forward user agents: keep (raw and parsed), parsed (only browser, os, device)")
+	fs.BoolVar(&o.scrub, "privacy.scrub", true, "redact emails, tokens, and long numbers from free text fields like script-sample")
+	fs.Var(&o.allowQ, "privacy.query.allow", "comma separated query parameters to always keep")
+	fs.Var(secretString(&o.secret), "privacy.secret", "secret to derive daily hashing salts from, shared between instances. random if empty")
+}
+
+func (o *privacyOpts) validate() error {
+	switch o.ip {
+	case "raw", "truncate", "hash", "drop":
+	default:
+		return fmt.Errorf("unknown privacy.ip mode: %s", o.ip)
+	}
+	if o.ipv4Bits < 0 || o.ipv4Bits > 32 {
+		return fmt.Errorf("privacy.ipv4.bits: %d out of range 0-32", o.ipv4Bits)
+	}
+	if o.ipv6Bits < 0 || o.ipv6Bits > 128 {
+		return fmt.Errorf("privacy.ipv6.bits: %d out of range 0-128", o.ipv6Bits)
+	}
+	switch o.dnt {
+	case "ignore", "drop", "strip":
+	default:
+		return fmt.Errorf("unknown privacy.dnt mode: %s", o.dnt)
+	}
+	switch o.consent {
+	case "ignore", "drop", "aggregate":
+	default:
+		return fmt.Errorf("unknown privacy.consent mode: %s", o.consent)
+	}
+	switch o.query {
+	case "keep", "strip", "hash":
+	default:
+		return fmt.Errorf("unknown privacy.query mode: %s", o.query)
+	}
+	switch o.ua {
+	case "keep", "parsed":
+	default:
+		return fmt.Errorf("unknown privacy.ua mode: %s", o.ua)
+	}
+	return nil
+}
+
+// httpRemote describes the client as privacy allows,
+// anonymous leaves out all identifying fields
+func (o *privacyOpts) httpRemote(r *http.Request, anonymous bool) *saver.HTTPRemote {
+	if anonymous || o.minimal || (o.dnt == "strip" && optedOut(r)) {
+		return &saver.HTTPRemote{
+			Timestamp: time.Now().Format(time.RFC3339),
+		}
+	}
+	return &saver.HTTPRemote{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Remote:    o.remote(r),
+		UserAgent: o.userAgent(r),
+		Referrer:  o.scrubURL(r.Referer()),
+	}
+}
+
+// userAgent is the raw user agent if it should be forwarded
+func (o *privacyOpts) userAgent(r *http.Request) string {
+	if o.ua == "parsed" {
+		return ""
+	}
+	return r.UserAgent()
+}
+
+// optedOut is true if the client asked not to be tracked
+func optedOut(r *http.Request) bool {
+	return r.Header.Get("dnt") == "1" || r.Header.Get("sec-gpc") == "1"
+}
+
+// remote is the client address to forward
+func (o *privacyOpts) remote(r *http.Request) string {
+	remote := clientIP(r)
+	switch o.ip {
+	case "truncate":
+		return o.truncate(remote)
+	case "hash":
+		return o.visitor(r, time.Now())
+	case "drop":
+		return ""
+	}
+	return remote
+}
+
+// truncate masks an ip (with optional port) to the configured prefix
+func (o *privacyOpts) truncate(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(o.ipv4Bits, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(o.ipv6Bits, 128)).String()
+}
+
+// visitor is a token identifying a client for the current (UTC) day
+func (o *privacyOpts) visitor(r *http.Request, t time.Time) string {
+	m := hmac.New(sha256.New, o.dailySalt(t))
+	m.Write([]byte(clientIP(r)))
+	m.Write([]byte{0})
+	m.Write([]byte(r.UserAgent()))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// dailySalt rotates at midnight UTC,
+// random salts are forgotten once rotated
+func (o *privacyOpts) dailySalt(t time.Time) []byte {
+	day := t.UTC().Format("2006-01-02")
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.saltDay == day {
+		return o.salt
+	}
+	if o.secret != "" {
+		m := hmac.New(sha256.New, []byte(o.secret))
+		m.Write([]byte(day))
+		o.salt = m.Sum(nil)
+	} else {
+		o.salt = make([]byte, 32)
+		rand.Read(o.salt)
+	}
+	o.saltDay = day
+	return o.salt
+}
+
+// consented is true if consent is not required or was given
+func (o *privacyOpts) consented(r *http.Request) bool {
+	if o.consent == "ignore" {
+		return true
+	}
+	ok, _ := strconv.ParseBool(r.FormValue("consent"))
+	return ok
+}
+
+// scrubText redacts free text if configured
+func (o *privacyOpts) scrubText(s string) string {
+	if !o.scrub {
+		return s
+	}
+	return scrubText(s)
+}
+
+// scrubURL removes or hashes query parameters not explicitly allowed,
+// and the fragment
+func (o *privacyOpts) scrubURL(u string) string {
+	if o.query == "keep" {
+		return u
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		// can't pick out the allowed parameters, drop everything after the path
+		if i := strings.IndexAny(u, "?#"); i >= 0 {
+			return u[:i]
+		}
+		return u
+	}
+	if pu.RawQuery == "" && pu.Fragment == "" {
+		return u
+	}
+	pu.Fragment = ""
+	q := pu.Query()
+	for k, vs := range q {
+		if o.queryAllowed(k) {
+			continue
+		}
+		if o.query == "strip" {
+			delete(q, k)
+			continue
+		}
+		for i, v := range vs {
+			m := hmac.New(sha256.New, o.dailySalt(time.Now()))
+			m.Write([]byte(v))
+			vs[i] = hex.EncodeToString(m.Sum(nil)[:6])
+		}
+	}
+	pu.RawQuery = q.Encode()
+	return pu.String()
+}
+
+func (o *privacyOpts) queryAllowed(k string) bool {
+	for _, a := range o.allowQ {
+		if k == a {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestScrubURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		in    string
+		want  string
+	}{
+		{"keep", "keep", "https://example.com/?token=secret", "https://example.com/?token=secret"},
+		{"strip allowed", "strip", "https://example.com/p?token=secret&utm_source=x#frag", "https://example.com/p?utm_source=x"},
+		{"no query", "strip", "https://example.com/p", "https://example.com/p"},
+		{"unparseable query", "strip", "https://example.com/%zz?token=secret&email=a@b.c", "https://example.com/%zz"},
+		{"unparseable fragment", "hash", "https://example.com/%zz#email=a@b.c", "https://example.com/%zz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &privacyOpts{query: tt.query, allowQ: stringList{"utm_source"}}
+			if got := o.scrubURL(tt.in); got != tt.want {
+				t.Errorf("scrubURL(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
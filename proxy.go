@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.seankhliao.com/usvc"
+)
+
+type proxyOpts struct {
+	upstream string
+	base     string
+	maxAge   time.Duration
+	nel      bool
+	csp      string
+}
+
+func (o *proxyOpts) Flags(fs *flag.FlagSet) {
+	fs.Var(withCredentials(&o.upstream), "proxy.upstream", "url to reverse proxy paths not handled by statslogger to, adding reporting headers to responses, disabled if empty")
+	fs.StringVar(&o.base, "proxy.base", "", "public origin reports are sent to in the added headers, eg https://example.com, proxy.upstream's scheme and host if empty")
+	fs.DurationVar(&o.maxAge, "proxy.max-age", 24*time.Hour, "how long browsers keep the added Report-To and NEL policies")
+	fs.BoolVar(&o.nel, "proxy.nel", true, "add NEL headers so browsers report network errors for the site")
+	fs.StringVar(&o.csp, "proxy.csp", "", "Content-Security-Policy-Report-Only to add to upstream responses without a policy")
+}
+
+func (o proxyOpts) validate() error {
+	if o.upstream == "" {
+		return nil
+	}
+	u, err := url.Parse(o.upstream)
+	if err != nil {
+		return fmt.Errorf("proxy.upstream: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("proxy.upstream: expected an absolute http(s) url, got %s", o.upstream)
+	}
+	if o.base != "" {
+		b, err := url.Parse(o.base)
+		if err != nil || (b.Scheme != "http" && b.Scheme != "https") || b.Host == "" {
+			return fmt.Errorf("proxy.base: expected an http(s) origin, got %s", o.base)
+		}
+	}
+	if o.maxAge <= 0 {
+		return fmt.Errorf("proxy.max-age: must be positive")
+	}
+	return nil
+}
+
+// origin is where the added headers send reports,
+// fixed rather than taken from requests so cached responses can't be pointed elsewhere
+func (o proxyOpts) origin(upstream *url.URL) string {
+	if o.base != "" {
+		return strings.TrimSuffix(o.base, "/")
+	}
+	return upstream.Scheme + "://" + upstream.Host
+}
+
+// setupProxy sends everything the service mux doesn't handle to proxy.upstream,
+// skipping usvc's middleware so the site is passed through untouched
+// other than the added reporting headers
+func (s *Server) setupProxy(u *usvc.USVC) error {
+	if s.proxyOpts.upstream == "" {
+		return nil
+	}
+	target, err := url.Parse(s.proxyOpts.upstream)
+	if err != nil {
+		return fmt.Errorf("proxy.upstream: %w", err)
+	}
+	rp := httputil.NewSingleHostReverseProxy(target)
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		director(r)
+		r.Host = target.Host
+	}
+	base := s.proxyOpts.origin(target)
+	rp.ModifyResponse = func(res *http.Response) error {
+		s.proxyOpts.inject(res.Header, base+s.routeOpts.path(s.routeOpts.reports), base+s.routeOpts.path(s.routeOpts.csp))
+		return nil
+	}
+	log := s.log.With().Str("module", "proxy").Logger()
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Error().Err(err).Str("path", r.URL.Path).Msg("proxy to upstream")
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	next := u.ServiceServer.Handler
+	u.ServiceServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := u.ServiceMux.Handler(r); pattern != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rp.ServeHTTP(w, r)
+	})
+	return nil
+}
+
+// inject adds the reporting endpoints, NEL policy,
+// and report-uri/report-to to csp policies that don't report anywhere,
+// leaving whatever the upstream already configured
+func (o proxyOpts) inject(h http.Header, reports, csp string) {
+	if h.Get("reporting-endpoints") == "" {
+		h.Set("reporting-endpoints", `csp-endpoint="`+reports+`", default="`+reports+`"`)
+	}
+	if o.nel && h.Get("nel") == "" {
+		maxAge := int64(o.maxAge.Seconds())
+		// NEL only understands the older Report-To groups
+		group, _ := json.Marshal(map[string]interface{}{
+			"group":     "nel",
+			"max_age":   maxAge,
+			"endpoints": []map[string]string{{"url": reports}},
+		})
+		h.Add("report-to", string(group))
+		h.Set("nel", `{"report_to":"nel","max_age":`+strconv.FormatInt(maxAge, 10)+`}`)
+	}
+
+	var policies int
+	for _, k := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+		for i, p := range h[k] {
+			policies++
+			if !cspReports(p) {
+				h[k][i] = strings.TrimRight(strings.TrimSpace(p), ";") + "; report-uri " + csp + "; report-to csp-endpoint"
+			}
+		}
+	}
+	if policies == 0 && o.csp != "" {
+		h.Set("content-security-policy-report-only", strings.TrimRight(strings.TrimSpace(o.csp), ";")+"; report-uri "+csp+"; report-to csp-endpoint")
+	}
+}
+
+// cspReports is whether a policy already has a reporting directive
+func cspReports(policy string) bool {
+	for _, d := range strings.Split(policy, ";") {
+		f := strings.Fields(d)
+		if len(f) > 0 && (strings.EqualFold(f[0], "report-uri") || strings.EqualFold(f[0], "report-to")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.seankhliao.com/apis/saver/v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// record is a report as forwarded to the saver
+type record struct {
+	Time     time.Time         `json:"time"`
+	Handler  string            `json:"handler"`
+	Report   proto.Message     `json:"report"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func newRecord(ctx context.Context, handler string, m proto.Message) record {
+	rec := record{
+		Time:    time.Now(),
+		Handler: handler,
+		Report:  m,
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	for k, vs := range md {
+		if len(vs) > 0 {
+			if rec.Metadata == nil {
+				rec.Metadata = make(map[string]string, len(md))
+			}
+			rec.Metadata[k] = vs[len(vs)-1]
+		}
+	}
+	return rec
+}
+
+// recentRecords is a ring buffer of the last forwarded records
+type recentRecords struct {
+	mu   sync.Mutex
+	recs []record
+	next int
+	full bool
+}
+
+func newRecentRecords(n int) *recentRecords {
+	return &recentRecords{recs: make([]record, n)}
+}
+
+func (rr *recentRecords) Add(rec record) {
+	if len(rr.recs) == 0 {
+		return
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.recs[rr.next] = rec
+	rr.next = (rr.next + 1) % len(rr.recs)
+	if rr.next == 0 {
+		rr.full = true
+	}
+}
+
+// Records returns the buffered records, newest first
+func (rr *recentRecords) Records() []record {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	n := rr.next
+	if rr.full {
+		n = len(rr.recs)
+	}
+	out := make([]record, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, rr.recs[(rr.next-i+len(rr.recs))%len(rr.recs)])
+	}
+	return out
+}
+
+// recordQuery selects records, zero values match everything
+type recordQuery struct {
+	handler     string // csp or beacon
+	since       time.Time
+	until       time.Time
+	fingerprint string
+	page        string // substring of the page url
+	text        string // case insensitive substring of any url or the script sample
+	limit       int
+}
+
+// parseRecordQuery reads ?type=&since=&until=&fingerprint=&page=&q=&limit=,
+// since and until are RFC3339 times or durations before now
+func parseRecordQuery(r *http.Request, now time.Time) (recordQuery, error) {
+	q := recordQuery{
+		handler:     r.FormValue("type"),
+		fingerprint: r.FormValue("fingerprint"),
+		page:        r.FormValue("page"),
+		text:        strings.ToLower(r.FormValue("q")),
+	}
+	for _, t := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &q.since}, {"until", &q.until}} {
+		var err error
+		*t.dst, err = parseSince(t.name, r.FormValue(t.name), now)
+		if err != nil {
+			return q, err
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("limit: invalid %q", v)
+		}
+		q.limit = n
+	}
+	return q, nil
+}
+
+// parseSince reads an RFC3339 time or a duration before now, zero if empty
+func parseSince(name, v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), nil
+	} else if ts, err := time.Parse(time.RFC3339, v); err == nil {
+		return ts, nil
+	}
+	return time.Time{}, fmt.Errorf("%s: expected RFC3339 time or duration: %q", name, v)
+}
+
+func (q recordQuery) match(rec record) bool {
+	switch {
+	case q.handler != "" && strings.TrimPrefix(rec.Handler, "/") != q.handler:
+		return false
+	case !q.since.IsZero() && rec.Time.Before(q.since):
+		return false
+	case !q.until.IsZero() && rec.Time.After(q.until):
+		return false
+	case q.fingerprint != "" && rec.Metadata["csp-fingerprint"] != q.fingerprint:
+		return false
+	}
+	if q.text != "" && !strings.Contains(strings.ToLower(strings.Join(recordText(rec), "\n")), q.text) {
+		return false
+	}
+	if q.page != "" {
+		var pages []string
+		switch m := rec.Report.(type) {
+		case *saver.CSPRequest:
+			pages = []string{m.DocumentUri}
+		case *saver.BeaconRequest:
+			pages = []string{m.SrcPage, m.DstPage}
+		}
+		for _, p := range pages {
+			if strings.Contains(p, q.page) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// recordText is the searchable text of a record
+func recordText(rec record) []string {
+	switch m := rec.Report.(type) {
+	case *saver.CSPRequest:
+		return []string{m.BlockedUri, m.DocumentUri, m.SourceFile, rec.Metadata["csp-script-sample-bin"]}
+	case *saver.BeaconRequest:
+		return []string{m.SrcPage, m.DstPage}
+	}
+	return nil
+}
+
+// Query returns the matching buffered records, newest first
+func (rr *recentRecords) Query(q recordQuery) []record {
+	out := []record{}
+	for _, rec := range rr.Records() {
+		if q.limit > 0 && len(out) >= q.limit {
+			break
+		}
+		if q.match(rec) {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// ServeHTTP serves the buffered records, filtered by the query parameters,
+// the saver has no read api so this is limited to what is still buffered
+func (rr *recentRecords) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseRecordQuery(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(rr.Query(q))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// redactRules is a flag value of comma separated field=action rules,
+// applied to every record sent to the saver and its metadata.
+// fields are the saver field names, eg. user_agent, blocked_uri,
+// or metadata keys, eg. session-id
+// actions are drop, hash, truncate:n (keep the first n characters)
+type redactRules []redactRule
+
+type redactRule struct {
+	field  string
+	action string
+	n      int
+}
+
+func (rs *redactRules) String() string {
+	if rs == nil {
+		return ""
+	}
+	var ss []string
+	for _, r := range *rs {
+		a := r.action
+		if a == "truncate" {
+			a += ":" + strconv.Itoa(r.n)
+		}
+		ss = append(ss, r.field+"="+a)
+	}
+	return strings.Join(ss, ",")
+}
+
+func (rs *redactRules) Set(v string) error {
+	*rs = nil
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return fmt.Errorf("redact rule %q: expected field=action", s)
+		}
+		r := redactRule{field: s[:i], action: s[i+1:]}
+		if strings.HasPrefix(r.action, "truncate:") {
+			n, err := strconv.Atoi(strings.TrimPrefix(r.action, "truncate:"))
+			if err != nil || n < 0 {
+				return fmt.Errorf("redact rule %q: bad truncate length", s)
+			}
+			r.action, r.n = "truncate", n
+		}
+		switch r.action {
+		case "drop", "hash", "truncate":
+		default:
+			return fmt.Errorf("redact rule %q: unknown action %s", s, r.action)
+		}
+		*rs = append(*rs, r)
+	}
+	return nil
+}
+
+// apply redacts the matching fields in m and any nested messages
+func (rs redactRules) apply(m proto.Message, salt []byte) {
+	if len(rs) == 0 {
+		return
+	}
+	rs.applyReflect(m.ProtoReflect(), salt)
+}
+
+func (rs redactRules) applyReflect(m protoreflect.Message, salt []byte) {
+	// modify after iterating, mutating in Range is undefined
+	var edits []func()
+	defer func() {
+		for _, e := range edits {
+			e()
+		}
+	}()
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Kind() == protoreflect.MessageKind && !fd.IsList() && !fd.IsMap() {
+			rs.applyReflect(v.Message(), salt)
+			return true
+		}
+		for _, r := range rs {
+			if r.field != string(fd.Name()) {
+				continue
+			}
+			if r.action == "drop" || fd.Kind() != protoreflect.StringKind {
+				edits = append(edits, func() { m.Clear(fd) })
+				continue
+			}
+			s := r.redact(v.String(), salt)
+			edits = append(edits, func() { m.Set(fd, protoreflect.ValueOfString(s)) })
+		}
+		return true
+	})
+}
+
+// applyMD redacts the values of metadata keys matching a rule's field,
+// eg. session-id=drop or js-error-bin=truncate:100
+func (rs redactRules) applyMD(md metadata.MD, salt []byte) {
+	for _, r := range rs {
+		k := strings.ToLower(r.field)
+		vs, ok := md[k]
+		if !ok {
+			continue
+		}
+		if r.action == "drop" {
+			delete(md, k)
+			continue
+		}
+		for i, v := range vs {
+			vs[i] = r.redact(v, salt)
+		}
+	}
+}
+
+// redact applies a hash or truncate action to s
+func (r redactRule) redact(s string, salt []byte) string {
+	switch r.action {
+	case "hash":
+		h := hmac.New(sha256.New, salt)
+		h.Write([]byte(s))
+		return hex.EncodeToString(h.Sum(nil)[:8])
+	case "truncate":
+		if utf8.RuneCountInString(s) > r.n {
+			return string([]rune(s)[:r.n])
+		}
+	}
+	return s
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisClient is a minimal RESP client,
+// enough to share small bits of state between instances
+type redisClient struct {
+	addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+func newRedis(ctx context.Context, addr string) (*redisClient, error) {
+	rc := &redisClient{addr: addr}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	err := rc.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		if rc.conn != nil {
+			rc.conn.Close()
+		}
+	}()
+	return rc, nil
+}
+
+func (rc *redisClient) dial(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", rc.addr)
+	if err != nil {
+		return fmt.Errorf("dial redis addr=%s: %w", rc.addr, err)
+	}
+	rc.conn = conn
+	rc.rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	return nil
+}
+
+// Do sends a command and returns the reply,
+// one of string, int64, nil, []interface{}
+func (rc *redisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.conn == nil {
+		err := rc.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		rc.conn.SetDeadline(dl)
+	} else {
+		rc.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	fmt.Fprintf(rc.rw, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(rc.rw, "$%d\r\n%s\r\n", len(a), a)
+	}
+	err := rc.rw.Flush()
+	if err != nil {
+		rc.reset()
+		return nil, fmt.Errorf("redis write: %w", err)
+	}
+	v, err := rc.read()
+	var re redisError
+	if err != nil && !errors.As(err, &re) {
+		rc.reset()
+	}
+	return v, err
+}
+
+func (rc *redisClient) Int(ctx context.Context, args ...string) (int64, error) {
+	v, err := rc.Do(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis %s: unexpected reply %v", args[0], v)
+	}
+	return n, nil
+}
+
+func (rc *redisClient) OK(ctx context.Context, args ...string) error {
+	v, err := rc.Do(ctx, args...)
+	if err != nil {
+		return err
+	}
+	if v != "OK" {
+		return fmt.Errorf("redis %s: unexpected reply %v", args[0], v)
+	}
+	return nil
+}
+
+func (rc *redisClient) reset() {
+	rc.conn.Close()
+	rc.conn = nil
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (rc *redisClient) read() (interface{}, error) {
+	line, err := rc.rw.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis read: %w", err)
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis read: short line %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(rc.rw, b)
+		if err != nil {
+			return nil, fmt.Errorf("redis read: %w", err)
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		// read every element even after an error reply,
+		// so the next reply starts in the right place
+		vs := make([]interface{}, n)
+		var first error
+		for i := range vs {
+			vs[i], err = rc.read()
+			var re redisError
+			if errors.As(err, &re) {
+				if first == nil {
+					first = err
+				}
+				vs[i] = err
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return vs, first
+	}
+	return nil, fmt.Errorf("redis read: unknown reply %q", line)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedisRead(t *testing.T) {
+	in := "*3\r\n:1\r\n-ERR bad\r\n$2\r\nok\r\n" +
+		"+PONG\r\n" +
+		"*2\r\n*1\r\n-ERR nested\r\n:2\r\n" +
+		"$-1\r\n" +
+		":7\r\n"
+	rc := &redisClient{rw: bufio.NewReadWriter(bufio.NewReader(strings.NewReader(in)), nil)}
+
+	v, err := rc.read()
+	var re redisError
+	if !errors.As(err, &re) || string(re) != "ERR bad" {
+		t.Fatalf("array with error: err = %v, want ERR bad", err)
+	}
+	if vs, ok := v.([]interface{}); !ok || len(vs) != 3 || vs[0] != int64(1) || vs[2] != "ok" {
+		t.Errorf("array with error = %#v", v)
+	}
+
+	v, err = rc.read()
+	if err != nil || v != "PONG" {
+		t.Fatalf("after array with error = %v, %v, want PONG", v, err)
+	}
+
+	v, err = rc.read()
+	if !errors.As(err, &re) || string(re) != "ERR nested" {
+		t.Fatalf("nested array with error: err = %v, want ERR nested", err)
+	}
+	if vs, ok := v.([]interface{}); !ok || len(vs) != 2 || vs[1] != int64(2) {
+		t.Errorf("nested array with error = %#v", v)
+	}
+
+	v, err = rc.read()
+	if err != nil || v != nil {
+		t.Errorf("null bulk string = %v, %v", v, err)
+	}
+
+	v, err = rc.read()
+	if err != nil || !reflect.DeepEqual(v, int64(7)) {
+		t.Errorf("last reply = %v, %v, want 7", v, err)
+	}
+}
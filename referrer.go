@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// defaultSources classify well known referrers,
+// a trailing .* matches any tld
+var defaultSources = []string{
+	"google.*=search", "bing.com=search", "duckduckgo.com=search", "yahoo.*=search",
+	"yandex.*=search", "baidu.com=search", "ecosia.org=search", "search.brave.com=search",
+	"startpage.com=search", "kagi.com=search",
+	"facebook.com=social", "instagram.com=social", "t.co=social", "twitter.com=social",
+	"x.com=social", "linkedin.com=social", "reddit.com=social", "news.ycombinator.com=social",
+	"lobste.rs=social", "youtube.com=social", "pinterest.com=social", "mastodon.social=social",
+}
+
+// referrerSources maps referrer domains to traffic sources
+type referrerSources []referrerSource
+
+type referrerSource struct {
+	domain string
+	source string
+}
+
+func newReferrerSources(extra []string) (referrerSources, error) {
+	var rs referrerSources
+	// later entries are checked first so configured ones override defaults
+	for _, e := range append(append([]string{}, defaultSources...), extra...) {
+		i := strings.Index(e, "=")
+		if i <= 0 || i == len(e)-1 {
+			return nil, fmt.Errorf("invalid referrer source %q, expected domain=source", e)
+		}
+		rs = append(referrerSources{{strings.ToLower(e[:i]), e[i+1:]}}, rs...)
+	}
+	return rs, nil
+}
+
+// classify is the traffic source of a visit to page from ref:
+// direct, internal, search, social, a configured source, or other
+func (rs referrerSources) classify(ref, page string) string {
+	if ref == "" {
+		return "direct"
+	}
+	ru, err := url.Parse(ref)
+	if err != nil || ru.Host == "" {
+		return "other"
+	}
+	host := strings.TrimSuffix(strings.ToLower(ru.Hostname()), ".")
+	if pu, err := url.Parse(page); err == nil && strings.EqualFold(pu.Hostname(), host) {
+		return "internal"
+	}
+	for _, r := range rs {
+		if matchDomain(r.domain, host) {
+			return r.source
+		}
+	}
+	return "other"
+}
+
+// matchDomain is true if host is domain or a subdomain of it,
+// with domain.* matching any tld
+func matchDomain(domain, host string) bool {
+	if !strings.HasSuffix(domain, ".*") {
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+	base := strings.TrimSuffix(domain, "*")
+	return strings.HasPrefix(host, base) || strings.Contains(host, "."+base)
+}
+
+// spamList is a set of referrer spam domains
+type spamList map[string]bool
+
+// loadSpamList reads a file of referrer spam domains, one per line,
+// as in the matomo referrer-spam-list, # starts a comment
+func loadSpamList(fn string) (spamList, error) {
+	if fn == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("referrer.spam: %w", err)
+	}
+	l := make(spamList)
+	for _, line := range strings.Split(string(b), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(line)), ".")
+		if line != "" {
+			l[line] = true
+		}
+	}
+	return l, nil
+}
+
+// spam is true if ref is on, or a subdomain of a domain on, the list
+func (l spamList) spam(ref string) bool {
+	if len(l) == 0 || ref == "" {
+		return false
+	}
+	ru, err := url.Parse(ref)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(ru.Hostname()), ".")
+	for host != "" {
+		if l[host] {
+			return true
+		}
+		i := strings.Index(host, ".")
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return false
+}
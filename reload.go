@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadable is the configuration that can change without a restart
+type reloadable struct {
+	allow  domainList
+	redact redactRules
+	filter filterRules
+	pages  pageList
+	spam   spamList
+	geo    *geoIP
+	geoOpt geoOpts
+	cert   *tls.Certificate
+}
+
+// current is the active reloadable configuration
+func (s *Server) current() *reloadable {
+	return s.live.Load().(*reloadable)
+}
+
+// loadReloadable builds the reloadable configuration from the flags in c
+func loadReloadable(c *Server) (*reloadable, error) {
+	geo, err := c.geoOpts.geoIP()
+	if err != nil {
+		return nil, err
+	}
+	spam, err := loadSpamList(c.spamFile)
+	if err != nil {
+		return nil, err
+	}
+	filter := c.filters
+	if c.noise {
+		filter = append(filter[:len(filter):len(filter)], noiseFilter()...)
+	}
+	rl := &reloadable{
+		allow:  domainList(c.allowDomains),
+		redact: c.redact,
+		filter: filter,
+		pages:  pageList(c.metricPages),
+		spam:   spam,
+		geo:    geo,
+		geoOpt: c.geoOpts,
+	}
+	crt, key := c.fs.Lookup("tls.crt"), c.fs.Lookup("tls.key")
+	if crt != nil && key != nil {
+		cert, err := tls.LoadX509KeyPair(crt.Value.String(), key.Value.String())
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("load tls cert: %w", err)
+		} else if err == nil {
+			rl.cert = &cert
+		}
+	}
+	return rl, nil
+}
+
+// reload rereads the command line, environment, and config file,
+// swapping in the reloadable parts,
+// other changes need a restart
+func (s *Server) reload() error {
+	args, err := configArgs(s.args)
+	if err != nil {
+		return err
+	}
+	next := &Server{}
+	fs := newFlagSet(args[0], next)
+	fs.SetOutput(ioutil.Discard)
+	err = fs.Parse(args[1:])
+	if err != nil {
+		return fmt.Errorf("parse flags: %w", err)
+	}
+	rl, err := loadReloadable(next)
+	if err != nil {
+		return err
+	}
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.live.Store(rl)
+	return nil
+}
+
+// reloadGeo reopens the geoip databases, keeping the rest
+func (s *Server) reloadGeo() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	rl := *s.current()
+	geo, err := rl.geoOpt.geoIP()
+	if err != nil {
+		return err
+	}
+	rl.geo = geo
+	s.live.Store(&rl)
+	return nil
+}
+
+// reloadSignals reloads on SIGHUP
+func (s *Server) reloadSignals(ctx context.Context) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c:
+				s.reloadLogged("signal")
+			}
+		}
+	}()
+}
+
+// reloadLogged reloads, logging the outcome
+func (s *Server) reloadLogged(trigger string) {
+	err := s.reload()
+	if err != nil {
+		s.log.Error().Err(err).Str("trigger", trigger).Msg("reload config")
+		return
+	}
+	s.log.Info().Str("trigger", trigger).Msg("reloaded config")
+}
+
+// getCertificate serves the most recently loaded certificate,
+// falling back to the one loaded at startup
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.current().cert, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"go.seankhliao.com/statslogger/collector"
+)
+
+// reports handles reporting api batches:
+// csp violations are replayed through the csp handler one at a time,
+// network errors from NEL are only counted as the saver has nowhere to put them,
+// other types are counted and dropped
+func (s *Server) reports(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.banned(ctx, w, r) || s.dnt(w, r) || s.tenant(w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	var es []collector.ReportingEntry
+	if err == nil {
+		if s.schemaOpts.mode != "off" {
+			var v interface{}
+			if json.Unmarshal(body, &v) == nil && s.checkSchema(w, r, "reports", v) {
+				return
+			}
+		}
+		es, err = collector.ParseReporting(bytes.NewReader(body))
+	}
+	if err != nil {
+		s.response.httpError(ctx, w, http.StatusBadRequest, err)
+		zerolog.Ctx(ctx).Error().Err(err).Msg("unmarshal reporting api batch")
+		s.count(r, "parse-error")
+		s.strike(ctx, r)
+		return
+	}
+	csp := s.accessLog("/csp", s.csp)
+	for _, e := range es {
+		s.reportingc.WithLabelValues(reportingTypes.label(e.Type)).Inc()
+		if rep, ok := e.CSP(); ok && s.routeOpts.enabled("csp") {
+			b, _ := json.Marshal(rep)
+			cr := r.Clone(ctx)
+			cr.Body = ioutil.NopCloser(bytes.NewReader(b))
+			cr.ContentLength = int64(len(b))
+			cr.Header.Set("content-type", "application/csp-report")
+			cr.Header.Del("x-request-id")
+			csp(&statusRecorder{header: make(http.Header)}, cr)
+			continue
+		}
+		if ne, ok := e.NEL(); ok {
+			s.nelc.WithLabelValues(nelTypes.label(strings.SplitN(ne.Type, ".", 2)[0]), nelPhases.label(ne.Phase)).Inc()
+			zerolog.Ctx(ctx).Debug().Str("url", s.privacyOpts.scrubURL(e.URL)).Str("type", ne.Type).Str("phase", ne.Phase).Msg("network error")
+		}
+	}
+	s.count(r, "success")
+	s.response.accepted(w)
+}
+
+// reportingTypes are the reporting api types exported as labels, others are counted as other
+var reportingTypes = newLabelSet([]string{"csp-violation", "network-error", "deprecation", "intervention", "crash", "coep", "coop", "permissions-policy-violation"})
+
+// nelTypes are the network error classes (before the first .) exported as labels
+var nelTypes = newLabelSet([]string{"ok", "dns", "tcp", "tls", "http", "h2", "h3", "quic", "abandoned", "unknown"})
+
+var nelPhases = newLabelSet([]string{"dns", "connection", "application"})
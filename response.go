@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+type responseOpts struct {
+	success      int
+	cacheControl string
+	errors       string
+}
+
+func (o *responseOpts) Flags(fs *flag.FlagSet) {
+	fs.IntVar(&o.success, "http.success", http.StatusNoContent, "status for accepted reports: 204, or 200 with an empty json object for clients that mishandle 204")
+	fs.StringVar(&o.cacheControl, "http.cache-control", "no-store", "cache-control header for report responses, none if empty")
+	fs.StringVar(&o.errors, "http.errors", "status", "error responses: status (status text and ids), verbose (with the error), silent (respond as if accepted)")
+}
+
+func (o responseOpts) validate() error {
+	if o.success != http.StatusNoContent && o.success != http.StatusOK {
+		return fmt.Errorf("http.success must be 200 or 204: %d", o.success)
+	}
+	switch o.errors {
+	case "status", "verbose", "silent":
+	default:
+		return fmt.Errorf("unknown http.errors mode: %s", o.errors)
+	}
+	return nil
+}
+
+// accepted writes the response for a report that was accepted,
+// whether or not it was forwarded
+func (o responseOpts) accepted(w http.ResponseWriter) {
+	if o.cacheControl != "" {
+		w.Header().Set("cache-control", o.cacheControl)
+	}
+	if o.success == http.StatusOK {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{}\n"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// httpError writes an error response identifying the request and trace
+// so failed submissions can be matched to logs
+func (o responseOpts) httpError(ctx context.Context, w http.ResponseWriter, code int, err error) {
+	if o.errors == "silent" {
+		o.accepted(w)
+		return
+	}
+	if sc := trace.SpanFromContext(ctx).SpanContext(); sc.IsValid() {
+		w.Header().Set("x-trace-id", sc.TraceID.String())
+	}
+	if o.cacheControl != "" {
+		w.Header().Set("cache-control", o.cacheControl)
+	}
+	msg := http.StatusText(code)
+	var serr *schemaError
+	if (o.errors == "verbose" || errors.As(err, &serr)) && err != nil {
+		msg += ": " + err.Error()
+	}
+	if id := requestID(ctx); id != "" {
+		msg += " (request id " + id + ")"
+	}
+	http.Error(w, msg, code)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"go.seankhliao.com/apis/saver/v1"
+	"google.golang.org/grpc/metadata"
+)
+
+type rollupOpts struct {
+	interval time.Duration
+	samples  int
+}
+
+func (o *rollupOpts) Flags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.interval, "rollup", 0, "forward per interval rollups (csp fingerprint counts, page counts and durations) instead of every report, 0 to forward every report")
+	fs.IntVar(&o.samples, "rollup.samples", 1000, "durations per page to keep for percentiles")
+}
+
+// rollup aggregates reports over an interval,
+// forwarding one record per csp fingerprint and beacon page
+type rollup struct {
+	rollupOpts
+	log     zerolog.Logger
+	flushed *prometheus.CounterVec
+	client  func() saver.SaverClient
+	done    chan struct{}
+
+	mu      sync.Mutex
+	start   time.Time
+	csp     map[string]*cspRollup
+	beacons map[string]*beaconRollup
+}
+
+type cspRollup struct {
+	req   *saver.CSPRequest
+	class string
+	n     int
+}
+
+type beaconRollup struct {
+	req  *saver.BeaconRequest
+	n    int
+	durs []int64 // reservoir sample
+}
+
+func newRollup(ctx context.Context, o rollupOpts, log zerolog.Logger, f promauto.Factory, client func() saver.SaverClient) *rollup {
+	ru := &rollup{
+		rollupOpts: o,
+		log:        log,
+		flushed: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "rollup_records",
+		}, []string{"rpc", "outcome"}),
+		client: client,
+		done:   make(chan struct{}),
+	}
+	ru.reset(time.Now())
+	if o.interval > 0 {
+		go ru.run(ctx)
+	} else {
+		close(ru.done)
+	}
+	return ru
+}
+
+func (ru *rollup) enabled() bool {
+	return ru.interval > 0
+}
+
+func (ru *rollup) reset(t time.Time) {
+	ru.start = t
+	ru.csp = make(map[string]*cspRollup)
+	ru.beacons = make(map[string]*beaconRollup)
+}
+
+// CSP counts a violation under its fingerprint
+func (ru *rollup) CSP(fingerprint, class string, req *saver.CSPRequest) {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+	c, ok := ru.csp[fingerprint]
+	if !ok {
+		// identifies the violation, not the client
+		req.HttpRemote = nil
+		c = &cspRollup{req: req, class: class}
+		ru.csp[fingerprint] = c
+	}
+	c.n++
+}
+
+// Beacon counts a beacon under its page, sampling its duration
+func (ru *rollup) Beacon(req *saver.BeaconRequest) {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+	b, ok := ru.beacons[req.SrcPage]
+	if !ok {
+		b = &beaconRollup{req: &saver.BeaconRequest{SrcPage: req.SrcPage}}
+		ru.beacons[req.SrcPage] = b
+	}
+	b.n++
+	if req.DurationMs <= 0 {
+		return
+	}
+	if len(b.durs) < ru.samples {
+		b.durs = append(b.durs, req.DurationMs)
+	} else if i := rand.Intn(b.n); i < ru.samples {
+		b.durs[i] = req.DurationMs
+	}
+}
+
+func (ru *rollup) run(ctx context.Context) {
+	defer close(ru.done)
+	t := time.NewTicker(ru.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// last partial interval, the saver connection is closed after this
+			fctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			ru.flush(fctx, time.Now())
+			cancel()
+			return
+		case now := <-t.C:
+			ru.flush(ctx, now)
+		}
+	}
+}
+
+func (ru *rollup) flush(ctx context.Context, now time.Time) {
+	ru.mu.Lock()
+	start, csps, beacons := ru.start, ru.csp, ru.beacons
+	ru.reset(now)
+	ru.mu.Unlock()
+
+	client := ru.client()
+	remote := &saver.HTTPRemote{Timestamp: start.UTC().Format(time.RFC3339)}
+	window := []string{
+		"rollup-start", start.UTC().Format(time.RFC3339),
+		"rollup-end", now.UTC().Format(time.RFC3339),
+	}
+	for fp, c := range csps {
+		c.req.HttpRemote = remote
+		rctx := metadata.NewOutgoingContext(ru.log.WithContext(ctx), metadata.Pairs(append([]string{
+			"rollup-count", strconv.Itoa(c.n),
+			"csp-fingerprint", fp,
+			"csp-class", c.class,
+		}, window...)...))
+		_, err := client.CSP(rctx, c.req)
+		ru.result("CSP", err, c.n)
+	}
+	for _, b := range beacons {
+		b.req.HttpRemote = remote
+		kv := append([]string{"rollup-count", strconv.Itoa(b.n)}, window...)
+		if len(b.durs) > 0 {
+			sort.Slice(b.durs, func(i, j int) bool { return b.durs[i] < b.durs[j] })
+			b.req.DurationMs = percentile(b.durs, 50)
+			kv = append(kv,
+				"rollup-duration-p50-ms", strconv.FormatInt(percentile(b.durs, 50), 10),
+				"rollup-duration-p90-ms", strconv.FormatInt(percentile(b.durs, 90), 10),
+				"rollup-duration-p99-ms", strconv.FormatInt(percentile(b.durs, 99), 10),
+			)
+		}
+		rctx := metadata.NewOutgoingContext(ru.log.WithContext(ctx), metadata.Pairs(kv...))
+		_, err := client.Beacon(rctx, b.req)
+		ru.result("Beacon", err, b.n)
+	}
+}
+
+func (ru *rollup) result(rpc string, err error, n int) {
+	if err != nil {
+		ru.log.Error().Err(err).Str("rpc", rpc).Int("reports", n).Msg("forward rollup")
+		ru.flushed.WithLabelValues(rpc, "error").Inc()
+		return
+	}
+	ru.flushed.WithLabelValues(rpc, "success").Inc()
+}
+
+// percentile of sorted values, nearest rank
+func percentile(sorted []int64, p int) int64 {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
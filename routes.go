@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+type routeOpts struct {
+	prefix   string
+	csp      string
+	beacon   string
+	reports  string
+	script   string
+	schemas  string
+	handlers stringList
+}
+
+func (o *routeOpts) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.prefix, "http.prefix", "", "path prefix to mount the report handlers under, eg /_stats")
+	fs.StringVar(&o.csp, "http.path.csp", "/csp", "path of the csp report handler, under http.prefix")
+	fs.StringVar(&o.beacon, "http.path.beacon", "/beacon", "path of the beacon handler, under http.prefix")
+	fs.StringVar(&o.reports, "http.path.reports", "/reports", "path of the reporting api handler (application/reports+json batches), under http.prefix")
+	fs.StringVar(&o.script, "http.path.script", "/s.js", "path of the client script, under http.prefix")
+	fs.StringVar(&o.schemas, "http.path.schemas", "/schemas", "path of the json schemas of accepted payloads, under http.prefix")
+	o.handlers = stringList{"csp", "beacon", "reports"}
+	fs.Var(&o.handlers, "http.handlers", "comma separated handlers to serve: csp, beacon, reports, script, schemas")
+}
+
+func (o routeOpts) validate() error {
+	for _, h := range o.handlers {
+		switch h {
+		case "csp", "beacon", "reports", "script", "schemas":
+		default:
+			return fmt.Errorf("unknown handler in http.handlers: %s", h)
+		}
+	}
+	return nil
+}
+
+func (o routeOpts) enabled(handler string) bool {
+	return o.handlers.contains(handler)
+}
+
+// path is where a handler is mounted
+func (o routeOpts) path(p string) string {
+	return path.Join("/", o.prefix, p)
+}
+
+// serviceHandler replaces usvc's service handler,
+// which also sends every request to saver as is, bypassing privacy, dnt, and dry run.
+// Only its tracing and cors are kept.
+func serviceHandler(mux http.Handler) http.Handler {
+	return otelhttp.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodOptions:
+			w.Header().Set("access-control-allow-origin", "*")
+			w.Header().Set("access-control-allow-methods", "GET, POST")
+			w.Header().Set("access-control-max-age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet, http.MethodPost:
+			w.Header().Set("access-control-allow-origin", "*")
+			w.Header().Set("access-control-allow-methods", "GET, POST")
+			w.Header().Set("access-control-max-age", "86400")
+			mux.ServeHTTP(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}), "otelhttp", otelhttp.WithMessageEvents(otelhttp.ReadEvents, otelhttp.WriteEvents))
+}
+
+// allowPreflight answers cors preflights for paths under prefixes,
+// usvc answers them itself without allowing any request headers
+func allowPreflight(srv *http.Server, headers string, prefixes ...string) {
+	next := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			for _, p := range prefixes {
+				if strings.HasPrefix(r.URL.Path, p) {
+					w.Header().Set("access-control-allow-origin", "*")
+					w.Header().Set("access-control-allow-methods", "POST")
+					w.Header().Set("access-control-allow-headers", headers)
+					w.Header().Set("access-control-max-age", "86400")
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type handlerKey struct{}
+
+// handlerName is the name of the handler serving r,
+// independent of where it's mounted, for use in metrics and logs
+func handlerName(r *http.Request) string {
+	if name, ok := r.Context().Value(handlerKey{}).(string); ok {
+		return name
+	}
+	return r.URL.Path
+}
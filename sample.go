@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+// sampleRules is a flag value of comma separated match=rate rules
+// for csp violations, first match wins.
+// match is a directive, optionally with the blocked host: img-src@ext-id,
+// rate is the fraction to keep: 0.01
+type sampleRules []sampleRule
+
+type sampleRule struct {
+	directive string
+	host      string
+	rate      float64
+}
+
+func (rs *sampleRules) String() string {
+	if rs == nil {
+		return ""
+	}
+	var ss []string
+	for _, r := range *rs {
+		m := r.directive
+		if r.host != "" {
+			m += "@" + r.host
+		}
+		ss = append(ss, m+"="+strconv.FormatFloat(r.rate, 'g', -1, 64))
+	}
+	return strings.Join(ss, ",")
+}
+
+func (rs *sampleRules) Set(v string) error {
+	*rs = nil
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		i := strings.LastIndex(s, "=")
+		if i < 0 {
+			return fmt.Errorf("sample rule %q: expected directive[@host]=rate", s)
+		}
+		rate, err := strconv.ParseFloat(s[i+1:], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("sample rule %q: rate should be between 0 and 1", s)
+		}
+		r := sampleRule{directive: s[:i], rate: rate}
+		if j := strings.Index(r.directive, "@"); j >= 0 {
+			r.directive, r.host = r.directive[:j], r.directive[j+1:]
+		}
+		*rs = append(*rs, r)
+	}
+	return nil
+}
+
+// sampleExprs is a repeatable flag of rate and expression (see parseExpr) rules
+// for csp violations, checked in order before the sampleRules:
+// 0.01 report.blocked_uri.startsWith("data:")
+type sampleExprs []sampleExpr
+
+type sampleExpr struct {
+	src  string
+	rate float64
+	cond exprCond
+}
+
+func (rs *sampleExprs) String() string {
+	if rs == nil {
+		return ""
+	}
+	var ss []string
+	for _, r := range *rs {
+		ss = append(ss, r.src)
+	}
+	return strings.Join(ss, "; ")
+}
+
+func (rs *sampleExprs) Set(v string) error {
+	v = strings.TrimSpace(v)
+	i := strings.IndexAny(v, " \t")
+	if i < 0 {
+		return fmt.Errorf("sample rule %q: expected rate expression", v)
+	}
+	rate, err := strconv.ParseFloat(v[:i], 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return fmt.Errorf("sample rule %q: rate should be between 0 and 1", v)
+	}
+	cond, err := parseExpr(v[i+1:])
+	if err != nil {
+		return fmt.Errorf("sample rule %q: %w", v, err)
+	}
+	*rs = append(*rs, sampleExpr{src: v, rate: rate, cond: cond})
+	return nil
+}
+
+// rate is the fraction of reports to keep by the first matching rule
+func (rs sampleExprs) rate(field func(string) string) (float64, bool) {
+	for _, r := range rs {
+		if r.cond(field) {
+			return r.rate, true
+		}
+	}
+	return 1, false
+}
+
+// rate is the fraction of reports to keep
+func (rs sampleRules) rate(directive, host string) float64 {
+	for _, r := range rs {
+		if r.directive != directive && r.directive != "*" {
+			continue
+		}
+		if r.host != "" && !matchDomain(r.host, host) {
+			continue
+		}
+		return r.rate
+	}
+	return 1
+}
+
+type sampleOpts struct {
+	rules sampleRules
+	exprs sampleExprs
+	seen  int
+}
+
+func (o *sampleOpts) Flags(fs *flag.FlagSet) {
+	fs.Var(&o.rules, "csp.sample", "comma separated directive[@blocked-host]=rate rules to sample csp violations, violations not seen before are always kept")
+	fs.Var(&o.exprs, "csp.sample.if", "rate followed by an expression, eg. '0.01 report.blocked_uri.startsWith(\"data:\")', checked before csp.sample, repeatable")
+	fs.IntVar(&o.seen, "csp.sample.seen", 100000, "number of violations to remember as seen, forgotten all at once when full")
+}
+
+// sampler keeps a fraction of csp violations,
+// except for the first of each kind
+type sampler struct {
+	sampleOpts
+	log     zerolog.Logger
+	novel   prometheus.Counter
+	sampled prometheus.Counter
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newSampler(o sampleOpts, log zerolog.Logger, f promauto.Factory) *sampler {
+	return &sampler{
+		sampleOpts: o,
+		log:        log,
+		novel: f.NewCounter(prometheus.CounterOpts{
+			Name: "csp_novel_violations",
+		}),
+		sampled: f.NewCounter(prometheus.CounterOpts{
+			Name: "csp_sampled_out",
+		}),
+		seen: make(map[string]struct{}),
+	}
+}
+
+// Keep returns the rate the report with the fingerprint was kept at,
+// or 0 if it should be dropped
+func (s *sampler) Keep(r CSPReport, key string) float64 {
+	if len(s.rules) == 0 && len(s.exprs) == 0 {
+		return 1
+	}
+	rate, matched := s.exprs.rate(r.field)
+	if !matched {
+		rate = s.rules.rate(r.directive(), hostOf(r.CspReport.BlockedURI))
+	}
+	if rate >= 1 {
+		return 1
+	}
+
+	s.mu.Lock()
+	_, ok := s.seen[key]
+	if !ok {
+		if len(s.seen) >= s.sampleOpts.seen {
+			s.log.Info().Int("seen", len(s.seen)).Msg("resetting seen violations")
+			s.seen = make(map[string]struct{})
+		}
+		s.seen[key] = struct{}{}
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.novel.Inc()
+		return 1
+	}
+
+	if rand.Float64() < rate {
+		return rate
+	}
+	s.sampled.Inc()
+	return 0
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/propagation"
+	"go.opentelemetry.io/otel/propagators"
+	"go.seankhliao.com/apis/saver/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// saverLatency records the duration of calls to the saver
+func saverLatency(latency *prometheus.HistogramVec) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		t := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		observeWithExemplar(ctx, latency.WithLabelValues(path.Base(method), status.Code(err).String()), time.Since(t).Seconds())
+		return err
+	}
+}
+
+// saverPropagators injects span context into saver calls
+// in the globally configured (b3) format and w3c trace context,
+// so the trace continues regardless of which one the saver extracts
+func saverPropagators() propagation.Propagators {
+	inj := append(global.Propagators().HTTPInjectors(), propagators.TraceContext{})
+	return propagation.New(propagation.WithInjectors(inj...))
+}
+
+// dryRunSaver logs records instead of forwarding them
+type dryRunSaver struct{}
+
+func (dryRunSaver) log(ctx context.Context, rpc string, m proto.Message) {
+	zerolog.Ctx(ctx).Info().Str("rpc", rpc).Interface("record", newRecord(ctx, "", m)).Msg("dry run")
+}
+
+func (d dryRunSaver) HTTP(ctx context.Context, in *saver.HTTPRequest, opts ...grpc.CallOption) (*saver.HTTPResponse, error) {
+	d.log(ctx, "HTTP", in)
+	return &saver.HTTPResponse{}, nil
+}
+
+func (d dryRunSaver) Beacon(ctx context.Context, in *saver.BeaconRequest, opts ...grpc.CallOption) (*saver.BeaconResponse, error) {
+	d.log(ctx, "Beacon", in)
+	return &saver.BeaconResponse{}, nil
+}
+
+func (d dryRunSaver) CSP(ctx context.Context, in *saver.CSPRequest, opts ...grpc.CallOption) (*saver.CSPResponse, error) {
+	d.log(ctx, "CSP", in)
+	return &saver.CSPResponse{}, nil
+}
+
+func (d dryRunSaver) RepoDefault(ctx context.Context, in *saver.RepoDefaultRequest, opts ...grpc.CallOption) (*saver.RepoDefaultResponse, error) {
+	d.log(ctx, "RepoDefault", in)
+	return &saver.RepoDefaultResponse{}, nil
+}
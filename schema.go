@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+type schemaOpts struct {
+	mode string
+}
+
+func (o *schemaOpts) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.mode, "schema.validate", "count", "check payloads against their json schema: off, count (only metrics and logs), reject (400 with the problems)")
+}
+
+func (o schemaOpts) validate() error {
+	switch o.mode {
+	case "off", "count", "reject":
+	default:
+		return fmt.Errorf("schema.validate: unknown mode %s", o.mode)
+	}
+	return nil
+}
+
+// schema is the subset of json schema used to describe the payloads,
+// it marshals to the schema served to integrators
+// and is what payloads are checked against
+type schema struct {
+	Schema      string             `json:"$schema,omitempty"`
+	ID          string             `json:"$id,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Type        string             `json:"type"`
+	Properties  map[string]*schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *schema            `json:"items,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Pattern     string             `json:"pattern,omitempty"`
+	MaxLength   int                `json:"maxLength,omitempty"`
+	Minimum     *float64           `json:"minimum,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaError lists everything wrong with a payload,
+// it only describes what the client sent so it's always shown to them
+type schemaError struct {
+	schema   string
+	problems []string
+}
+
+func (e *schemaError) Error() string {
+	return "invalid " + e.schema + ": " + strings.Join(e.problems, "; ")
+}
+
+// check validates v as decoded by encoding/json
+func (sc *schema) check(name string, v interface{}) error {
+	var problems []string
+	sc.walk("", v, &problems)
+	if len(problems) == 0 {
+		return nil
+	}
+	return &schemaError{name, problems}
+}
+
+func (sc *schema) walk(path string, v interface{}, problems *[]string) {
+	at := path
+	if at == "" {
+		at = "payload"
+	}
+	bad := func(format string, args ...interface{}) {
+		*problems = append(*problems, at+": "+fmt.Sprintf(format, args...))
+	}
+	switch sc.Type {
+	case "object":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			bad("expected object, got %s", jsonType(v))
+			return
+		}
+		for _, k := range sc.Required {
+			if _, ok := m[k]; !ok {
+				*problems = append(*problems, joinPath(path, k)+": required")
+			}
+		}
+		keys := make([]string, 0, len(sc.Properties))
+		for k := range sc.Properties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if fv, ok := m[k]; ok {
+				sc.Properties[k].walk(joinPath(path, k), fv, problems)
+			}
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			bad("expected array, got %s", jsonType(v))
+			return
+		}
+		for i, iv := range a {
+			sc.Items.walk(fmt.Sprintf("%s[%d]", path, i), iv, problems)
+		}
+	case "integer", "number":
+		f, ok := v.(float64)
+		if !ok {
+			bad("expected %s, got %s", sc.Type, jsonType(v))
+			return
+		}
+		if sc.Type == "integer" && f != float64(int64(f)) {
+			bad("expected integer, got %v", f)
+		}
+		if sc.Minimum != nil && f < *sc.Minimum {
+			bad("%v is less than %v", f, *sc.Minimum)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			bad("expected string, got %s", jsonType(v))
+			return
+		}
+		if sc.MaxLength > 0 && len(s) > sc.MaxLength {
+			bad("longer than %d", sc.MaxLength)
+		}
+		if len(sc.Enum) > 0 && !stringList(sc.Enum).contains(s) {
+			bad("%q is not one of %s", s, strings.Join(sc.Enum, ", "))
+		}
+		if sc.pattern != nil && !sc.pattern.MatchString(s) {
+			bad("%q doesn't match %s", s, sc.Pattern)
+		}
+		if sc.Format == "uri" && s != "" {
+			// browsers send keywords like inline and eval in place of urls
+			if u, err := url.Parse(s); err != nil || (u.Scheme == "" && strings.Contains(s, "/")) {
+				bad("%q is not a url", s)
+			}
+		}
+	}
+}
+
+func joinPath(path, k string) string {
+	if path == "" {
+		return k
+	}
+	return path + "." + k
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// compile prepares patterns, panicking on invalid ones as the schemas are fixed
+func (sc *schema) compile() *schema {
+	if sc.Pattern != "" {
+		sc.pattern = regexp.MustCompile(sc.Pattern)
+	}
+	for _, p := range sc.Properties {
+		p.compile()
+	}
+	if sc.Items != nil {
+		sc.Items.compile()
+	}
+	return sc
+}
+
+func str(desc string) *schema {
+	return &schema{Type: "string", Description: desc}
+}
+
+func uri(desc string) *schema {
+	return &schema{Type: "string", Format: "uri", MaxLength: 8192, Description: desc}
+}
+
+func nonNegative(typ, desc string) *schema {
+	zero := 0.0
+	return &schema{Type: typ, Minimum: &zero, Description: desc}
+}
+
+func withPattern(sc *schema, pattern string) *schema {
+	sc.Pattern = pattern
+	return sc
+}
+
+// cspViolation is the body of a report-uri csp report
+func cspViolation() map[string]*schema {
+	return map[string]*schema{
+		"document-uri":        uri("page the violation happened on"),
+		"referrer":            uri("referrer of the page"),
+		"blocked-uri":         uri("resource that was blocked, or a keyword like inline or eval"),
+		"violated-directive":  str("directive that was violated, with its value in older browsers"),
+		"effective-directive": str("directive that was enforced"),
+		"original-policy":     str("the full policy"),
+		"disposition":         {Type: "string", Enum: []string{"enforce", "report"}},
+		"source-file":         uri("script that caused the violation"),
+		"script-sample":       {Type: "string", MaxLength: 4096, Description: "start of the blocked inline script"},
+		"status-code":         nonNegative("integer", "http status of the page"),
+		"line-number":         nonNegative("integer", ""),
+		"column-number":       nonNegative("integer", ""),
+	}
+}
+
+// schemas are the payloads accepted by the report handlers, by handler name
+var schemas = map[string]*schema{
+	"csp": (&schema{
+		Title:       "csp report",
+		Description: "sent by browsers to a csp report-uri, application/csp-report or application/json",
+		Type:        "object",
+		Required:    []string{"csp-report"},
+		Properties: map[string]*schema{
+			"csp-report": {Type: "object", Required: []string{"document-uri"}, Properties: cspViolation()},
+		},
+	}).compile(),
+	"beacon": (&schema{
+		Title:       "beacon",
+		Description: "application/x-www-form-urlencoded form of a page view, shown here as an object of its fields",
+		Type:        "object",
+		Required:    []string{"src"},
+		Properties: map[string]*schema{
+			"src":    uri("page that was viewed"),
+			"dst":    {Type: "string", MaxLength: 8192, Description: "page navigated to next, relative to src"},
+			"dur":    withPattern(str("time on page in ms, optionally suffixed with ms"), `^-?[0-9]+(ms)?$`),
+			"ref":    uri("document.referrer"),
+			"site":   withPattern(str("site key"), siteKey.String()),
+			"lcp":    withPattern(str("largest contentful paint in ms"), `^[0-9.]+$`),
+			"fcp":    withPattern(str("first contentful paint in ms"), `^[0-9.]+$`),
+			"inp":    withPattern(str("interaction to next paint in ms"), `^[0-9.]+$`),
+			"ttfb":   withPattern(str("time to first byte in ms"), `^[0-9.]+$`),
+			"cls":    withPattern(str("cumulative layout shift"), `^[0-9.]+$`),
+			"errors": withPattern(str("uncaught errors and unhandled rejections on the page"), `^[0-9]+$`),
+			"error":  {Type: "string", MaxLength: 1024, Description: "message and location of the first error"},
+		},
+	}).compile(),
+	"reports": (&schema{
+		Title:       "reporting api batch",
+		Description: "sent by browsers to endpoints from Reporting-Endpoints or Report-To, application/reports+json",
+		Type:        "array",
+		Items: &schema{
+			Type:     "object",
+			Required: []string{"type", "body"},
+			Properties: map[string]*schema{
+				"type":       str("csp-violation, network-error, deprecation, ..."),
+				"age":        nonNegative("integer", "ms between the report being generated and sent"),
+				"url":        uri("page the report is about"),
+				"user_agent": str(""),
+				"body":       {Type: "object", Description: "depends on type"},
+			},
+		},
+	}).compile(),
+}
+
+// checkSchema validates a payload against the handler's schema,
+// counting the result and rejecting it if configured,
+// returning true if the request was handled
+func (s *Server) checkSchema(w http.ResponseWriter, r *http.Request, handler string, v interface{}) bool {
+	if s.schemaOpts.mode == "off" {
+		return false
+	}
+	err := schemas[handler].check(handler, v)
+	if err == nil {
+		s.schemac.WithLabelValues(handler, "valid").Inc()
+		return false
+	}
+	s.schemac.WithLabelValues(handler, "invalid").Inc()
+	ctx := r.Context()
+	if s.schemaOpts.mode != "reject" {
+		zerolog.Ctx(ctx).Debug().Err(err).Msg("schema")
+		return false
+	}
+	zerolog.Ctx(ctx).Debug().Err(err).Msg("reject schema")
+	s.response.httpError(ctx, w, http.StatusBadRequest, err)
+	s.count(r, "invalid-schema")
+	s.strike(ctx, r)
+	return true
+}
+
+// formObject is a form as checked against a schema, using the first value of each field
+func formObject(form url.Values) map[string]interface{} {
+	m := make(map[string]interface{}, len(form))
+	for k, vs := range form {
+		if len(vs) > 0 {
+			m[k] = vs[0]
+		}
+	}
+	return m
+}
+
+// schemasHandler serves the schemas at <path>/<handler>.json, and an index at <path>/
+func (s *Server) schemasHandler(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		w.Header().Set("content-type", "application/schema+json")
+		w.Header().Set("cache-control", "public, max-age=3600")
+		if name == "" || name == "/" {
+			index := make(map[string]string)
+			for h := range schemas {
+				if s.routeOpts.enabled(h) {
+					index[h] = strings.TrimSuffix(prefix, "/") + "/" + h + ".json"
+				}
+			}
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(index)
+			return
+		}
+		h := strings.TrimSuffix(strings.TrimPrefix(name, "/"), ".json")
+		sc, ok := schemas[h]
+		if !ok || !s.routeOpts.enabled(h) {
+			http.NotFound(w, r)
+			return
+		}
+		out := *sc
+		out.Schema = "https://json-schema.org/draft/2020-12/schema"
+		out.ID = strings.TrimSuffix(prefix, "/") + "/" + h + ".json"
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		e.Encode(out)
+	}
+}
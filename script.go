@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/metadata"
+)
+
+// scriptEvent is the line delimited json exchanged with -pipeline.exec
+type scriptEvent struct {
+	Handler  string              `json:"handler"`
+	Report   json.RawMessage     `json:"report"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+	Drop     bool                `json:"drop,omitempty"`
+}
+
+// scriptProc runs a user supplied command as a processor,
+// writing an event per line to its stdin and reading the result from its stdout.
+// Each of the workers is a copy of the command handling one event at a time,
+// started on first use and killed and restarted if it fails or takes longer than timeout,
+// it should exit when stdin is closed.
+// With failOpen, events the command fails on are passed through unchanged.
+type scriptProc struct {
+	timeout  time.Duration
+	failOpen bool
+	log      zerolog.Logger
+	idle     chan *scriptWorker
+}
+
+// scriptWorker is a single copy of the command
+type scriptWorker struct {
+	args []string
+	log  zerolog.Logger
+
+	cmd    *exec.Cmd
+	in     io.WriteCloser
+	out    chan []byte
+	done   chan struct{} // closed by stop, nothing reads out anymore
+	exited chan struct{} // closed once the command is reaped
+}
+
+func newScriptProc(o pipelineOpts, log zerolog.Logger) *scriptProc {
+	p := &scriptProc{
+		timeout:  o.execTimeout,
+		failOpen: o.execFailOpen,
+		log:      log.With().Str("module", "exec").Logger(),
+		idle:     make(chan *scriptWorker, o.execWorkers),
+	}
+	for i := 0; i < o.execWorkers; i++ {
+		p.idle <- &scriptWorker{
+			args: strings.Fields(o.exec),
+			log:  p.log.With().Int("worker", i).Logger(),
+		}
+	}
+	return p
+}
+
+func (w *scriptWorker) start() error {
+	cmd := exec.Command(w.args[0], w.args[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("stdout: %w", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("start %s: %w", w.args[0], err)
+	}
+	out, done, exited := make(chan []byte), make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		defer cmd.Wait()
+		defer close(out)
+		sc := bufio.NewScanner(stdout)
+		sc.Buffer(make([]byte, 64<<10), 4<<20)
+		for sc.Scan() {
+			select {
+			case out <- append([]byte(nil), sc.Bytes()...):
+			case <-done:
+				// a late response to an event that timed out
+				return
+			}
+		}
+	}()
+	w.cmd, w.in, w.out, w.done, w.exited = cmd, in, out, done, exited
+	w.log.Info().Int("pid", cmd.Process.Pid).Msg("started")
+	return nil
+}
+
+// stop kills the command so the next event restarts it
+func (w *scriptWorker) stop() {
+	if w.cmd == nil {
+		return
+	}
+	w.in.Close()
+	w.cmd.Process.Kill()
+	close(w.done)
+	w.cmd = nil
+}
+
+// call sends b and waits for the response line,
+// the write is covered by the deadline too as a stuck command stops reading
+func (w *scriptWorker) call(ctx context.Context, b []byte, timeout time.Duration) ([]byte, error) {
+	if w.cmd == nil {
+		err := w.start()
+		if err != nil {
+			return nil, err
+		}
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	in, written := w.in, make(chan error, 1)
+	go func() {
+		_, err := in.Write(append(b, '\n'))
+		written <- err
+	}()
+	for {
+		select {
+		case err := <-written:
+			if err != nil {
+				w.stop()
+				return nil, fmt.Errorf("write: %w", err)
+			}
+			written = nil
+		case line, ok := <-w.out:
+			if !ok {
+				w.stop()
+				return nil, fmt.Errorf("exited")
+			}
+			return line, nil
+		case <-t.C:
+			w.stop()
+			return nil, fmt.Errorf("no response in %v", timeout)
+		case <-ctx.Done():
+			w.stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (p *scriptProc) Process(ctx context.Context, e *event) (*event, bool, error) {
+	next, drop, err := p.process(ctx, e)
+	if err != nil && p.failOpen && ctx.Err() == nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("exec failed, passing event through")
+		return e, false, nil
+	}
+	return next, drop, err
+}
+
+func (p *scriptProc) process(ctx context.Context, e *event) (*event, bool, error) {
+	report, err := json.Marshal(e.msg)
+	if err != nil {
+		return e, false, fmt.Errorf("exec: marshal: %w", err)
+	}
+	b, err := json.Marshal(scriptEvent{Handler: e.handler, Report: report, Metadata: e.md})
+	if err != nil {
+		return e, false, fmt.Errorf("exec: marshal: %w", err)
+	}
+
+	var w *scriptWorker
+	t := time.NewTimer(p.timeout)
+	select {
+	case w = <-p.idle:
+		t.Stop()
+	case <-t.C:
+		return e, false, fmt.Errorf("exec: no free worker in %v", p.timeout)
+	case <-ctx.Done():
+		t.Stop()
+		return e, false, ctx.Err()
+	}
+	line, err := w.call(ctx, b, p.timeout)
+	p.idle <- w
+	if err != nil {
+		return e, false, fmt.Errorf("exec: %w", err)
+	}
+
+	var res scriptEvent
+	err = json.Unmarshal(line, &res)
+	if err != nil {
+		return e, false, fmt.Errorf("exec: unmarshal: %w", err)
+	}
+	if res.Drop {
+		return e, true, nil
+	}
+	msg := e.msg.ProtoReflect().New().Interface()
+	err = json.Unmarshal(res.Report, msg)
+	if err != nil {
+		return e, false, fmt.Errorf("exec: unmarshal report: %w", err)
+	}
+	next := *e
+	next.msg, next.md = msg, metadata.MD(res.Metadata)
+	if next.md == nil {
+		next.md = metadata.MD{}
+	}
+	return &next, false, nil
+}
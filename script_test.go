@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestScriptWorkerTimeout(t *testing.T) {
+	// the response outlives the killed shell and arrives after the timeout
+	w := &scriptWorker{
+		args: []string{"sh", "-c", `read l; (sleep 0.2; echo "$l") & wait`},
+		log:  zerolog.Nop(),
+	}
+	_, err := w.call(context.Background(), []byte(`{}`), 50*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected a timeout")
+	}
+	select {
+	case <-w.exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command not reaped after timing out")
+	}
+}
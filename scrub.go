@@ -0,0 +1,27 @@
+package main
+
+import (
+	"regexp"
+)
+
+// scrubPatterns match common secrets and personal data in free text
+var scrubPatterns = []*regexp.Regexp{
+	// email addresses
+	regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`),
+	// jwts
+	regexp.MustCompile(`eyJ[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]*`),
+	// bearer / basic credentials
+	regexp.MustCompile(`(?i)(bearer|basic|token)[ =:]+[a-zA-Z0-9._~+/=-]{8,}`),
+	// long random looking tokens
+	regexp.MustCompile(`[a-zA-Z0-9_-]*[0-9][a-zA-Z0-9_-]*[a-zA-Z][a-zA-Z0-9_-]{18,}|[a-zA-Z0-9_-]*[a-zA-Z][a-zA-Z0-9_-]*[0-9][a-zA-Z0-9_-]{18,}`),
+	// long numbers: phone, card, account numbers
+	regexp.MustCompile(`[0-9][0-9 -]{4,}[0-9]`),
+}
+
+// scrubText redacts likely sensitive substrings
+func scrubText(s string) string {
+	for _, p := range scrubPatterns {
+		s = p.ReplaceAllString(s, "[redacted]")
+	}
+	return s
+}
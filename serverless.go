@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.seankhliao.com/apis/saver/v1"
+	"go.seankhliao.com/statslogger/collector"
+	"go.seankhliao.com/usvc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// serverless runs just the collector handlers for scale to zero platforms:
+// as an AWS Lambda function if started by the lambda runtime,
+// otherwise listening on $PORT as Cloud Run and Cloud Functions expect.
+// There's no state to warm up, the saver connection is made on the first report.
+// Privacy, redaction, the domain allowlist, and filter rules work as in serve,
+// with the same flags.
+func serverless(args []string) int {
+	var (
+		tlsOpts  usvc.TLSOpts
+		privacy  privacyOpts
+		redact   redactRules
+		trusted  trustedProxies
+		allow    stringList
+		filters  filterRules
+		noise    bool
+		normOpts normalizeOpts
+	)
+	fs := flag.NewFlagSet(args[0]+" serverless", flag.ExitOnError)
+	saverAddr := fs.String("saver", "saver:443", "url to connect to saver")
+	dryRun := fs.Bool("dry-run", false, "log records instead of forwarding them to saver")
+	prefix := fs.String("http.prefix", "", "path prefix to mount the report handlers under, eg /_stats")
+	strict := fs.Bool("csp.strict", false, "reject csp reports missing required fields or with malformed urls with 400")
+	tlsOpts.Flags(fs)
+	privacy.Flags(fs)
+	fs.Var(&trusted, "http.trusted-proxies", "comma separated ips or cidrs of proxies whose x-forwarded-for is used to find the client address, none if empty")
+	fs.Var(&redact, "redact", "comma separated field=action rules applied to forwarded records, actions: drop, hash, truncate:n")
+	fs.Var(&allow, "allow.domains", "comma separated domains (and their subdomains) to accept reports for, all if empty")
+	fs.Var(&filters, "filter", "rule applied to reports before forwarding: action field=glob|field~regexp ..., actions: drop, keep, tag:name (ignored here), repeatable")
+	fs.BoolVar(&noise, "filter.noise", true, "drop csp violations from browser extensions, in app browsers, and page translators, after the filter rules")
+	normOpts.Flags(fs)
+	fs.Parse(args[1:])
+
+	log := zerolog.New(os.Stderr).With().Timestamp().Logger()
+	err := privacy.validate()
+	if err != nil {
+		log.Error().Err(err).Msg("validate flags")
+		return 2
+	}
+	tlsConf, err := tlsOpts.Config()
+	if err != nil {
+		log.Error().Err(err).Msg("load tls config")
+		return 1
+	}
+	if noise {
+		filters = append(filters[:len(filters):len(filters)], noiseFilter()...)
+	}
+	allowed := domainList(allow)
+
+	client := collector.Lazy(func(ctx context.Context) (saver.SaverClient, error) {
+		if *dryRun {
+			return dryRunSaver{}, nil
+		}
+		cc, err := grpc.DialContext(ctx, *saverAddr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConf)))
+		if err != nil {
+			return nil, fmt.Errorf("connect to saver: %w", err)
+		}
+		return saver.NewSaverClient(cc), nil
+	})
+	c := collector.New(client,
+		collector.WithLogger(log),
+		collector.WithStrict(*strict),
+		collector.WithPaths(path.Join("/", *prefix, "csp"), path.Join("/", *prefix, "beacon")),
+		collector.WithRemote(func(r *http.Request) *saver.HTTPRemote {
+			return privacy.httpRemote(r, false)
+		}),
+		collector.WithCSPFilter(func(r *http.Request, rep collector.Report, req *saver.CSPRequest) bool {
+			if (privacy.dnt == "drop" && optedOut(r)) || !allowed.Allowed(rep.CspReport.DocumentURI) {
+				return false
+			}
+			if drop, _ := filters.apply(CSPReport(rep).field); drop != "" {
+				return false
+			}
+			req.BlockedUri = privacy.scrubURL(req.BlockedUri)
+			req.SourceFile = privacy.scrubURL(req.SourceFile)
+			req.DocumentUri = privacy.scrubURL(normOpts.url(req.DocumentUri, ""))
+			redact.apply(req, privacy.dailySalt(time.Now()))
+			return true
+		}),
+		collector.WithBeaconFilter(func(r *http.Request, b collector.Beacon, req *saver.BeaconRequest) bool {
+			if (privacy.dnt == "drop" && optedOut(r)) || !allowed.Allowed(b.Src) {
+				return false
+			}
+			if drop, _ := filters.apply(r.FormValue); drop != "" {
+				return false
+			}
+			if !privacy.consented(r) {
+				if privacy.consent == "drop" {
+					return false
+				}
+				req.HttpRemote = privacy.httpRemote(r, true)
+			}
+			req.SrcPage = privacy.scrubURL(normOpts.url(b.Src, ""))
+			req.DstPage = privacy.scrubURL(normOpts.url(b.Dst, b.Src))
+			redact.apply(req, privacy.dailySalt(time.Now()))
+			return true
+		}),
+	).Handler()
+	// dry run logs through the request context
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := withClient(log.WithContext(r.Context()), trusted.clientAddr(r))
+		c.ServeHTTP(w, r.WithContext(ctx))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		<-sigc
+		cancel()
+	}()
+
+	if collector.InLambda() {
+		err := collector.ServeLambda(ctx, h)
+		if err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("serve lambda")
+			return 1
+		}
+		return 0
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	srv := &http.Server{Addr: ":" + port, Handler: h}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	log.Info().Str("addr", srv.Addr).Msg("serving")
+	err = srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Error().Err(err).Msg("serve")
+		return 1
+	}
+	return 0
+}
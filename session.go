@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// sessions assigns anonymous session ids to visitor tokens,
+// starting a new session after a period of inactivity
+type sessions struct {
+	timeout time.Duration
+
+	mu   sync.Mutex
+	last map[string]*session
+}
+
+type session struct {
+	id   string
+	seen time.Time
+}
+
+func newSessions(ctx context.Context, timeout time.Duration) *sessions {
+	ss := &sessions{
+		timeout: timeout,
+		last:    make(map[string]*session),
+	}
+	if timeout > 0 {
+		go ss.prune(ctx)
+	}
+	return ss
+}
+
+// ID returns the session id for visitor at t, empty if disabled
+func (ss *sessions) ID(visitor string, t time.Time) string {
+	if ss.timeout <= 0 {
+		return ""
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.last[visitor]
+	if !ok || t.Sub(s.seen) > ss.timeout {
+		h := sha256.Sum256([]byte(visitor + t.Format(time.RFC3339Nano)))
+		s = &session{id: hex.EncodeToString(h[:8])}
+		ss.last[visitor] = s
+	}
+	s.seen = t
+	return s.id
+}
+
+func (ss *sessions) prune(ctx context.Context) {
+	t := time.NewTicker(ss.timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			ss.mu.Lock()
+			for v, s := range ss.last {
+				if now.Sub(s.seen) > ss.timeout {
+					delete(ss.last, v)
+				}
+			}
+			ss.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// shutdownAfter force closes the servers if draining them
+// takes longer than timeout after ctx is done,
+// usvc's own shutdown waits indefinitely
+func shutdownAfter(ctx context.Context, timeout time.Duration, log zerolog.Logger, srvs ...*http.Server) {
+	if timeout <= 0 {
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		time.Sleep(timeout)
+		log.Warn().Dur("timeout", timeout).Msg("shutdown timed out, closing remaining connections")
+		for _, srv := range srvs {
+			srv.Close()
+		}
+	}()
+}
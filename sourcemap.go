@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+type sourceMapOpts struct {
+	domains stringList
+	ttl     time.Duration
+	maxSize int64
+	timeout time.Duration
+}
+
+func (o *sourceMapOpts) Flags(fs *flag.FlagSet) {
+	fs.Var(&o.domains, "js.sourcemaps", "comma separated domains (and their subdomains) whose scripts' source maps are fetched to resolve js error locations, none if empty")
+	fs.DurationVar(&o.ttl, "js.sourcemaps.ttl", time.Hour, "how long to cache a fetched source map, or a failure to fetch one")
+	fs.Int64Var(&o.maxSize, "js.sourcemaps.max-size", 16<<20, "maximum size in bytes of a script or source map to fetch")
+	fs.DurationVar(&o.timeout, "js.sourcemaps.timeout", 5*time.Second, "timeout for fetching a script or source map, beacons wait on it")
+}
+
+func (o sourceMapOpts) validate() error {
+	if len(o.domains) == 0 {
+		return nil
+	}
+	switch {
+	case o.ttl <= 0:
+		return fmt.Errorf("js.sourcemaps.ttl: %v not positive", o.ttl)
+	case o.maxSize <= 0:
+		return fmt.Errorf("js.sourcemaps.max-size: %d not positive", o.maxSize)
+	case o.timeout <= 0:
+		return fmt.Errorf("js.sourcemaps.timeout: %v not positive", o.timeout)
+	}
+	return nil
+}
+
+// sourceMaps rewrites locations in scripts from owned domains
+// to the original source, line and column from the scripts' source maps
+type sourceMaps struct {
+	sourceMapOpts
+	log     zerolog.Logger
+	client  *http.Client
+	fetches *prometheus.CounterVec
+
+	mu      sync.Mutex
+	scripts map[string]*sourceMapEntry
+}
+
+type sourceMapEntry struct {
+	ready   chan struct{}
+	fetched time.Time
+	m       *sourceMap // nil if the script has none or it couldn't be fetched
+}
+
+func newSourceMaps(o sourceMapOpts, log zerolog.Logger, f promauto.Factory) *sourceMaps {
+	return &sourceMaps{
+		sourceMapOpts: o,
+		log:           log,
+		client: &http.Client{
+			Timeout: o.timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 5 {
+					return fmt.Errorf("too many redirects")
+				}
+				if !domainList(o.domains).Allowed(req.URL.String()) {
+					return fmt.Errorf("redirect to %s: not an owned domain", req.URL.Host)
+				}
+				return nil
+			},
+		},
+		fetches: f.NewCounterVec(prometheus.CounterOpts{
+			Name: "js_sourcemap_fetches",
+		}, []string{"result"}),
+		scripts: make(map[string]*sourceMapEntry),
+	}
+}
+
+// jsLocation is a url:line:column in an error message or stack frame
+var jsLocation = regexp.MustCompile(`(https?://[^\s()@]+?):(\d+):(\d+)`)
+
+// Resolve rewrites the script locations in text,
+// leaving those it can't resolve as they are
+func (sm *sourceMaps) Resolve(ctx context.Context, text string) string {
+	if len(sm.domains) == 0 || text == "" {
+		return text
+	}
+	return jsLocation.ReplaceAllStringFunc(text, func(loc string) string {
+		m := jsLocation.FindStringSubmatch(loc)
+		if !domainList(sm.domains).Allowed(m[1]) {
+			return loc
+		}
+		line, err1 := strconv.Atoi(m[2])
+		col, err2 := strconv.Atoi(m[3])
+		if err1 != nil || err2 != nil {
+			return loc
+		}
+		smap := sm.get(ctx, m[1])
+		if smap == nil {
+			return loc
+		}
+		src, line, col, ok := smap.lookup(line, col)
+		if !ok {
+			return loc
+		}
+		return src + ":" + strconv.Itoa(line) + ":" + strconv.Itoa(col)
+	})
+}
+
+// get is the cached source map for a script,
+// fetching it if it's not cached or expired,
+// concurrent callers wait on the same fetch
+func (sm *sourceMaps) get(ctx context.Context, script string) *sourceMap {
+	if i := strings.IndexByte(script, '#'); i >= 0 {
+		script = script[:i]
+	}
+	now := time.Now()
+	sm.mu.Lock()
+	e, ok := sm.scripts[script]
+	if ok {
+		select {
+		case <-e.ready:
+			if now.Sub(e.fetched) >= sm.ttl {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		for key, old := range sm.scripts {
+			select {
+			case <-old.ready:
+				if now.Sub(old.fetched) >= sm.ttl {
+					delete(sm.scripts, key)
+				}
+			default:
+			}
+		}
+		e = &sourceMapEntry{ready: make(chan struct{})}
+		sm.scripts[script] = e
+	}
+	sm.mu.Unlock()
+
+	if !ok {
+		m, err := sm.fetch(script)
+		switch {
+		case err != nil:
+			sm.fetches.WithLabelValues("error").Inc()
+			sm.log.Debug().Err(err).Str("script", script).Msg("fetch source map")
+		case m == nil:
+			sm.fetches.WithLabelValues("none").Inc()
+		default:
+			sm.fetches.WithLabelValues("ok").Inc()
+		}
+		e.m, e.fetched = m, time.Now()
+		close(e.ready)
+	}
+	select {
+	case <-e.ready:
+		return e.m
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// fetch gets a script's source map from its SourceMap header or sourceMappingURL comment,
+// a nil map without an error if it doesn't have one.
+// It's fetched without the beacon's context, the result is shared.
+func (sm *sourceMaps) fetch(script string) (*sourceMap, error) {
+	res, body, err := sm.download(script)
+	if err != nil {
+		return nil, err
+	}
+	ref := res.Header.Get("sourcemap")
+	if ref == "" {
+		ref = res.Header.Get("x-sourcemap")
+	}
+	if ref == "" {
+		i := strings.LastIndex(string(body), "# sourceMappingURL=")
+		if i < 0 {
+			return nil, nil
+		}
+		fields := strings.Fields(string(body[i+len("# sourceMappingURL="):]))
+		if len(fields) == 0 {
+			return nil, nil
+		}
+		ref = fields[0]
+	}
+
+	var raw []byte
+	if strings.HasPrefix(ref, "data:") {
+		i := strings.Index(ref, ";base64,")
+		if i < 0 {
+			return nil, fmt.Errorf("inline source map: not base64")
+		}
+		raw, err = base64.StdEncoding.DecodeString(ref[i+len(";base64,"):])
+		if err != nil {
+			return nil, fmt.Errorf("inline source map: %w", err)
+		}
+	} else {
+		u, err := res.Request.URL.Parse(ref)
+		if err != nil {
+			return nil, fmt.Errorf("source map url %s: %w", ref, err)
+		}
+		if !domainList(sm.domains).Allowed(u.String()) {
+			return nil, fmt.Errorf("source map %s: not on an owned domain", hostOf(u.String()))
+		}
+		_, raw, err = sm.download(u.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+	m, err := parseSourceMap(raw, res.Request.URL)
+	if err != nil {
+		return nil, fmt.Errorf("source map for %s: %w", script, err)
+	}
+	return m, nil
+}
+
+// download gets u, limited to maxSize
+func (sm *sourceMaps) download(u string) (*http.Response, []byte, error) {
+	res, err := sm.client.Get(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("get %s: %s", u, res.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, sm.maxSize+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("get %s: %w", u, err)
+	}
+	if int64(len(body)) > sm.maxSize {
+		return nil, nil, fmt.Errorf("get %s: larger than %d bytes", u, sm.maxSize)
+	}
+	return res, body, nil
+}
+
+// sourceMap is a decoded version 3 source map,
+// index maps with sections aren't supported
+type sourceMap struct {
+	sources []string
+	lines   [][]mapping // by generated line
+}
+
+// mapping is a segment of a generated line, all 0 based
+type mapping struct {
+	genCol, src, line, col int
+}
+
+func parseSourceMap(raw []byte, script *url.URL) (*sourceMap, error) {
+	var sm struct {
+		Version    int      `json:"version"`
+		SourceRoot string   `json:"sourceRoot"`
+		Sources    []string `json:"sources"`
+		Mappings   string   `json:"mappings"`
+	}
+	err := json.Unmarshal(raw, &sm)
+	if err != nil {
+		return nil, err
+	}
+	if sm.Version != 3 {
+		return nil, fmt.Errorf("unsupported version %d", sm.Version)
+	}
+
+	m := &sourceMap{sources: make([]string, len(sm.Sources))}
+	for i, src := range sm.Sources {
+		m.sources[i] = sourcePath(sm.SourceRoot, src, script)
+	}
+	var src, line, col int
+	for _, l := range strings.Split(sm.Mappings, ";") {
+		var genCol int
+		var segs []mapping
+		for _, seg := range strings.Split(l, ",") {
+			if seg == "" {
+				continue
+			}
+			vs, err := decodeVLQ(seg)
+			if err != nil {
+				return nil, err
+			}
+			genCol += vs[0]
+			if len(vs) < 4 {
+				// no original location
+				continue
+			}
+			src, line, col = src+vs[1], line+vs[2], col+vs[3]
+			if src < 0 || src >= len(m.sources) || line < 0 || col < 0 {
+				return nil, fmt.Errorf("mapping %s out of range", seg)
+			}
+			segs = append(segs, mapping{genCol, src, line, col})
+		}
+		sort.SliceStable(segs, func(i, j int) bool { return segs[i].genCol < segs[j].genCol })
+		m.lines = append(m.lines, segs)
+	}
+	return m, nil
+}
+
+// sourcePath is how a source is shown:
+// relative to the source root, and scheme prefixes like webpack:/// trimmed
+func sourcePath(root, src string, script *url.URL) string {
+	if root != "" && !strings.Contains(src, "://") && !strings.HasPrefix(src, "/") {
+		src = strings.TrimSuffix(root, "/") + "/" + src
+	}
+	if i := strings.Index(src, ":///"); i >= 0 {
+		return src[i+3:]
+	}
+	if u, err := url.Parse(src); err == nil && u.Scheme == "" && !strings.HasPrefix(src, "/") {
+		return path.Join(path.Dir(script.Path), src)
+	}
+	return src
+}
+
+// lookup maps a 1 based generated line and column to the original
+func (m *sourceMap) lookup(line, col int) (string, int, int, bool) {
+	if line < 1 || line > len(m.lines) {
+		return "", 0, 0, false
+	}
+	segs := m.lines[line-1]
+	i := sort.Search(len(segs), func(i int) bool { return segs[i].genCol > col-1 }) - 1
+	if i < 0 {
+		return "", 0, 0, false
+	}
+	seg := segs[i]
+	return m.sources[seg.src], seg.line + 1, seg.col + 1, true
+}
+
+const vlqChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// decodeVLQ decodes a segment of base64 variable length quantities
+func decodeVLQ(seg string) ([]int, error) {
+	var vs []int
+	var v, shift int
+	for i := 0; i < len(seg); i++ {
+		d := strings.IndexByte(vlqChars, seg[i])
+		if d < 0 {
+			return nil, fmt.Errorf("mapping %s: invalid character %q", seg, seg[i])
+		}
+		v += (d & 31) << shift
+		if d&32 != 0 {
+			shift += 5
+			if shift > 30 {
+				return nil, fmt.Errorf("mapping %s: value too large", seg)
+			}
+			continue
+		}
+		if v&1 != 0 {
+			vs = append(vs, -(v >> 1))
+		} else {
+			vs = append(vs, v>>1)
+		}
+		v, shift = 0, 0
+	}
+	if shift != 0 {
+		return nil, fmt.Errorf("mapping %s: truncated", seg)
+	}
+	return vs, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+func TestDecodeVLQ(t *testing.T) {
+	for seg, want := range map[string][]int{
+		"AAAA": {0, 0, 0, 0},
+		"SAAS": {9, 0, 0, 9},
+		"D":    {-1},
+		"gB":   {16},
+		"2HwB": {123, 24},
+	} {
+		got, err := decodeVLQ(seg)
+		if err != nil {
+			t.Errorf("decodeVLQ(%s): %v", seg, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("decodeVLQ(%s) = %v, want %v", seg, got, want)
+		}
+	}
+	for _, seg := range []string{"g", "A!"} {
+		if _, err := decodeVLQ(seg); err == nil {
+			t.Errorf("decodeVLQ(%s): expected an error", seg)
+		}
+	}
+}
+
+func TestSourceMapResolve(t *testing.T) {
+	var fetches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		switch r.URL.Path {
+		case "/static/app.js":
+			w.Write([]byte("function a(){}\n//# sourceMappingURL=app.js.map\n"))
+		case "/static/app.js.map":
+			w.Write([]byte(`{"version":3,"sources":["../src/app.ts"],"mappings":"AAAA,SAAS;AACA"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	o := sourceMapOpts{
+		domains: stringList{"127.0.0.1"},
+		ttl:     time.Hour,
+		maxSize: 1 << 20,
+		timeout: time.Second,
+	}
+	sm := newSourceMaps(o, zerolog.Nop(), promauto.With(prometheus.NewRegistry()))
+	stack := strings.Join([]string{
+		"TypeError: x is undefined",
+		"    at f (" + srv.URL + "/static/app.js:1:12)",
+		"    at " + srv.URL + "/static/app.js:2:1",
+		"g@" + srv.URL + "/static/other.js:1:1",
+		"    at https://cdn.example/lib.js:1:1",
+	}, "\n")
+	want := strings.Join([]string{
+		"TypeError: x is undefined",
+		"    at f (/src/app.ts:1:10)",
+		"    at /src/app.ts:2:10",
+		"g@" + srv.URL + "/static/other.js:1:1",
+		"    at https://cdn.example/lib.js:1:1",
+	}, "\n")
+	for i := 0; i < 2; i++ {
+		if got := sm.Resolve(context.Background(), stack); got != want {
+			t.Errorf("Resolve =\n%s\nwant\n%s", got, want)
+		}
+	}
+	// app.js, its map, and other.js, once each
+	if fetches != 3 {
+		t.Errorf("fetched %d times, want 3", fetches)
+	}
+}
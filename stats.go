@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type durationStats struct {
+	Beacons int64 `json:"beacons"`
+	Sampled int   `json:"sampled"`
+	P50     int64 `json:"p50_ms"`
+	P90     int64 `json:"p90_ms"`
+	P99     int64 `json:"p99_ms"`
+}
+
+type windowStats struct {
+	Window     string        `json:"window"`
+	Directives []topEntry    `json:"directives"`
+	Sources    []topEntry    `json:"sources"`
+	Pages      []topEntry    `json:"pages"`
+	Durations  durationStats `json:"durations"`
+}
+
+// stats serves aggregates over each of ?window=1h (repeatable, default all of top.windows),
+// limited to the ?n=10 largest counts, with the daily unique and online visitors
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	n := 10
+	if v := r.FormValue("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+	var windows []time.Duration
+	for _, v := range r.Form["window"] {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "invalid window", http.StatusBadRequest)
+			return
+		}
+		windows = append(windows, d)
+	}
+	if len(windows) == 0 {
+		for _, tw := range s.top.windows {
+			windows = append(windows, tw.window)
+		}
+	}
+
+	var ws []windowStats
+	for _, window := range windows {
+		st, ok := s.windowStats(window, n, now)
+		if !ok {
+			http.Error(w, fmt.Sprintf("window %v not in top.windows", window), http.StatusNotFound)
+			return
+		}
+		ws = append(ws, st)
+	}
+
+	day, uniques := s.uniques.Estimates()
+	if len(uniques) > n {
+		uniques = uniques[:n]
+	}
+	online := s.online.Count(now)
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Time    time.Time      `json:"time"`
+		Windows []windowStats  `json:"windows"`
+		Day     string         `json:"day"`
+		Uniques []uniqueCount  `json:"uniques"`
+		Online  map[string]int `json:"online"`
+	}{now.UTC(), ws, day, uniques, online})
+}
+
+// windowStats is the n largest counts and the durations in one of top.windows
+func (s *Server) windowStats(window time.Duration, n int, now time.Time) (windowStats, bool) {
+	ds, seen, ok := s.top.Durations(window, now)
+	if !ok {
+		return windowStats{}, false
+	}
+	st := windowStats{
+		Window:    window.String(),
+		Durations: durationStats{Beacons: seen, Sampled: len(ds)},
+	}
+	if len(ds) > 0 {
+		st.Durations.P50 = percentile(ds, 50)
+		st.Durations.P90 = percentile(ds, 90)
+		st.Durations.P99 = percentile(ds, 99)
+	}
+	st.Directives, _ = s.top.Top("directive", window, n, now)
+	st.Sources, _ = s.top.Top("violation", window, n, now)
+	st.Pages, _ = s.top.Top("page", window, n, now)
+	return st, true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.seankhliao.com/apis/saver/v1"
+)
+
+// tail fans out forwarded records to live subscribers,
+// slow subscribers miss records rather than block forwarding
+type tail struct {
+	mu   sync.Mutex
+	subs map[chan record]struct{}
+}
+
+func newTail() *tail {
+	return &tail{subs: make(map[chan record]struct{})}
+}
+
+func (t *tail) Publish(rec record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.subs {
+		select {
+		case c <- rec:
+		default:
+		}
+	}
+}
+
+func (t *tail) subscribe() chan record {
+	c := make(chan record, 64)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subs[c] = struct{}{}
+	return c
+}
+
+func (t *tail) unsubscribe(c chan record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.subs, c)
+}
+
+// ServeHTTP streams records as server sent events,
+// optionally filtered by ?handler= (csp or /csp) and ?directive=
+func (t *tail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	handler, directive := r.FormValue("handler"), r.FormValue("directive")
+
+	// subscribe first so nothing is missed once the client sees the headers
+	c := t.subscribe()
+	defer t.unsubscribe(c)
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case rec := <-c:
+			if handler != "" && strings.TrimPrefix(rec.Handler, "/") != strings.TrimPrefix(handler, "/") {
+				continue
+			}
+			if directive != "" {
+				cr, ok := rec.Report.(*saver.CSPRequest)
+				if !ok || cr.EffectiveDirective != directive {
+					continue
+				}
+			}
+			b, err := json.Marshal(rec)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", b)
+			f.Flush()
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.seankhliao.com/apis/saver/v1"
+)
+
+func TestTailHandlerFilter(t *testing.T) {
+	for _, filter := range []string{"csp", "/csp"} {
+		t.Run(filter, func(t *testing.T) {
+			tl := newTail()
+			srv := httptest.NewServer(tl)
+			defer srv.Close()
+			res, err := http.Get(srv.URL + "?handler=" + filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			tl.Publish(record{Handler: "/beacon", Report: &saver.BeaconRequest{}})
+			tl.Publish(record{Handler: "/csp", Report: &saver.CSPRequest{EffectiveDirective: "script-src"}})
+
+			sc := bufio.NewScanner(res.Body)
+			for sc.Scan() {
+				line := sc.Text()
+				if !strings.HasPrefix(line, "data: ") {
+					continue
+				}
+				if !strings.Contains(line, `"handler":"/csp"`) {
+					t.Errorf("got %s, want the /csp record", line)
+				}
+				return
+			}
+			t.Fatalf("no record: %v", sc.Err())
+		})
+	}
+}
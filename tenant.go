@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.seankhliao.com/usvc"
+)
+
+type tenantOpts struct {
+	from  stringList
+	keys  stringList
+	sites stringList
+	rates stringList
+}
+
+func (o *tenantOpts) Flags(fs *flag.FlagSet) {
+	fs.Var(&o.from, "tenant.from", "comma separated ways to find the site a report is for, tried in order: key (x-api-key header or key query parameter), host, path (first path segment, eg /blog/csp), disabled if empty")
+	fs.Var(secret(&o.keys), "tenant.keys", "comma separated key=site api keys for tenant.from=key")
+	fs.Var(&o.sites, "tenant.sites", "comma separated sites accepted from host and path, required with either")
+	fs.Var(&o.rates, "tenant.rate", "comma separated site=reports per second limits, * for sites not listed, unlimited if unset")
+}
+
+func (o tenantOpts) validate() error {
+	_, err := newTenants(o, nil)
+	return err
+}
+
+// tenants identifies which site a report is for,
+// limiting the rate of reports for each
+type tenants struct {
+	from  []string
+	keys  map[string]string
+	sites labelSet
+	rates map[string]float64
+
+	mu      sync.Mutex
+	buckets map[string]*tenantBucket
+	limited *prometheus.CounterVec
+}
+
+// tenantBucket is a token bucket holding up to a second of reports
+type tenantBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTenants(o tenantOpts, f *promauto.Factory) (*tenants, error) {
+	t := &tenants{
+		from:    o.from,
+		keys:    make(map[string]string),
+		rates:   make(map[string]float64),
+		buckets: make(map[string]*tenantBucket),
+	}
+	for _, src := range o.from {
+		switch src {
+		case "key", "host", "path":
+		default:
+			return nil, fmt.Errorf("tenant.from: unknown source %s", src)
+		}
+	}
+	for _, kv := range o.keys {
+		i := strings.Index(kv, "=")
+		if i <= 0 || !siteKey.MatchString(kv[i+1:]) || kv[i+1:] == "" {
+			return nil, fmt.Errorf("tenant.keys: expected key=site, site of letters, digits, and ._-")
+		}
+		t.keys[kv[:i]] = kv[i+1:]
+	}
+	if (o.from.contains("host") || o.from.contains("path")) && len(o.sites) == 0 {
+		// every host or path a client sends would be a new label and bucket
+		return nil, fmt.Errorf("tenant.sites: required for tenant.from host or path")
+	}
+	for _, site := range o.sites {
+		if !siteKey.MatchString(site) {
+			return nil, fmt.Errorf("tenant.sites: invalid site %q", site)
+		}
+	}
+	if len(o.sites) > 0 {
+		t.sites = newLabelSet(o.sites)
+	}
+	for _, kv := range o.rates {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("tenant.rate: expected site=reports per second: %q", kv)
+		}
+		rate, err := strconv.ParseFloat(kv[i+1:], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("tenant.rate: %q: rate should be positive", kv)
+		}
+		t.rates[kv[:i]] = rate
+	}
+	if f != nil {
+		t.limited = f.NewCounterVec(prometheus.CounterOpts{
+			Name: "tenant_rate_limited",
+		}, []string{"tenant"})
+	}
+	return t, nil
+}
+
+func (t *tenants) enabled() bool {
+	return len(t.from) > 0
+}
+
+type tenantPathKey struct{}
+
+// of is the site r is for, false if none of tenant.from identify it,
+// always one of tenant.keys or tenant.sites
+func (t *tenants) of(r *http.Request) (string, bool) {
+	for _, src := range t.from {
+		var site string
+		switch src {
+		case "key":
+			key := r.Header.Get("x-api-key")
+			if key == "" {
+				key = r.URL.Query().Get("key")
+			}
+			if site, ok := t.keys[key]; ok && key != "" {
+				return site, true
+			}
+			continue
+		case "host":
+			site = r.Host
+			if h, _, err := net.SplitHostPort(site); err == nil {
+				site = h
+			}
+			site = strings.ToLower(site)
+		case "path":
+			site, _ = r.Context().Value(tenantPathKey{}).(string)
+		}
+		if site != "" && siteKey.MatchString(site) && (t.sites == nil || t.sites[site]) {
+			return site, true
+		}
+	}
+	return "", false
+}
+
+// allow takes a report from site's bucket
+func (t *tenants) allow(site string, now time.Time) bool {
+	rate, ok := t.rates[site]
+	if !ok {
+		rate, ok = t.rates["*"]
+	}
+	if !ok {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.buckets[site]
+	if !ok {
+		b = &tenantBucket{tokens: rate, last: now}
+		t.buckets[site] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+	if b.tokens < 1 {
+		t.limited.WithLabelValues(site).Inc()
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// tenant rejects reports for unknown sites and sites over their rate,
+// returning true if the request was handled
+func (s *Server) tenant(w http.ResponseWriter, r *http.Request) bool {
+	if !s.tenants.enabled() {
+		return false
+	}
+	site, ok := s.tenants.of(r)
+	if !ok {
+		s.response.httpError(r.Context(), w, http.StatusForbidden, fmt.Errorf("unknown site"))
+		s.count(r, "unknown-tenant")
+		return true
+	}
+	if !s.tenants.allow(site, time.Now()) {
+		w.Header().Set("retry-after", "1")
+		s.response.httpError(r.Context(), w, http.StatusTooManyRequests, fmt.Errorf("rate limited"))
+		s.count(r, "rate-limited")
+		return true
+	}
+	return false
+}
+
+// tenantOf is the site r is for, empty if tenants aren't enabled
+func (s *Server) tenantOf(r *http.Request) string {
+	if !s.tenants.enabled() {
+		return ""
+	}
+	site, _ := s.tenants.of(r)
+	return site
+}
+
+// tenantLabels adds the tenant label to metrics broken down by site
+func (s *Server) tenantLabels(names ...string) []string {
+	if len(s.tenantOpts.from) > 0 {
+		names = append(names, "tenant")
+	}
+	return names
+}
+
+// tenantValues adds the site of r to label values, matching tenantLabels
+func (s *Server) tenantValues(r *http.Request, values ...string) []string {
+	if s.tenants.enabled() {
+		values = append(values, s.tenantOf(r))
+	}
+	return values
+}
+
+// withTenant makes the site available to filter rules as tenant
+func withTenant(field func(string) string, site string) func(string) string {
+	return func(name string) string {
+		if name == "tenant" {
+			return site
+		}
+		return field(name)
+	}
+}
+
+// setupTenants serves the report handlers under a site path segment for tenant.from=path,
+// /blog/csp is handled as /csp for blog
+func (s *Server) setupTenants(u *usvc.USVC) {
+	if !s.tenantOpts.from.contains("path") {
+		return
+	}
+	next := u.ServiceServer.Handler
+	u.ServiceServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, "/")
+		i := strings.Index(p, "/")
+		if i > 0 && siteKey.MatchString(p[:i]) {
+			r2 := r.Clone(context.WithValue(r.Context(), tenantPathKey{}, p[:i]))
+			r2.URL.Path = p[i:]
+			r2.URL.RawPath = ""
+			if _, pattern := u.ServiceMux.Handler(r2); pattern != "" {
+				next.ServeHTTP(w, r2)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// topSlots is the number of slots a window is split into,
+// the window slides one slot at a time
+const topSlots = 12
+
+type topOpts struct {
+	windows  stringList
+	capacity int
+	file     string
+}
+
+func (o *topOpts) Flags(fs *flag.FlagSet) {
+	o.windows = stringList{"1h", "24h"}
+	fs.Var(&o.windows, "top.windows", "comma separated windows to count top pages, violation sources and directives over, empty to disable")
+	fs.IntVar(&o.capacity, "top.capacity", 1000, "entries tracked per kind and window slot, counts are approximate beyond this")
+	fs.StringVar(&o.file, "top.file", "", "file to persist top counts in across restarts")
+}
+
+func (o topOpts) durations() ([]time.Duration, error) {
+	var ds []time.Duration
+	for _, w := range o.windows {
+		d, err := time.ParseDuration(w)
+		if err != nil || d < topSlots*time.Second {
+			return nil, fmt.Errorf("top.windows: invalid window %q", w)
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+func (o topOpts) validate() error {
+	_, err := o.durations()
+	return err
+}
+
+// spaceSaving approximately counts the most frequent keys in bounded space,
+// a new key evicts the least frequent one, inheriting its count
+type spaceSaving map[string]uint64
+
+func (ss spaceSaving) add(key string, capacity int) {
+	if _, ok := ss[key]; !ok && len(ss) >= capacity {
+		var minK string
+		var minN uint64
+		for k, n := range ss {
+			if minK == "" || n < minN {
+				minK, minN = k, n
+			}
+		}
+		delete(ss, minK)
+		ss[key] = minN
+	}
+	ss[key]++
+}
+
+type topSlot struct {
+	Epoch int64                  `json:"epoch"` // start of slot / slot length
+	Kinds map[string]spaceSaving `json:"kinds"`
+
+	// reservoir sample of beacon durations in ms, of DurationsSeen
+	Durations     []int64 `json:"durations,omitempty"`
+	DurationsSeen int64   `json:"durations_seen,omitempty"`
+}
+
+type topWindow struct {
+	window time.Duration
+	slots  [topSlots]topSlot
+}
+
+func (tw *topWindow) slot() time.Duration {
+	return tw.window / topSlots
+}
+
+// top counts the most common pages and violation sources over sliding windows
+type top struct {
+	topOpts
+	log zerolog.Logger
+
+	mu      sync.Mutex
+	windows []*topWindow
+}
+
+func newTop(ctx context.Context, o topOpts, log zerolog.Logger) (*top, error) {
+	ds, err := o.durations()
+	if err != nil {
+		return nil, err
+	}
+	t := &top{topOpts: o, log: log}
+	for _, d := range ds {
+		t.windows = append(t.windows, &topWindow{window: d})
+	}
+	if o.file != "" && len(ds) > 0 {
+		err = t.load()
+		if err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("file", o.file).Msg("load top counts")
+		}
+		go t.persist(ctx)
+	}
+	return t, nil
+}
+
+// current returns the slot for now, clearing it if it is stale
+func (tw *topWindow) current(now time.Time) *topSlot {
+	epoch := now.UnixNano() / int64(tw.slot())
+	s := &tw.slots[epoch%topSlots]
+	if s.Epoch != epoch {
+		*s = topSlot{Epoch: epoch, Kinds: make(map[string]spaceSaving)}
+	}
+	return s
+}
+
+// Add counts key of kind: page, violation or directive
+func (t *top) Add(kind, key string, now time.Time) {
+	if key == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tw := range t.windows {
+		s := tw.current(now)
+		ss, ok := s.Kinds[kind]
+		if !ok {
+			ss = make(spaceSaving)
+			s.Kinds[kind] = ss
+		}
+		ss.add(key, t.capacity)
+	}
+}
+
+// Duration samples a beacon duration, keeping up to capacity per slot
+func (t *top) Duration(ms int64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tw := range t.windows {
+		s := tw.current(now)
+		s.DurationsSeen++
+		if len(s.Durations) < t.capacity {
+			s.Durations = append(s.Durations, ms)
+		} else if i := rand.Int63n(s.DurationsSeen); i < int64(t.capacity) {
+			s.Durations[i] = ms
+		}
+	}
+}
+
+// Durations is the sorted sample of beacon durations in the window
+// and the number of beacons it was drawn from
+func (t *top) Durations(window time.Duration, now time.Time) ([]int64, int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tw := range t.windows {
+		if tw.window != window {
+			continue
+		}
+		epoch := now.UnixNano() / int64(tw.slot())
+		var ds []int64
+		var seen int64
+		for _, s := range tw.slots {
+			if s.Epoch <= epoch-topSlots {
+				continue
+			}
+			ds = append(ds, s.Durations...)
+			seen += s.DurationsSeen
+		}
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+		return ds, seen, true
+	}
+	return nil, 0, false
+}
+
+type topEntry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// Top is the n most common keys of kind in the window
+func (t *top) Top(kind string, window time.Duration, n int, now time.Time) ([]topEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tw := range t.windows {
+		if tw.window != window {
+			continue
+		}
+		epoch := now.UnixNano() / int64(tw.slot())
+		sum := make(map[string]uint64)
+		for _, s := range tw.slots {
+			if s.Epoch <= epoch-topSlots {
+				continue
+			}
+			for k, c := range s.Kinds[kind] {
+				sum[k] += c
+			}
+		}
+		es := make([]topEntry, 0, len(sum))
+		for k, c := range sum {
+			es = append(es, topEntry{k, c})
+		}
+		sort.Slice(es, func(i, j int) bool {
+			if es[i].Count != es[j].Count {
+				return es[i].Count > es[j].Count
+			}
+			return es[i].Key < es[j].Key
+		})
+		if len(es) > n {
+			es = es[:n]
+		}
+		return es, true
+	}
+	return nil, false
+}
+
+// Each calls fn for every slot of window from oldest to newest,
+// with a nil slot if nothing was counted in it
+func (t *top) Each(window time.Duration, now time.Time, fn func(start time.Time, s *topSlot)) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tw := range t.windows {
+		if tw.window != window {
+			continue
+		}
+		epoch := now.UnixNano() / int64(tw.slot())
+		for e := epoch - topSlots + 1; e <= epoch; e++ {
+			s := &tw.slots[e%topSlots]
+			if s.Epoch != e {
+				s = nil
+			}
+			fn(time.Unix(0, e*int64(tw.slot())), s)
+		}
+		return true
+	}
+	return false
+}
+
+// Series is the total count of kind per slot in the first window, oldest first
+func (t *top) Series(kind string, now time.Time) []uint64 {
+	if len(t.windows) == 0 {
+		return nil
+	}
+	var series []uint64
+	t.Each(t.windows[0].window, now, func(_ time.Time, s *topSlot) {
+		var n uint64
+		if s != nil {
+			for _, c := range s.Kinds[kind] {
+				n += c
+			}
+		}
+		series = append(series, n)
+	})
+	return series
+}
+
+// ServeHTTP serves ?kind=page|violation|directive&window=1h&n=10
+func (t *top) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kind := r.FormValue("kind")
+	if kind == "" {
+		kind = "page"
+	}
+	window := time.Hour
+	if v := r.FormValue("window"); v != "" {
+		var err error
+		window, err = time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "invalid window", http.StatusBadRequest)
+			return
+		}
+	} else if len(t.windows) > 0 {
+		window = t.windows[0].window
+	}
+	n := 10
+	if v := r.FormValue("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+	}
+	es, ok := t.Top(kind, window, n, time.Now())
+	if !ok {
+		http.Error(w, fmt.Sprintf("window %v not in top.windows", window), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Kind   string     `json:"kind"`
+		Window string     `json:"window"`
+		Top    []topEntry `json:"top"`
+	}{kind, window.String(), es})
+}
+
+// persisted is the file format of top.file, slots by window
+type persisted map[string][topSlots]topSlot
+
+func (t *top) load() error {
+	b, err := ioutil.ReadFile(t.file)
+	if err != nil {
+		return err
+	}
+	var p persisted
+	err = json.Unmarshal(b, &p)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tw := range t.windows {
+		if slots, ok := p[tw.window.String()]; ok {
+			tw.slots = slots
+		}
+	}
+	return nil
+}
+
+func (t *top) save() error {
+	t.mu.Lock()
+	p := make(persisted, len(t.windows))
+	for _, tw := range t.windows {
+		p[tw.window.String()] = tw.slots
+	}
+	b, err := json.Marshal(p)
+	t.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	tmp := t.file + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.file)
+}
+
+// persist saves the counts every minute and on shutdown
+func (t *top) persist(ctx context.Context) {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := t.save(); err != nil {
+				t.log.Error().Err(err).Str("file", t.file).Msg("save top counts")
+			}
+			return
+		case <-tick.C:
+			if err := t.save(); err != nil {
+				t.log.Error().Err(err).Str("file", t.file).Msg("save top counts")
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/trace/jaeger"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+type traceOpts struct {
+	sampler  string
+	ratio    float64
+	agent    string
+	disabled bool
+	handlers stringList
+
+	fs *flag.FlagSet
+}
+
+func (o *traceOpts) Flags(fs *flag.FlagSet) {
+	o.fs = fs
+	fs.StringVar(&o.sampler, "trace.sampler", "", "trace sampler: always, never, ratio, parent-ratio. overrides -trace, keeps the usvc setup if empty and no -trace.agent")
+	fs.Float64Var(&o.ratio, "trace.ratio", 0.1, "fraction of traces to sample for the ratio samplers")
+	fs.StringVar(&o.agent, "trace.agent", "", "host:port of a jaeger agent to export to instead of -trace.collector")
+	fs.BoolVar(&o.disabled, "trace.disabled", false, "don't create spans for handlers and saver calls")
+	o.handlers = stringList{"csp", "beacon"}
+	fs.Var(&o.handlers, "trace.handlers", "comma separated handlers to create spans for: csp, beacon")
+}
+
+// tracer is the tracer for handler,
+// a noop tracer if it shouldn't be traced.
+// usvc's request spans are only sampled with -trace,
+// and the health checks on the metrics port are never traced
+func (o traceOpts) tracer(handler string) trace.Tracer {
+	if o.disabled || !o.handlers.contains(handler) {
+		return trace.NoopTracerProvider().Tracer(name)
+	}
+	return global.Tracer(name)
+}
+
+func (o traceOpts) validate() error {
+	switch o.sampler {
+	case "", "always", "never", "ratio", "parent-ratio":
+		return nil
+	}
+	return fmt.Errorf("unknown trace.sampler: %s", o.sampler)
+}
+
+// install replaces the tracer pipeline setup by usvc
+// if a sampler or exporter was configured
+func (o traceOpts) install(ctx context.Context) error {
+	if o.disabled {
+		global.SetTracerProvider(trace.NoopTracerProvider())
+		return nil
+	}
+	if o.sampler == "" && o.agent == "" {
+		return nil
+	}
+
+	var sampler sdktrace.Sampler
+	switch o.sampler {
+	case "always":
+		sampler = sdktrace.AlwaysSample()
+	case "never":
+		sampler = sdktrace.NeverSample()
+	case "ratio":
+		sampler = sdktrace.TraceIDRatioBased(o.ratio)
+	case "", "parent-ratio":
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.ratio))
+	default:
+		return fmt.Errorf("unknown trace sampler: %s", o.sampler)
+	}
+
+	endpoint := jaeger.WithCollectorEndpoint(o.fs.Lookup("trace.collector").Value.String(), jaeger.WithCollectorEndpointOptionFromEnv())
+	if o.agent != "" {
+		endpoint = jaeger.WithAgentEndpoint(o.agent)
+	}
+	flush, err := jaeger.InstallNewPipeline(
+		endpoint,
+		jaeger.WithProcess(jaeger.Process{
+			ServiceName: name,
+		}),
+		jaeger.WithProcessFromEnv(),
+		jaeger.WithSDK(&sdktrace.Config{DefaultSampler: sampler}),
+	)
+	if err != nil {
+		return fmt.Errorf("install trace pipeline: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		flush()
+	}()
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+)
+
+// uaFamily is a coarse browser family from a user agent string
+func uaFamily(ua string) string {
+	switch {
+	case ua == "":
+		return "unknown"
+	case strings.Contains(ua, "bot"), strings.Contains(ua, "Bot"), strings.Contains(ua, "spider"), strings.Contains(ua, "crawl"):
+		return "bot"
+	case strings.Contains(ua, "Edg/"), strings.Contains(ua, "Edge/"), strings.Contains(ua, "EdgA/"), strings.Contains(ua, "EdgiOS/"):
+		return "edge"
+	case strings.Contains(ua, "OPR/"), strings.Contains(ua, "Opera"):
+		return "opera"
+	case strings.Contains(ua, "Firefox/"), strings.Contains(ua, "FxiOS/"):
+		return "firefox"
+	case strings.Contains(ua, "Chrome/"), strings.Contains(ua, "CriOS/"):
+		return "chrome"
+	case strings.Contains(ua, "Safari/"):
+		return "safari"
+	}
+	return "other"
+}
+
+// uaVersionTokens are where each family's version is found, in order of preference
+var uaVersionTokens = map[string][]string{
+	"edge":    {"Edg/", "Edge/", "EdgA/", "EdgiOS/"},
+	"opera":   {"OPR/", "Version/", "Opera/"},
+	"firefox": {"Firefox/", "FxiOS/"},
+	"chrome":  {"Chrome/", "CriOS/"},
+	"safari":  {"Version/"},
+}
+
+// userAgent is the low cardinality structure of a user agent string
+type userAgent struct {
+	Browser string
+	Version string // major only
+	OS      string
+	Device  string
+}
+
+func parseUA(ua string) userAgent {
+	u := userAgent{
+		Browser: uaFamily(ua),
+		OS:      uaOS(ua),
+	}
+	for _, tok := range uaVersionTokens[u.Browser] {
+		if i := strings.Index(ua, tok); i >= 0 {
+			v := ua[i+len(tok):]
+			if end := strings.IndexAny(v, ". ;)"); end >= 0 {
+				v = v[:end]
+			}
+			u.Version = v
+			break
+		}
+	}
+	switch {
+	case u.Browser == "bot":
+		u.Device = "bot"
+	case strings.Contains(ua, "iPad"), strings.Contains(ua, "Tablet"), u.OS == "android" && !strings.Contains(ua, "Mobile"):
+		u.Device = "tablet"
+	case strings.Contains(ua, "Mobi"), strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPod"):
+		u.Device = "mobile"
+	case ua == "":
+		u.Device = "unknown"
+	default:
+		u.Device = "desktop"
+	}
+	return u
+}
+
+func uaOS(ua string) string {
+	switch {
+	case ua == "":
+		return "unknown"
+	case strings.Contains(ua, "Android"):
+		return "android"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"), strings.Contains(ua, "iPod"):
+		return "ios"
+	case strings.Contains(ua, "Windows"):
+		return "windows"
+	case strings.Contains(ua, "CrOS"):
+		return "chromeos"
+	case strings.Contains(ua, "Mac OS X"), strings.Contains(ua, "Macintosh"):
+		return "macos"
+	case strings.Contains(ua, "Linux"):
+		return "linux"
+	}
+	return "other"
+}
+
+// metadata is u as grpc metadata key value pairs
+func (u userAgent) metadata() []string {
+	kv := []string{"ua-browser", u.Browser, "ua-os", u.OS, "ua-device", u.Device}
+	if u.Version != "" {
+		kv = append(kv, "ua-browser-version", u.Version)
+	}
+	return kv
+}
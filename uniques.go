@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type uniquesOpts struct {
+	sketches int
+}
+
+func (o *uniquesOpts) Flags(fs *flag.FlagSet) {
+	fs.IntVar(&o.sketches, "uniques.sketches", 100, "maximum site and page combinations to estimate daily unique visitors for, 4KiB each, 0 to disable")
+}
+
+type uniqueKey struct {
+	site string
+	page string
+}
+
+// uniques estimates distinct visitors per site and page for the current UTC day,
+// from the daily visitor tokens, keeping nothing per visitor
+type uniques struct {
+	uniquesOpts
+	gauge  *prometheus.GaugeVec
+	full   prometheus.Counter
+	mu     sync.Mutex
+	day    string
+	counts map[uniqueKey]*hll
+}
+
+func newUniques(ctx context.Context, o uniquesOpts, f promauto.Factory) *uniques {
+	u := &uniques{
+		uniquesOpts: o,
+		gauge: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "unique_visitors",
+		}, []string{"site", "page"}),
+		full: f.NewCounter(prometheus.CounterOpts{
+			Name: "unique_visitors_untracked",
+		}),
+		counts: make(map[uniqueKey]*hll),
+	}
+	if o.sketches > 0 {
+		go u.run(ctx)
+	}
+	return u
+}
+
+// Add counts a visitor to a page
+func (u *uniques) Add(site, page, visitor string, t time.Time) {
+	if u.sketches <= 0 {
+		return
+	}
+	day := t.UTC().Format("2006-01-02")
+	k := uniqueKey{site, page}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if day != u.day {
+		u.day, u.counts = day, make(map[uniqueKey]*hll)
+	}
+	h, ok := u.counts[k]
+	if !ok {
+		if len(u.counts) >= u.sketches {
+			u.full.Inc()
+			return
+		}
+		h = new(hll)
+		u.counts[k] = h
+	}
+	h.Add(visitor)
+}
+
+type uniqueCount struct {
+	Site     string `json:"site"`
+	Page     string `json:"page"`
+	Visitors uint64 `json:"visitors"`
+}
+
+// Estimates are the current day's estimates, most visited first
+func (u *uniques) Estimates() (string, []uniqueCount) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.day != time.Now().UTC().Format("2006-01-02") {
+		return u.day, nil
+	}
+	var cs []uniqueCount
+	for k, h := range u.counts {
+		cs = append(cs, uniqueCount{k.site, k.page, h.Estimate()})
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Visitors > cs[j].Visitors })
+	return u.day, cs
+}
+
+// run refreshes the gauges, estimating is too slow to do per visit
+func (u *uniques) run(ctx context.Context) {
+	t := time.NewTicker(15 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			_, cs := u.Estimates()
+			u.gauge.Reset()
+			for _, c := range cs {
+				u.gauge.WithLabelValues(c.Site, c.Page).Set(float64(c.Visitors))
+			}
+		}
+	}
+}
+
+func (u *uniques) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	day, cs := u.Estimates()
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Day   string        `json:"day"`
+		Pages []uniqueCount `json:"pages"`
+	}{day, cs})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// fileVersion identifies a version of a file's contents,
+// os.Stat follows the symlinks kubernetes swaps on configmap updates
+type fileVersion struct {
+	mod  time.Time
+	size int64
+}
+
+func statVersion(fn string) fileVersion {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return fileVersion{}
+	}
+	return fileVersion{fi.ModTime(), fi.Size()}
+}
+
+// watchFiles polls fns every interval, calling changed when any of them change
+func watchFiles(ctx context.Context, interval time.Duration, fns []string, changed func()) {
+	if interval <= 0 || len(fns) == 0 {
+		return
+	}
+	last := make([]fileVersion, len(fns))
+	for i, fn := range fns {
+		last[i] = statVersion(fn)
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			var change bool
+			for i, fn := range fns {
+				v := statVersion(fn)
+				if v != last[i] {
+					last[i] = v
+					change = true
+				}
+			}
+			if change {
+				changed()
+			}
+		}
+	}()
+}